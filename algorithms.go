@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// The key exchange, cipher and MAC algorithms which may be enabled with -kex,
+// -ciphers and -macs.
+var (
+	supportedKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	}
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// The algorithms enabled by default, which exclude those relying on SHA-1.
+const (
+	defaultKexAlgorithms = "curve25519-sha256,curve25519-sha256@libssh.org,ecdh-sha2-nistp256,ecdh-sha2-nistp384,ecdh-sha2-nistp521,diffie-hellman-group14-sha256"
+	defaultCiphers       = "aes128-gcm@openssh.com,chacha20-poly1305@openssh.com,aes128-ctr,aes192-ctr,aes256-ctr"
+	defaultMACs          = "hmac-sha2-256-etm@openssh.com,hmac-sha2-256"
+)
+
+// parseAlgorithms parses a comma-separated list of algorithms, checking that
+// each is one of supported.
+func parseAlgorithms(s string, supported []string) ([]string, error) {
+	algs := splitList(s)
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("at least one algorithm must be given")
+	}
+
+	for _, alg := range algs {
+		if !contains(supported, alg) {
+			return nil, fmt.Errorf("unsupported algorithm %q: must be one of %v", alg, strings.Join(supported, ", "))
+		}
+	}
+	return algs, nil
+}
+
+// logAlgorithms logs the algorithms negotiated for conn, with the host key
+// algorithm and the details of each direction only logged with -debug.
+func logAlgorithms(conn gossh.ConnMetadata) {
+	meta, ok := conn.(gossh.AlgorithmsConnMetadata)
+	if !ok {
+		return
+	}
+	algs := meta.Algorithms()
+
+	// The client's writes are the server's reads.
+	cipher, mac := algs.Read.Cipher, algs.Read.MAC
+	if algs.Write.Cipher != cipher || algs.Write.MAC != mac {
+		logDebug(fmt.Sprintf("negotiated cipher %v, mac %v from client to server, cipher %v, mac %v from server to client",
+			algs.Read.Cipher, algs.Read.MAC, algs.Write.Cipher, algs.Write.MAC))
+	}
+	if isAEADCipher(cipher) {
+		// AEAD ciphers provide their own integrity protection, so the
+		// negotiated MAC isn't used.
+		mac = "implicit"
+	}
+
+	logNotice(fmt.Sprintf("negotiated kex %v, cipher %v, mac %v", algs.KeyExchange, cipher, mac))
+	logDebug(fmt.Sprintf("negotiated host key algorithm %v", algs.HostKey))
+}
+
+func isAEADCipher(cipher string) bool {
+	return strings.HasPrefix(cipher, "aes128-gcm@") ||
+		strings.HasPrefix(cipher, "aes256-gcm@") ||
+		strings.HasPrefix(cipher, "chacha20-poly1305@")
+}
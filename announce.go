@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// announcer publishes the generated host key, so that clients can learn which
+// key to expect.
+type announcer interface {
+	announce(key ssh.PublicKey) error
+}
+
+// newAnnouncer returns the announcer for the given -announce-mode, announcing
+// to target.
+func newAnnouncer(mode, target string) (announcer, error) {
+	switch mode {
+	case "command":
+		if err := validateAnnouncement(target); err != nil {
+			return nil, err
+		}
+		return commandAnnouncer{command: target}, nil
+	case "http":
+		if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			return nil, fmt.Errorf("%v is not an http or https URL", target)
+		}
+		return httpAnnouncer{url: target}, nil
+	case "file":
+		return fileAnnouncer{path: target}, nil
+	default:
+		return nil, fmt.Errorf("unknown announce mode %q: expected command, http or file", mode)
+	}
+}
+
+// commandAnnouncer runs a command with the known_hosts line for the key as its
+// last argument.
+type commandAnnouncer struct {
+	command string
+}
+
+func (a commandAnnouncer) announce(key ssh.PublicKey) error {
+	if stderr, err := performAnnouncement(a.command, key); err != nil {
+		return fmt.Errorf("%w, stderr: %v", err, stderr)
+	}
+
+	logNotice(fmt.Sprintf("announced host key by running %q, which exited with status 0", a.command))
+	return nil
+}
+
+// httpAnnouncer POSTs the known_hosts line for the key to a URL.
+type httpAnnouncer struct {
+	url string
+}
+
+func (a httpAnnouncer) announce(key ssh.PublicKey) error {
+	resp, err := http.Post(a.url, "text/plain", strings.NewReader(formatKnownHosts(key)+"\n"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+
+	logNotice(fmt.Sprintf("announced host key to %v, which responded with status %v", a.url, resp.Status))
+	return nil
+}
+
+// fileAnnouncer appends the known_hosts line for the key to a file.
+type fileAnnouncer struct {
+	path string
+}
+
+func (a fileAnnouncer) announce(key ssh.PublicKey) error {
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(f, formatKnownHosts(key)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	logNotice(fmt.Sprintf("announced host key to %v", a.path))
+	return nil
+}
+
+// announceHostKey announces key with a, logging rather than returning any
+// failure, as the server can still be used without the announcement.
+func announceHostKey(a announcer, key ssh.PublicKey) {
+	if err := a.announce(key); err != nil {
+		logWarn(fmt.Sprintf("announcement failed: %v", err))
+	}
+}
+
+func validateAnnouncement(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New("command is empty")
+	}
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("failed to find %v: %w", args[0], err)
+	}
+	return nil
+}
+
+func performAnnouncement(command string, key ssh.PublicKey) (stderr string, err error) {
+	args := strings.Fields(command)
+	args = append(args, formatKnownHosts(key))
+	_, err = exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		var eerr *exec.ExitError
+		if errors.As(err, &eerr) {
+			return string(eerr.Stderr), err
+		}
+		return "", err
+	}
+	return "", nil
+}
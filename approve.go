@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ttyApprover asks the operator, on the terminal otsshd is running in,
+// whether each session may proceed.
+type ttyApprover struct {
+	tty     *os.File
+	timeout time.Duration
+	lines   chan string
+
+	// mu ensures only one prompt is shown at a time.
+	mu sync.Mutex
+}
+
+// newTTYApprover opens the controlling terminal to prompt on. The terminal is
+// used rather than stdin, which may have been used to pass authorized keys.
+func newTTYApprover(timeout time.Duration) (*ttyApprover, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open terminal: %w", err)
+	}
+
+	a := &ttyApprover{
+		tty:     tty,
+		timeout: timeout,
+		lines:   make(chan string, 1),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(tty)
+		for scanner.Scan() {
+			a.lines <- scanner.Text()
+		}
+		close(a.lines)
+	}()
+
+	return a, nil
+}
+
+// approve shows prompt and reports whether the operator answered yes within
+// the timeout.
+func (a *ttyApprover) approve(prompt string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Discard anything typed since the last prompt, such as an answer which
+	// arrived after it timed out.
+	select {
+	case <-a.lines:
+	default:
+	}
+
+	fmt.Fprintf(a.tty, "%v [y/N] ", prompt)
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	select {
+	case line, ok := <-a.lines:
+		if !ok {
+			return false
+		}
+		answer := strings.ToLower(strings.TrimSpace(line))
+		return answer == "y" || answer == "yes"
+	case <-timer.C:
+		fmt.Fprintf(a.tty, "\nno answer within %v, denying\n", a.timeout)
+		return false
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// attachment connects a running shell to the SSH session currently attached
+// to it.
+//
+// If a reconnect grace period is configured, the shell outlives the session
+// which started it: when that session disconnects, another session
+// authenticated with the same key may reattach to the shell within the grace
+// period. If nobody reattaches in time, the shell is killed.
+type attachment struct {
+	grace      time.Duration
+	requirePty bool
+	readOnly   bool
+
+	mu      sync.Mutex
+	pty     *os.File
+	process *os.Process
+	key     ssh.PublicKey
+	session ssh.Session
+	input   io.Writer
+	timer   *time.Timer
+	expired bool
+	exited  chan struct{}
+}
+
+func newAttachment(grace time.Duration, requirePty, readOnly bool) *attachment {
+	return &attachment{
+		grace:      grace,
+		requirePty: requirePty,
+		readOnly:   readOnly,
+		exited:     make(chan struct{}),
+	}
+}
+
+// start attaches s, the session which started the shell, to the shell's PTY.
+// The input of s, and of any sessions which reattach, is written to input if
+// it isn't nil.
+func (a *attachment) start(f *os.File, process *os.Process, s ssh.Session, winCh <-chan ssh.Window, input io.Writer) {
+	a.mu.Lock()
+	a.pty = f
+	a.process = process
+	a.key = s.PublicKey()
+	a.input = input
+	a.setSession(s)
+	a.mu.Unlock()
+
+	a.attach(s, winCh)
+}
+
+// reattach attaches s to the shell if the shell is waiting for a session
+// authenticated with the same key as s to reconnect. It blocks until s
+// disconnects or the shell exits, and reports whether s was attached.
+func (a *attachment) reattach(s ssh.Session) bool {
+	_, winCh, isPty := s.Pty()
+
+	// The check and the attaching are done together, so that two sessions
+	// can't both take the shell, and it can't expire in between.
+	a.mu.Lock()
+	waiting := a.pty != nil && a.session == nil && !a.expired && ssh.KeysEqual(a.key, s.PublicKey())
+	if waiting && isPty {
+		a.setSession(s)
+	}
+	a.mu.Unlock()
+
+	if !waiting {
+		return false
+	}
+	if !isPty {
+		rejectNoPty(s, a.requirePty)
+		return true
+	}
+
+	logNotice("session reattached " + describeSession(s))
+	a.attach(s, winCh)
+
+	select {
+	case <-s.Context().Done():
+	case <-a.exited:
+	}
+	return true
+}
+
+// setSession makes s the attached session, stopping any expiry timer. a.mu
+// must be held.
+func (a *attachment) setSession(s ssh.Session) {
+	a.session = s
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+}
+
+// attach copies between s, which must already be the attached session, and
+// the shell's PTY.
+func (a *attachment) attach(s ssh.Session, winCh <-chan ssh.Window) {
+	go func() {
+		for win := range winCh {
+			logDebug(fmt.Sprintf("window resized to %vx%v", win.Width, win.Height))
+			setWinsize(a.pty, win.Width, win.Height)
+		}
+	}()
+
+	if a.readOnly {
+		io.WriteString(s.Stderr(), readOnlyNotice+"\r\n")
+		go discardInput(s, a.input)
+	} else {
+		go func() {
+			io.Copy(a.pty, teeInput(s, a.input))
+		}()
+	}
+
+	if a.grace > 0 {
+		go func() {
+			<-s.Context().Done()
+			a.detach(s)
+		}()
+	} else {
+		// Otherwise the disconnect is only noticed once the shell writes
+		// output, which it may never do, such as when it is waiting for
+		// input, or the client of a -read-only session can't type.
+		go func() {
+			select {
+			case <-s.Context().Done():
+			case <-a.exited:
+				return
+			}
+
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if !a.expired {
+				a.expired = true
+				logNotice("session disconnected, killing shell")
+				a.process.Kill()
+			}
+		}()
+	}
+}
+
+func (a *attachment) detach(s ssh.Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.session != s {
+		return
+	}
+
+	a.session = nil
+	logNotice(fmt.Sprintf("session disconnected, waiting %v for it to reconnect", a.grace))
+	a.timer = time.AfterFunc(a.grace, a.expire)
+}
+
+func (a *attachment) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.session != nil || a.expired {
+		return
+	}
+
+	a.expired = true
+	logWarn(fmt.Sprintf("session did not reconnect within %v, killing shell", a.grace))
+	a.process.Kill()
+}
+
+// close marks the shell as exited, releasing any reattached session.
+func (a *attachment) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expired = true
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	close(a.exited)
+}
+
+// exit tells the attached session, if any, how the shell exited.
+func (a *attachment) exit(state *os.ProcessState) {
+	a.mu.Lock()
+	// Sending the exit status ends the session, which mustn't be taken
+	// for the client disconnecting.
+	a.expired = true
+	s := a.session
+	a.mu.Unlock()
+
+	if s != nil {
+		sendExit(s, state)
+	}
+}
+
+// Write writes b to the attached session. Output produced while no session
+// is attached is discarded.
+func (a *attachment) Write(b []byte) (int, error) {
+	a.mu.Lock()
+	s := a.session
+	a.mu.Unlock()
+
+	if s == nil {
+		return len(b), nil
+	}
+
+	n, err := writeFull(s, b)
+	if err != nil && a.grace > 0 {
+		a.detach(s)
+		return len(b), nil
+	}
+	return n, err
+}
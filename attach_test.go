@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDisconnectKillsShell(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "echo started; read line"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	ss.waitForOutput(t, "started")
+
+	// Without -reconnect-grace, the shell is killed as soon as the client
+	// disconnects, even though it is waiting for input.
+	ss.client.Close()
+	ts.wait(t)
+	if got, want := exitCodeFor(ts.SessionError()), 128+int(syscall.SIGKILL); got != want {
+		t.Errorf("exit code = %v, want %v", got, want)
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	program := []string{"sh", "-c", `echo started; read line; echo "got $line"`}
+
+	t.Run("reattaches", func(t *testing.T) {
+		key := newTestKey(t)
+		ts := startTestServer(t, options{program: program, reconnectGrace: 10 * time.Second}, key.PublicKey())
+
+		ss := ts.startSession(t, key, true)
+		ss.waitForOutput(t, "started")
+		ss.client.Close()
+
+		// The second session is attached to the shell the first started,
+		// rather than starting another.
+		ss = ts.startSession(t, key, true)
+		ss.stdin.Write([]byte("back\r"))
+		ss.waitForOutput(t, "got back")
+		if err := ss.wait(t); err != nil {
+			t.Fatalf("reattached session failed: %v", err)
+		}
+		if got := ss.stdout.String(); strings.Contains(got, "started") {
+			t.Errorf("output = %q, want no second start of the shell", got)
+		}
+		ts.wait(t)
+		if err := ts.SessionError(); err != nil {
+			t.Errorf("session error = %v, want nil", err)
+		}
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		key := newTestKey(t)
+		ts := startTestServer(t, options{program: program, reconnectGrace: 100 * time.Millisecond}, key.PublicKey())
+
+		ss := ts.startSession(t, key, true)
+		ss.waitForOutput(t, "started")
+		ss.client.Close()
+
+		// Nobody reconnects, so the shell is killed once the grace period
+		// runs out.
+		ts.wait(t)
+		if got, want := exitCodeFor(ts.SessionError()), 128+int(syscall.SIGKILL); got != want {
+			t.Errorf("exit code = %v, want %v", got, want)
+		}
+		if _, err := ts.dial(key); err == nil {
+			t.Error("connected after the shell was killed")
+		}
+	})
+}
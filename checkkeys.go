@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keyCheckResult is the result of checking an authorized_keys file, as
+// printed by -check-keys.
+type keyCheckResult struct {
+	Keys   []checkedKey   `json:"keys"`
+	Errors []invalidEntry `json:"errors"`
+}
+
+// checkedKey is a valid key found by -check-keys.
+type checkedKey struct {
+	Line        int    `json:"line"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// invalidEntry is a line which -check-keys couldn't parse.
+type invalidEntry struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// checkAuthorizedKeys parses every line of an authorized_keys file, collecting
+// the valid keys and the lines which failed to parse. Blank lines and comments
+// are skipped.
+func checkAuthorizedKeys(r io.Reader) (keyCheckResult, error) {
+	result := keyCheckResult{Keys: []checkedKey{}, Errors: []invalidEntry{}}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 || b[0] == '#' {
+			continue
+		}
+
+		key, comment, options, _, err := gossh.ParseAuthorizedKey(b)
+		if err == nil {
+			_, err = parseKeyOptions(options)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, invalidEntry{Line: line, Error: err.Error()})
+			continue
+		}
+
+		result.Keys = append(result.Keys, checkedKey{
+			Line:        line,
+			Type:        key.Type(),
+			Fingerprint: gossh.FingerprintSHA256(key),
+			Comment:     comment,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return keyCheckResult{}, fmt.Errorf("scanning file failed: %w", err)
+	}
+
+	return result, nil
+}
+
+// checkKeys checks the authorized_keys file at path, or stdin if path is
+// empty, and writes a report to w in the given -output format. It reports
+// whether every line of the file was valid.
+func checkKeys(w io.Writer, path string, format string) (bool, error) {
+	f := os.Stdin
+	if path != "" {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+	}
+
+	result, err := checkAuthorizedKeys(f)
+	if err != nil {
+		return false, err
+	}
+
+	if format == "json" {
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			return false, err
+		}
+	} else {
+		for _, key := range result.Keys {
+			fmt.Fprintf(w, "line %v: %v %v %v\n", key.Line, key.Type, key.Fingerprint, key.Comment)
+		}
+		for _, entry := range result.Errors {
+			fmt.Fprintf(w, "line %v: invalid: %v\n", entry.Line, entry.Error)
+		}
+		fmt.Fprintf(w, "%v valid keys, %v invalid lines\n", len(result.Keys), len(result.Errors))
+	}
+
+	return len(result.Errors) == 0 && len(result.Keys) > 0, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestCheckKeys(t *testing.T) {
+	alice, bob := newTestKey(t).PublicKey(), newTestKey(t).PublicKey()
+	aliceLine := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(alice)))
+	bobLine := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(bob)))
+	aliceFP, bobFP := gossh.FingerprintSHA256(alice), gossh.FingerprintSHA256(bob)
+
+	for _, tt := range []struct {
+		name     string
+		contents string
+		format   string
+		wantOK   bool
+		want     string
+	}{
+		{
+			name: "mixed text",
+			contents: "# team keys\n" +
+				aliceLine + " alice@laptop\n" +
+				"\n" +
+				"not a key\n" +
+				"  # indented comment\n" +
+				`command="uptime" ` + bobLine + "\n" +
+				"environment=FOO " + bobLine + "\n",
+			format: "text",
+			wantOK: false,
+			want: "line 2: ssh-ed25519 " + aliceFP + " alice@laptop\n" +
+				"line 6: ssh-ed25519 " + bobFP + " \n" +
+				"line 4: invalid: ssh: no key found\n" +
+				"line 7: invalid: invalid option environment=FOO: the value must be quoted\n" +
+				"2 valid keys, 2 invalid lines\n",
+		},
+		{
+			name:     "all valid text",
+			contents: "# only comments and keys\n" + aliceLine + " alice\n",
+			format:   "text",
+			wantOK:   true,
+			want:     "line 2: ssh-ed25519 " + aliceFP + " alice\n1 valid keys, 0 invalid lines\n",
+		},
+		{
+			name:     "only comments",
+			contents: "# nothing here yet\n\n",
+			format:   "text",
+			wantOK:   false,
+			want:     "0 valid keys, 0 invalid lines\n",
+		},
+		{
+			name:     "mixed json",
+			contents: "# team keys\n" + aliceLine + " alice\nnot a key\n",
+			format:   "json",
+			wantOK:   false,
+			want: `{"keys":[{"line":2,"type":"ssh-ed25519","fingerprint":"` + aliceFP + `","comment":"alice"}],` +
+				`"errors":[{"line":3,"error":"ssh: no key found"}]}` + "\n",
+		},
+		{
+			name:     "only comments json",
+			contents: "# nothing here yet\n",
+			format:   "json",
+			wantOK:   false,
+			want:     `{"keys":[],"errors":[]}` + "\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "authorized_keys")
+			if err := ioutil.WriteFile(path, []byte(tt.contents), 0600); err != nil {
+				t.Fatalf("failed to write keys: %v", err)
+			}
+
+			var out bytes.Buffer
+			ok, err := checkKeys(&out, path, tt.format)
+			if err != nil {
+				t.Fatalf("checkKeys failed: %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("checkKeys = %v, want %v", ok, tt.wantOK)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("report = %q, want %q", got, tt.want)
+			}
+
+			if tt.format == "json" {
+				var result keyCheckResult
+				if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+					t.Fatalf("report isn't valid JSON: %v", err)
+				}
+				want, _ := checkAuthorizedKeys(strings.NewReader(tt.contents))
+				if !reflect.DeepEqual(result, want) {
+					t.Errorf("report = %+v, want %+v", result, want)
+				}
+			}
+		})
+	}
+
+	if _, err := checkKeys(ioutil.Discard, filepath.Join(t.TempDir(), "missing"), "text"); err == nil {
+		t.Error("checkKeys succeeded with a missing file")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// clientPolicy is the minimum a client must meet to authenticate, set by
+// -client-version and -min-openssh-version. The zero value allows any client.
+type clientPolicy struct {
+	// versionPattern, if set, must match the client's identification
+	// string, such as "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13".
+	versionPattern *regexp.Regexp
+
+	// minOpenSSH, if set, is the oldest version of OpenSSH allowed, such as
+	// [8 0]. Clients other than OpenSSH aren't affected.
+	minOpenSSH []int
+}
+
+// openSSHVersionPattern matches the version in an OpenSSH client's
+// identification string.
+var openSSHVersionPattern = regexp.MustCompile(`^SSH-2\.0-OpenSSH_([0-9]+(?:\.[0-9]+)*)`)
+
+// parseVersion parses a dotted version number, such as 8.0.
+func parseVersion(s string) ([]int, error) {
+	var version []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q: expected numbers separated by dots, such as 8.0", s)
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as, or newer
+// than b. Missing parts count as zero, so 8 and 8.0 are the same.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// check returns the reason a client with the given identification string
+// doesn't meet the policy, or "" if it does.
+func (p clientPolicy) check(clientVersion string) string {
+	if p.versionPattern != nil && !p.versionPattern.MatchString(clientVersion) {
+		return fmt.Sprintf("client version %q does not match -client-version", clientVersion)
+	}
+
+	if p.minOpenSSH != nil {
+		if m := openSSHVersionPattern.FindStringSubmatch(clientVersion); m != nil {
+			// The pattern only matches valid versions.
+			version, _ := parseVersion(m[1])
+			if compareVersions(version, p.minOpenSSH) < 0 {
+				return fmt.Sprintf("client is OpenSSH %v, older than -min-openssh-version %v", m[1], formatVersion(p.minOpenSSH))
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tt := range []struct {
+		s       string
+		want    []int
+		wantErr bool
+	}{
+		{s: "8", want: []int{8}},
+		{s: "8.0", want: []int{8, 0}},
+		{s: "9.6.1", want: []int{9, 6, 1}},
+		{s: "10.02", want: []int{10, 2}},
+		{s: "", wantErr: true},
+		{s: "8.", wantErr: true},
+		{s: ".8", wantErr: true},
+		{s: "8.x", wantErr: true},
+		{s: "9.6p1", wantErr: true},
+		{s: "-1", wantErr: true},
+	} {
+		got, err := parseVersion(tt.s)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b []int
+		want int
+	}{
+		{[]int{8, 0}, []int{8, 0}, 0},
+		{[]int{8}, []int{8, 0}, 0},
+		{[]int{8, 0, 0}, []int{8}, 0},
+		{[]int{7, 9}, []int{8, 0}, -1},
+		{[]int{8, 0}, []int{7, 9}, 1},
+		{[]int{8, 9}, []int{8, 10}, -1},
+		{[]int{10, 0}, []int{9, 9}, 1},
+		{[]int{8}, []int{8, 0, 1}, -1},
+		{[]int{8, 0, 1}, []int{8}, 1},
+		{nil, []int{0}, 0},
+	} {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		policy        clientPolicy
+		clientVersion string
+		wantReason    string
+	}{
+		{"no policy", clientPolicy{}, "SSH-2.0-anything", ""},
+		{"pattern matches", clientPolicy{versionPattern: regexp.MustCompile(`^SSH-2\.0-OpenSSH_`)}, "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13", ""},
+		{"pattern doesn't match", clientPolicy{versionPattern: regexp.MustCompile(`^SSH-2\.0-OpenSSH_`)}, "SSH-2.0-PuTTY_Release_0.80", "does not match -client-version"},
+		{"newer", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13", ""},
+		{"same", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-OpenSSH_8.0", ""},
+		{"same with fewer parts", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-OpenSSH_8", ""},
+		{"older", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-OpenSSH_7.4p1", "OpenSSH 7.4, older than -min-openssh-version 8.0"},
+		{"older minor", clientPolicy{minOpenSSH: []int{8, 10}}, "SSH-2.0-OpenSSH_8.9p1", "OpenSSH 8.9, older than -min-openssh-version 8.10"},
+		{"not OpenSSH", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-PuTTY_Release_0.80", ""},
+		{"not really OpenSSH", clientPolicy{minOpenSSH: []int{8, 0}}, "SSH-2.0-Go OpenSSH_1.0", ""},
+		{"both", clientPolicy{versionPattern: regexp.MustCompile(`OpenSSH`), minOpenSSH: []int{8, 0}}, "SSH-2.0-OpenSSH_7.4", "older than -min-openssh-version"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.check(tt.clientVersion)
+			if tt.wantReason == "" && got != "" || !strings.Contains(got, tt.wantReason) {
+				t.Errorf("check(%q) = %q, want %q", tt.clientVersion, got, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/fatih/color"
+)
+
+// daemonChildEnv is set in the environment of the copy of otsshd which
+// -daemon starts in the background.
+const daemonChildEnv = "OTSSHD_DAEMON_CHILD"
+
+// daemonReadyFd is the file descriptor in the background copy of the pipe it
+// writes to once it is ready, the first of cmd.ExtraFiles.
+const daemonReadyFd = 3
+
+// startDaemon runs otsshd again, with the same arguments, in the background
+// in a new session, so that it is unaffected by the terminal closing. The
+// background copy prints the startup information to this process's stdout and
+// stderr, then moves them to the -daemon-log and tells this process that it
+// is ready. It returns the status to exit with: 0 once the background copy is
+// ready, or its exit status if it fails before then.
+func startDaemon() int {
+	exe, err := os.Executable()
+	if err != nil {
+		logError(fmt.Sprintf("failed to find otsshd executable: %v", err))
+		return exitFailure
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		logError(fmt.Sprintf("failed to create pipe: %v", err))
+		return exitFailure
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonChildEnv+"=1")
+	// Authorized keys may still be read from stdin before detaching.
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{readyW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		logError(fmt.Sprintf("failed to start otsshd in the background: %v", err))
+		return exitFailure
+	}
+
+	// The pipe is closed without anything being written if the background
+	// copy exits before it is ready.
+	if _, err := readyR.Read(make([]byte, 1)); err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exitErr) {
+		return exitCode(exitErr.ProcessState)
+	}
+	return exitFailure
+}
+
+// detachDaemon is called by the background copy started by startDaemon once
+// the startup information has been printed. It prints its PID, then moves its
+// stdout and stderr to the log at logPath and stdin to /dev/null, so that
+// nothing more is written to the terminal, and tells the foreground process to
+// exit.
+func detachDaemon(logPath, statusFile string, mkdir bool) error {
+	logFile, err := openLogFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, mkdir)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	message := fmt.Sprintf("otsshd is running in the background with PID %v, logging to %v.", os.Getpid(), logPath)
+	if statusFile != "" {
+		message += fmt.Sprintf(" Its status will be written to %v when it exits.", statusFile)
+	}
+	logSuccess(message)
+
+	for fd, f := range map[int]*os.File{0: devNull, 1: logFile, 2: logFile} {
+		if err := dupFd(int(f.Fd()), fd); err != nil {
+			return fmt.Errorf("failed to redirect file descriptor %v: %w", fd, err)
+		}
+	}
+	// Colors were enabled, or not, for the terminal, but the log is a file.
+	color.NoColor = true
+
+	ready := os.NewFile(daemonReadyFd, "daemon-ready")
+	defer ready.Close()
+
+	_, err = io.WriteString(ready, "\n")
+	return err
+}
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// dupFd makes newfd a copy of oldfd, closing newfd first if it is open.
+func dupFd(oldfd, newfd int) error {
+	// Dup2 isn't available on every Linux architecture, such as arm64.
+	return syscall.Dup3(oldfd, newfd, 0)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+// dupFd makes newfd a copy of oldfd, closing newfd first if it is open.
+func dupFd(oldfd, newfd int) error {
+	return syscall.Dup2(oldfd, newfd)
+}
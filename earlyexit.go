@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// earlyExitError is returned by handleSSHSession when the shell failed within
+// -min-shell-duration of starting, which usually means that it is
+// misconfigured rather than that the session's user made it fail.
+type earlyExitError struct {
+	err     error
+	elapsed time.Duration
+}
+
+func (e *earlyExitError) Error() string {
+	return fmt.Sprintf("shell failed %v after starting: %v", e.elapsed.Round(time.Millisecond), e.err)
+}
+
+func (e *earlyExitError) Unwrap() error {
+	return e.err
+}
+
+// checkEarlyExit returns err, the error a shell started at start failed with,
+// as an *earlyExitError if the shell failed within opts.minShellDuration. The
+// client is told about it on w, as the shell's own error output alone may not
+// explain why the session ended.
+func checkEarlyExit(opts options, w io.Writer, start time.Time, err error) error {
+	elapsed := time.Since(start)
+	if err == nil || opts.minShellDuration <= 0 || elapsed >= opts.minShellDuration {
+		return err
+	}
+
+	message := fmt.Sprintf("The shell failed within %v of starting.", opts.minShellDuration)
+	if opts.retryShell {
+		message += " This session has not used up the server, so you can connect again."
+	}
+	io.WriteString(w, message+"\n")
+
+	return &earlyExitError{err: err, elapsed: elapsed}
+}
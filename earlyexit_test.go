@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryShell(t *testing.T) {
+	// The shell fails straight away the first time it runs, as if it were
+	// misconfigured, and works once it has been fixed.
+	fixed := filepath.Join(t.TempDir(), "fixed")
+	program := []string{"sh", "-c", `test -f "$0" || { touch "$0"; exit 3; }; echo ok`, fixed}
+
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: program, minShellDuration: 10 * time.Second, retryShell: true}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if got := exitStatus(t, ss.wait(t)); got != 3 {
+		t.Errorf("exit status of the failed session = %v, want 3", got)
+	}
+	if got, want := ss.stderr.String(), "The shell failed within 10s of starting. This session has not used up the server, so you can connect again.\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+
+	// The failed session didn't use up the server.
+	ss = ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("second session failed: %v", err)
+	}
+	if got := ss.stdout.String(); !strings.Contains(got, "ok") {
+		t.Errorf("second session output = %q, want ok", got)
+	}
+	ts.wait(t)
+	if err := ts.SessionError(); err != nil {
+		t.Errorf("session error = %v, want the second session's, nil", err)
+	}
+}
+
+func TestMinShellDurationWithoutRetry(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "exit 3"}, minShellDuration: 10 * time.Second}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	ss.wait(t)
+	if got, want := ss.stderr.String(), "The shell failed within 10s of starting.\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+
+	// Without -retry-shell, the server ends with the shell's status.
+	ts.wait(t)
+	if got := exitCodeFor(ts.SessionError()); got != 3 {
+		t.Errorf("exit code = %v, want 3", got)
+	}
+}
+
+func TestCheckEarlyExit(t *testing.T) {
+	errFailed := commandError(t, "exit 1")
+	for _, tt := range []struct {
+		name      string
+		min       time.Duration
+		elapsed   time.Duration
+		err       error
+		wantEarly bool
+	}{
+		{"early failure", time.Minute, time.Second, errFailed, true},
+		{"late failure", time.Second, time.Minute, errFailed, false},
+		{"early success", time.Minute, time.Second, nil, false},
+		{"no minimum", 0, time.Second, errFailed, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var w strings.Builder
+			err := checkEarlyExit(options{minShellDuration: tt.min}, &w, time.Now().Add(-tt.elapsed), tt.err)
+
+			_, early := err.(*earlyExitError)
+			if early != tt.wantEarly || !early && err != tt.err {
+				t.Errorf("checkEarlyExit = %v, want early %v", err, tt.wantEarly)
+			}
+			if (w.Len() > 0) != tt.wantEarly {
+				t.Errorf("client was told %q", w.String())
+			}
+		})
+	}
+}
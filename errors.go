@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Exit codes for otsshd's own failures, chosen from sysexits.h so that they
+// are unlikely to be mistaken for the exit status of the session's shell,
+// which otsshd otherwise exits with. Invalid flags exit with status 2, a
+// timeout with -timeout-exit-code, being stopped by signal n with 128+n, and
+// any other failure with status 1.
+const (
+	exitFailure  = 1
+	exitNoKeys   = 66 // EX_NOINPUT: the authorized keys couldn't be loaded.
+	exitListen   = 69 // EX_UNAVAILABLE: an -addr couldn't be listened on.
+	exitSession  = 70 // EX_SOFTWARE: the session failed other than by its shell exiting.
+	exitAnnounce = 78 // EX_CONFIG: the -announce target is invalid.
+)
+
+// keysError is returned by run when the authorized keys couldn't be loaded,
+// such as when none were given.
+type keysError struct {
+	err error
+}
+
+func (e *keysError) Error() string { return e.err.Error() }
+func (e *keysError) Unwrap() error { return e.err }
+
+// listenError is returned by Listen when an address couldn't be listened on.
+type listenError struct {
+	addr string
+	err  error
+}
+
+func (e *listenError) Error() string { return "failed to listen on " + e.addr + ": " + e.err.Error() }
+func (e *listenError) Unwrap() error { return e.err }
+
+// announceError is returned by run when the -announce target is invalid.
+type announceError struct {
+	err error
+}
+
+func (e *announceError) Error() string { return "invalid announcement: " + e.err.Error() }
+func (e *announceError) Unwrap() error { return e.err }
+
+// sessionError is the error a session ended with, when it wasn't the exit
+// status of its shell, such as when the shell couldn't be started.
+type sessionError struct {
+	err error
+}
+
+func (e *sessionError) Error() string { return e.err.Error() }
+func (e *sessionError) Unwrap() error { return e.err }
+
+// timeoutError is returned by run when no session started within the
+// -timeout, if -timeout-exit-code is set, so that an unused server can be told
+// apart from one which was used.
+type timeoutError struct {
+	timeout time.Duration
+	code    int
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("no session started within the timeout (%v)", e.timeout)
+}
+
+// signalError is returned by run when otsshd was stopped by a signal, such as
+// SIGINT from Ctrl-C. otsshd then exits with 128+n for signal n, as shells
+// report a process killed by it.
+type signalError struct {
+	sig syscall.Signal
+}
+
+func (e *signalError) Error() string { return "stopped by signal: " + e.sig.String() }
+
+// shellExitCode returns the exit code of the session's shell, if err is how it
+// exited: an *exec.ExitError from a local shell, or a *gossh.ExitError from a
+// -proxy-to backend.
+func shellExitCode(err error) (int, bool) {
+	var (
+		exitErr      *exec.ExitError
+		proxyExitErr *gossh.ExitError
+	)
+
+	switch {
+	case errors.As(err, &exitErr):
+		return exitCode(exitErr.ProcessState), true
+	case errors.As(err, &proxyExitErr):
+		return proxyExitErr.ExitStatus(), true
+	default:
+		return 0, false
+	}
+}
+
+// exitCodeFor returns the code otsshd should exit with after failing with
+// err: the exit status of the session's shell, or one of the exit codes above.
+func exitCodeFor(err error) int {
+	if code, ok := shellExitCode(err); ok {
+		return code
+	}
+
+	var (
+		keysErr     *keysError
+		listenErr   *listenError
+		announceErr *announceError
+		sessionErr  *sessionError
+		timeoutErr  *timeoutError
+		signalErr   *signalError
+	)
+
+	switch {
+	case errors.As(err, &keysErr):
+		return exitNoKeys
+	case errors.As(err, &listenErr):
+		return exitListen
+	case errors.As(err, &announceErr):
+		return exitAnnounce
+	case errors.As(err, &sessionErr):
+		return exitSession
+	case errors.As(err, &timeoutErr):
+		return timeoutErr.code
+	case errors.As(err, &signalErr):
+		return 128 + int(signalErr.sig)
+	default:
+		return exitFailure
+	}
+}
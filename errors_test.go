@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// commandError returns the error running the shell command s fails with.
+func commandError(t *testing.T, s string) error {
+	t.Helper()
+
+	err := exec.Command("sh", "-c", s).Run()
+	if err == nil {
+		t.Fatalf("%q succeeded", s)
+	}
+	return err
+}
+
+func TestExitCodeFor(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "exit 4"}}, key.PublicKey())
+	backendErr := ts.startSession(t, key, true).wait(t)
+
+	errFailed := errors.New("failed")
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"shell exit status", commandError(t, "exit 3"), 3},
+		{"shell killed by signal", commandError(t, "kill -TERM $$"), 128 + int(syscall.SIGTERM)},
+		{"wrapped shell exit status", fmt.Errorf("session: %w", commandError(t, "exit 5")), 5},
+		{"backend exit status", backendErr, 4},
+		{"keys", &keysError{err: errNoKeys}, exitNoKeys},
+		{"listen", fmt.Errorf("failed to start: %w", &listenError{addr: ":22", err: errFailed}), exitListen},
+		{"announce", &announceError{err: errFailed}, exitAnnounce},
+		{"session", &sessionError{err: errFailed}, exitSession},
+		{"timeout", &timeoutError{timeout: time.Minute, code: 9}, 9},
+		{"timeout with status 0", &timeoutError{timeout: time.Minute}, 0},
+		{"SIGINT", &signalError{sig: syscall.SIGINT}, 130},
+		{"SIGTERM", &signalError{sig: syscall.SIGTERM}, 143},
+		{"other", errFailed, exitFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCodeFor(tt.err); got != tt.want {
+				t.Errorf("exitCodeFor(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{&listenError{addr: ":22", err: errFailed}, "failed to listen on :22: failed"},
+		{&announceError{err: errFailed}, "invalid announcement: failed"},
+		{&timeoutError{timeout: time.Minute}, "no session started within the timeout (1m0s)"},
+		{&signalError{sig: syscall.SIGINT}, "stopped by signal: interrupt"},
+	} {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+
+	for _, err := range []error{&keysError{err: errFailed}, &listenError{err: errFailed}, &announceError{err: errFailed}, &sessionError{err: errFailed}} {
+		if !errors.Is(err, errFailed) {
+			t.Errorf("%T doesn't unwrap to the error it wraps", err)
+		}
+	}
+}
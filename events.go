@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// eventBytesInterval is how often a session's byte counts are reported, if
+// they have changed.
+const eventBytesInterval = time.Second
+
+// sessionEvent is something which happened during a session, passed to
+// opts.onEvent. Only the fields relevant to its Type are set.
+type sessionEvent struct {
+	Time          string `json:"time"`
+	Type          string `json:"type"`
+	RemoteAddress string `json:"remote_address"`
+
+	// User and Fingerprint are set on connect events.
+	User        string `json:"user,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Width and Height are set on connect events with a PTY, and resize
+	// events.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// BytesIn and BytesOut are set on bytes and disconnect events, to the
+	// number of bytes of session data received from and sent to the client
+	// so far.
+	BytesIn  int64 `json:"bytes_in,omitempty"`
+	BytesOut int64 `json:"bytes_out,omitempty"`
+
+	// Data is set on output events, to the output of the session's shell,
+	// and on backlog events, to the most recent output.
+	Data string `json:"data,omitempty"`
+}
+
+// emitEvent passes event, which happened during s, to opts.onEvent.
+func emitEvent(opts options, s ssh.Session, event sessionEvent) {
+	if opts.onEvent == nil {
+		return
+	}
+
+	event.Time = formatNow()
+	event.RemoteAddress = s.RemoteAddr().String()
+	opts.onEvent(event)
+}
+
+// watchSessionEvents emits the connect event for s, and bytes events while it
+// runs. The returned function emits the disconnect event and stops watching.
+// The returned session must be used in place of s, so that its data is
+// counted.
+func watchSessionEvents(opts options, s ssh.Session) (ssh.Session, func()) {
+	if opts.onEvent == nil {
+		return s, func() {}
+	}
+
+	connect := sessionEvent{
+		Type:        "connect",
+		User:        s.User(),
+		Fingerprint: gossh.FingerprintSHA256(s.PublicKey()),
+	}
+	if ptyReq, _, isPty := s.Pty(); isPty {
+		connect.Width, connect.Height = ptyReq.Window.Width, ptyReq.Window.Height
+	}
+	emitEvent(opts, s, connect)
+
+	var in, out int64
+	counted := &countingSession{Session: s, in: &in, out: &out}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(eventBytesInterval)
+		defer ticker.Stop()
+
+		var lastIn, lastOut int64
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			bytesIn, bytesOut := atomic.LoadInt64(&in), atomic.LoadInt64(&out)
+			if bytesIn != lastIn || bytesOut != lastOut {
+				emitEvent(opts, s, sessionEvent{Type: "bytes", BytesIn: bytesIn, BytesOut: bytesOut})
+				lastIn, lastOut = bytesIn, bytesOut
+			}
+		}
+	}()
+
+	return counted, func() {
+		close(done)
+		<-stopped
+		emitEvent(opts, s, sessionEvent{
+			Type:     "disconnect",
+			BytesIn:  atomic.LoadInt64(&in),
+			BytesOut: atomic.LoadInt64(&out),
+		})
+	}
+}
+
+// watchResizes emits a resize event for each window size sent on winCh, which
+// is passed on through the returned channel.
+func watchResizes(opts options, s ssh.Session, winCh <-chan ssh.Window) <-chan ssh.Window {
+	if opts.onEvent == nil {
+		return winCh
+	}
+
+	watched := make(chan ssh.Window)
+	go func() {
+		defer close(watched)
+		for win := range winCh {
+			emitEvent(opts, s, sessionEvent{Type: "resize", Width: win.Width, Height: win.Height})
+			watched <- win
+		}
+	}()
+	return watched
+}
+
+// eventOutputWriter emits each write, of the output of the shell of s, as an
+// output event. It is used alongside the session log, with -monitor-output.
+type eventOutputWriter struct {
+	opts options
+	s    ssh.Session
+}
+
+func (w eventOutputWriter) Write(b []byte) (int, error) {
+	emitEvent(w.opts, w.s, sessionEvent{Type: "output", Data: string(b)})
+	return len(b), nil
+}
+
+// withEventOutput returns logWriter, the writer the output of the shell of s
+// is logged to, also writing to an eventOutputWriter if opts.monitorOutput is
+// set.
+func withEventOutput(opts options, s ssh.Session, logWriter io.Writer) io.Writer {
+	if opts.onEvent == nil || !opts.monitorOutput {
+		return logWriter
+	}
+	return io.MultiWriter(logWriter, eventOutputWriter{opts: opts, s: s})
+}
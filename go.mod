@@ -1,13 +1,25 @@
 module github.com/jamespwilliams/otsshd
 
-go 1.15
+go 1.23.0
 
 require (
-	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
 	github.com/creack/pty v1.1.11
 	github.com/fatih/color v1.10.0
-	github.com/gliderlabs/ssh v0.3.1
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gliderlabs/ssh v0.3.4
+	github.com/gorilla/websocket v1.4.2
 	github.com/mikesmitty/edkey v0.0.0-20170222072505-3356ea4e686a
-	golang.org/x/crypto v0.1.0
+	github.com/pkg/sftp v1.13.10
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.41.0
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/term v0.34.0
+)
+
+require (
+	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-colorable v0.1.8 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testServer is a oneTimeServer listening on a loopback address for a test,
+// which clients can connect to with a gossh client.
+type testServer struct {
+	*oneTimeServer
+
+	// hostKey is the server's host key.
+	hostKey gossh.PublicKey
+
+	// log holds everything the server wrote to its session log.
+	log *syncBuffer
+
+	served chan error
+}
+
+// syncBuffer is a bytes.Buffer which may be written to while it is read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the messages otsshd logs, which are otherwise printed
+// to stdout, until the test ends.
+func captureLog(t *testing.T) *syncBuffer {
+	log := &syncBuffer{}
+	stdout := color.Output
+	color.Output = log
+	t.Cleanup(func() { color.Output = stdout })
+	return log
+}
+
+// newTestKey generates a key for a test client to authenticate with.
+func newTestKey(t *testing.T) gossh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+// startTestServer starts a server with opts which accepts the authorized
+// keys, listening on an ephemeral port on 127.0.0.1 unless opts.addrs is set.
+// The server is closed when the test ends.
+func startTestServer(t *testing.T, opts options, authorized ...gossh.PublicKey) *testServer {
+	t.Helper()
+
+	if len(opts.addrs) == 0 {
+		opts.addrs = []string{"127.0.0.1:0"}
+	}
+	if opts.timeout == 0 {
+		opts.timeout = time.Minute
+	}
+
+	var keys []authorizedKey
+	for i, key := range authorized {
+		keys = append(keys, authorizedKey{key: key, comment: "key-" + string(rune('a'+i))})
+	}
+
+	signer, pubKey, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	log := &syncBuffer{}
+	ots, err := newOneTimeServer(newKeySet(keys), signer, log, opts)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := ots.Listen(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ts := &testServer{oneTimeServer: ots, hostKey: pubKey, log: log, served: make(chan error, 1)}
+	go func() {
+		ts.served <- ots.Serve(context.Background())
+	}()
+	t.Cleanup(func() {
+		ots.Close()
+		ts.wait(t)
+	})
+	return ts
+}
+
+// wait waits for the server to stop serving, returning the error Serve
+// returned.
+func (ts *testServer) wait(t *testing.T) error {
+	t.Helper()
+
+	select {
+	case err := <-ts.served:
+		// Let later calls return straight away too.
+		ts.served <- err
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't stop")
+		return nil
+	}
+}
+
+// dial connects to the server as user "test", authenticating with key.
+func (ts *testServer) dial(key gossh.Signer) (*gossh.Client, error) {
+	return ts.dialAddr(ts.Addr().String(), "test", key)
+}
+
+// dialAddr connects to the server at addr as user, authenticating with key.
+func (ts *testServer) dialAddr(addr, user string, key gossh.Signer) (*gossh.Client, error) {
+	return gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(key)},
+		HostKeyCallback: gossh.FixedHostKey(ts.hostKey),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// testSession is a session on a testServer, with its output collected.
+type testSession struct {
+	*gossh.Session
+
+	client *gossh.Client
+	stdin  io.WriteCloser
+	stdout *syncBuffer
+	stderr *syncBuffer
+}
+
+// startSession connects to the server with key and starts a shell, with a
+// PTY if pty is set.
+func (ts *testServer) startSession(t *testing.T, key gossh.Signer, pty bool) *testSession {
+	t.Helper()
+
+	client, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+
+	ss := &testSession{Session: session, client: client, stdout: &syncBuffer{}, stderr: &syncBuffer{}}
+	session.Stdout = ss.stdout
+	session.Stderr = ss.stderr
+	if ss.stdin, err = session.StdinPipe(); err != nil {
+		t.Fatalf("failed to open stdin: %v", err)
+	}
+
+	if pty {
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatalf("failed to request PTY: %v", err)
+		}
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("failed to start shell: %v", err)
+	}
+	return ss
+}
+
+// wait waits for the session to end, returning the error Wait returned.
+func (ss *testSession) wait(t *testing.T) error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ss.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("session didn't end; output so far: %q", ss.stdout.String())
+		return nil
+	}
+}
+
+// waitForOutput waits until the session's output contains s.
+func (ss *testSession) waitForOutput(t *testing.T, s string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(ss.stdout.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("output %q never contained %q", ss.stdout.String(), s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runTestSession runs a PTY session with key on a server running program as
+// the shell, waiting for it to end, and returns its output and the error Wait
+// returned.
+func runTestSession(t *testing.T, opts options, program ...string) (string, error) {
+	t.Helper()
+
+	key := newTestKey(t)
+	t.Setenv("SHELL", program[0])
+	opts.shellArgs = program[1:]
+	ts := startTestServer(t, opts, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	err := ss.wait(t)
+	return ss.stdout.String(), err
+}
+
+// exitStatus returns the exit status the session ended with, as reported by
+// Wait's error.
+func exitStatus(t *testing.T, err error) int {
+	t.Helper()
+
+	var exitErr *gossh.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus()
+	default:
+		t.Fatalf("session failed: %v", err)
+		return -1
+	}
+}
+
+// testContext is an ssh.Context for calling handlers directly, outside of a
+// connection, from user "test" at 127.0.0.1.
+type testContext struct {
+	context.Context
+	sync.Mutex
+
+	values map[interface{}]interface{}
+}
+
+func newTestContext() *testContext {
+	return &testContext{Context: context.Background(), values: make(map[interface{}]interface{})}
+}
+
+func (c *testContext) Value(key interface{}) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *testContext) SetValue(key, value interface{}) {
+	c.values[key] = value
+}
+
+func (c *testContext) User() string {
+	return "test"
+}
+
+func (c *testContext) SessionID() string {
+	return ""
+}
+
+func (c *testContext) ClientVersion() string {
+	return "SSH-2.0-OpenSSH_9.6"
+}
+
+func (c *testContext) ServerVersion() string {
+	return serverVersionPrefix + "otsshd"
+}
+
+func (c *testContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+func (c *testContext) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
+
+func (c *testContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// now returns the current time. It is a variable so that the clock can be
+// replaced.
+var now = time.Now
+
+// timeWindow is a daily window of time, such as 09:00-18:00, in a given
+// location. A window whose end is before its start spans midnight.
+type timeWindow struct {
+	start, end time.Duration
+	loc        *time.Location
+	spec       string
+}
+
+// parseTimeWindow parses a window of the form HH:MM-HH:MM in the named time
+// zone, or the local time zone if tz is empty.
+func parseTimeWindow(s string, tz string) (*timeWindow, error) {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %w", tz, err)
+		}
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q: expected HH:MM-HH:MM", s)
+	}
+
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid window %q: start and end are the same", s)
+	}
+
+	return &timeWindow{start: start, end: end, loc: loc, spec: s}, nil
+}
+
+// parseTimeOfDay parses a time of the form HH:MM, returning the time since
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls within the window.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+func (w *timeWindow) String() string {
+	return fmt.Sprintf("%v %v", w.spec, w.loc)
+}
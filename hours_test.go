@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	for _, tt := range []struct {
+		spec, tz   string
+		start, end time.Duration
+		wantErr    string
+	}{
+		{spec: "09:00-18:00", start: 9 * time.Hour, end: 18 * time.Hour},
+		{spec: "22:30-06:15", start: 22*time.Hour + 30*time.Minute, end: 6*time.Hour + 15*time.Minute},
+		{spec: " 9:00 - 17:00 ", start: 9 * time.Hour, end: 17 * time.Hour},
+		{spec: "00:00-23:59", tz: "UTC", start: 0, end: 23*time.Hour + 59*time.Minute},
+		{spec: "09:00", wantErr: "expected HH:MM-HH:MM"},
+		{spec: "09:00-12:00-18:00", wantErr: "expected HH:MM-HH:MM"},
+		{spec: "9am-5pm", wantErr: `invalid time "9am"`},
+		{spec: "09:00-24:00", wantErr: `invalid time "24:00"`},
+		{spec: "09:00-09:00", wantErr: "start and end are the same"},
+		{spec: "09:00-18:00", tz: "Nowhere/Special", wantErr: `invalid time zone "Nowhere/Special"`},
+	} {
+		w, err := parseTimeWindow(tt.spec, tt.tz)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTimeWindow(%q, %q) = %v, want an error containing %q", tt.spec, tt.tz, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeWindow(%q, %q) failed: %v", tt.spec, tt.tz, err)
+			continue
+		}
+		if w.start != tt.start || w.end != tt.end {
+			t.Errorf("parseTimeWindow(%q, %q) = %v to %v, want %v to %v", tt.spec, tt.tz, w.start, w.end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("invalid time %q: %v", s, err)
+		}
+		return tm
+	}
+
+	for _, tt := range []struct {
+		spec, tz string
+		time     string
+		want     bool
+	}{
+		// A window within a day includes its start but not its end.
+		{"09:00-18:00", "UTC", "2024-03-04T08:59:59Z", false},
+		{"09:00-18:00", "UTC", "2024-03-04T09:00:00Z", true},
+		{"09:00-18:00", "UTC", "2024-03-04T17:59:59Z", true},
+		{"09:00-18:00", "UTC", "2024-03-04T18:00:00Z", false},
+
+		// A window crossing midnight includes both sides of it.
+		{"22:00-06:00", "UTC", "2024-03-04T21:59:59Z", false},
+		{"22:00-06:00", "UTC", "2024-03-04T22:00:00Z", true},
+		{"22:00-06:00", "UTC", "2024-03-04T23:59:59Z", true},
+		{"22:00-06:00", "UTC", "2024-03-05T00:00:00Z", true},
+		{"22:00-06:00", "UTC", "2024-03-05T05:59:59Z", true},
+		{"22:00-06:00", "UTC", "2024-03-05T06:00:00Z", false},
+		{"22:00-06:00", "UTC", "2024-03-05T12:00:00Z", false},
+
+		// Times are compared in the window's time zone, whatever zone
+		// they are given in.
+		{"09:00-18:00", "America/New_York", "2024-03-04T13:30:00Z", false},
+		{"09:00-18:00", "America/New_York", "2024-03-04T14:30:00Z", true},
+		{"09:00-18:00", "America/New_York", "2024-03-04T13:30:00-05:00", true},
+		{"09:00-18:00", "America/New_York", "2024-03-04T09:30:00Z", false},
+		{"09:00-18:00", "America/New_York", "2024-03-04T23:30:00Z", false},
+
+		// Including across daylight saving time: 08:30 UTC is 08:30 in
+		// London in winter, but 09:30 in summer.
+		{"09:00-18:00", "Europe/London", "2024-01-15T08:30:00Z", false},
+		{"09:00-18:00", "Europe/London", "2024-07-15T08:30:00Z", true},
+
+		// A time zone can move the window across midnight in UTC.
+		{"22:00-06:00", "Asia/Tokyo", "2024-03-04T14:00:00Z", true},
+		{"22:00-06:00", "Asia/Tokyo", "2024-03-04T20:59:59Z", true},
+		{"22:00-06:00", "Asia/Tokyo", "2024-03-04T21:00:00Z", false},
+	} {
+		w, err := parseTimeWindow(tt.spec, tt.tz)
+		if err != nil {
+			t.Fatalf("parseTimeWindow(%q, %q) failed: %v", tt.spec, tt.tz, err)
+		}
+		if got := w.contains(at(tt.time)); got != tt.want {
+			t.Errorf("%v contains %v = %v, want %v", w, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestAllowHours(t *testing.T) {
+	window, err := parseTimeWindow("22:00-06:00", "Europe/London")
+	if err != nil {
+		t.Fatalf("failed to parse window: %v", err)
+	}
+	key := newTestKey(t)
+
+	signer, _, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	ots, err := newOneTimeServer(newKeySet([]authorizedKey{{key: key.PublicKey()}}), signer, ioutil.Discard, options{
+		addrs:      []string{"127.0.0.1:0"},
+		allowHours: window,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	defer func(orig func() time.Time) { now = orig }(now)
+	for _, tt := range []struct {
+		time       string
+		want       bool
+		wantReason string
+	}{
+		{"2024-07-15T21:30:00Z", true, ""},
+		{"2024-07-15T12:00:00Z", false, "it is 13:00, outside of the allowed hours (22:00-06:00 Europe/London)"},
+	} {
+		tm, err := time.Parse(time.RFC3339, tt.time)
+		if err != nil {
+			t.Fatalf("invalid time %q: %v", tt.time, err)
+		}
+		now = func() time.Time { return tm }
+
+		ok, reason := ots.authenticate(newTestContext(), key.PublicKey())
+		if ok != tt.want || (!ok && reason != tt.wantReason) {
+			t.Errorf("at %v: authenticate = %v, %q, want %v, %q", tt.time, ok, reason, tt.want, tt.wantReason)
+		}
+	}
+}
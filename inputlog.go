@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// openInputLogFile opens the -log-input file for s, adding name to its path as
+// openSessionLog does, and starts it with the same header as the session log.
+// It returns the log and a function which closes it.
+func openInputLogFile(opts options, s ssh.Session, name string) (io.Writer, func(), error) {
+	path := opts.inputLogPath
+	if name != "" {
+		path = sessionLogPath(path, name)
+		logNotice(fmt.Sprintf("logging the input of %v to %v", name, path))
+	}
+
+	f, err := openLogFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, opts.logMkdir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ptyReq, _, _ := s.Pty()
+	if err := writeSessionHeader(f, s, ptyReq); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to write to input log: %w", err)
+	}
+
+	return &bestEffortWriter{w: f}, func() { f.Close() }, nil
+}
+
+// teeInput returns r, which reads the input sent by a client, writing
+// everything read from it to input too, if it isn't nil.
+func teeInput(r io.Reader, input io.Writer) io.Reader {
+	if input == nil {
+		return r
+	}
+	return io.TeeReader(r, input)
+}
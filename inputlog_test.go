@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInputLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.log")
+	key := newTestKey(t)
+	ts := startTestServer(t, options{
+		program:      []string{"sh", "-c", "stty -echo; echo ready; read line; echo done"},
+		inputLogPath: path,
+	}, key.PublicKey())
+
+	// The input isn't echoed, so it is only recorded by the input log.
+	ss := ts.startSession(t, key, true)
+	ss.waitForOutput(t, "ready")
+	ss.stdin.Write([]byte("hunter2\r"))
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	ts.wait(t)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read input log: %v", err)
+	}
+	header, input, ok := strings.Cut(string(b), "======================\n")
+	if !ok || !strings.HasPrefix(header, "=== otsshd session ===\n") || !strings.Contains(header, "term:        xterm\n") {
+		t.Errorf("input log = %q, want the session header first", b)
+	}
+	if input != "hunter2\r" {
+		t.Errorf("logged input = %q, want %q", input, "hunter2\r")
+	}
+	if strings.Contains(ts.log.String(), "hunter2") {
+		t.Errorf("session log = %q, want no unechoed input", ts.log.String())
+	}
+}
+
+func TestTeeInput(t *testing.T) {
+	var input bytes.Buffer
+	b, err := ioutil.ReadAll(teeInput(strings.NewReader("typed"), &input))
+	if err != nil || string(b) != "typed" {
+		t.Errorf("read %q, %v, want %q", b, err, "typed")
+	}
+	if got := input.String(); got != "typed" {
+		t.Errorf("input = %q, want %q", got, "typed")
+	}
+
+	// Without an input log, the reader is used as it is.
+	r := strings.NewReader("typed")
+	if got := teeInput(r, nil); got != r {
+		t.Errorf("teeInput with no input log = %v, want the reader", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// keyServer serves the host public key over HTTP, for -key-http-addr, so that
+// clients can fetch and pin it before connecting rather than having it
+// announced to them. It is served as a known_hosts line, or with
+// ?format=json or an Accept header asking for JSON, as the object printed by
+// -output json. Only public information is served, so no token is needed.
+type keyServer struct {
+	listener net.Listener
+	server   *http.Server
+
+	text []byte
+	json []byte
+}
+
+// newKeyServer starts serving key, the host key of the server listening on
+// addrs, on addr. host and hashHost are interpreted as by writeStartupInfo.
+func newKeyServer(addr, host string, addrs []net.Addr, key ssh.PublicKey, hashHost bool) (*keyServer, error) {
+	text := formatKnownHosts(key)
+	if knownHostsLine, _, err := connectionInfo(host, addrs[0], key, hashHost); err == nil {
+		text = knownHostsLine
+	}
+
+	var info bytes.Buffer
+	// The web terminal's link is left out, as it grants a session.
+	if err := writeStartupInfo(&info, host, addrs, key, hashHost, ""); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	k := &keyServer{
+		listener: listener,
+		text:     []byte(text + "\n"),
+		json:     info.Bytes(),
+	}
+	k.server = &http.Server{Handler: k}
+	go k.server.Serve(listener)
+	return k, nil
+}
+
+// Addr returns the address the key server is listening on.
+func (k *keyServer) Addr() net.Addr {
+	return k.listener.Addr()
+}
+
+func (k *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logDebug(fmt.Sprintf("serving host key to %v", r.RemoteAddr))
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(k.json)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(k.text)
+}
+
+// Close stops serving the key.
+func (k *keyServer) Close() {
+	k.server.Close()
+}
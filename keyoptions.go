@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// workdirEnv is the environment variable which, when set by an authorized
+// key's environment option, is the directory the key's session starts in.
+const workdirEnv = "OTSSH_WORKDIR"
+
+// keyOptionsContextKey holds the keyOptions of the authorized key that a
+// connection authenticated with.
+var keyOptionsContextKey = &contextKey{"key-options"}
+
+// keyOptions are the options of an authorized key which otsshd supports, in
+// the same syntax as OpenSSH.
+type keyOptions struct {
+	// environment is set in the session, from environment="NAME=value"
+	// options.
+	environment []string
+
+	// command, from command="...", is run with the shell in place of the
+	// shell itself or the command the client requested.
+	command string
+
+	// noPty, from no-pty, prevents the session from using a PTY.
+	noPty bool
+}
+
+// parseKeyOptions parses the options of an authorized key, as returned by
+// ssh.ParseAuthorizedKey. Other options are ignored.
+func parseKeyOptions(options []string) (keyOptions, error) {
+	var opts keyOptions
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+
+		switch strings.ToLower(name) {
+		case "environment":
+			kv, err := unquoteKeyOption(option, value)
+			if err != nil {
+				return keyOptions{}, err
+			}
+			if i := strings.IndexByte(kv, '='); i <= 0 {
+				return keyOptions{}, fmt.Errorf("invalid option %v: expected NAME=value", option)
+			}
+			opts.environment = append(opts.environment, kv)
+		case "command":
+			command, err := unquoteKeyOption(option, value)
+			if err != nil {
+				return keyOptions{}, err
+			}
+			opts.command = command
+		case "no-pty":
+			opts.noPty = true
+		}
+	}
+	return opts, nil
+}
+
+// unquoteKeyOption returns the value of option, which must be in double
+// quotes.
+func unquoteKeyOption(option, value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("invalid option %v: the value must be quoted", option)
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`), nil
+}
+
+// sessionKeyOptions returns the options of the authorized key that s
+// authenticated with.
+func sessionKeyOptions(s ssh.Session) keyOptions {
+	opts, _ := s.Context().Value(keyOptionsContextKey).(keyOptions)
+	return opts
+}
+
+// rejectNoPtyKey rejects PTY requests from clients whose authorized key has
+// the no-pty option, as OpenSSH does, so that their output isn't translated
+// as if it were written to a terminal.
+func rejectNoPtyKey(ctx ssh.Context, pty ssh.Pty) bool {
+	if opts, _ := ctx.Value(keyOptionsContextKey).(keyOptions); opts.noPty {
+		logWarn(fmt.Sprintf("rejected PTY request from %v: the authorized key has the no-pty option", ctx.RemoteAddr()))
+		return false
+	}
+	return true
+}
+
+// keyEnvironment returns the environment set by the options of the authorized
+// key that s authenticated with.
+func keyEnvironment(s ssh.Session) []string {
+	return sessionKeyOptions(s).environment
+}
+
+// keyWorkdir returns the directory that s should start in, as set by its
+// authorized key, or "" to use otsshd's working directory.
+func keyWorkdir(s ssh.Session) string {
+	dir := ""
+	for _, kv := range keyEnvironment(s) {
+		if strings.HasPrefix(kv, workdirEnv+"=") {
+			dir = strings.TrimPrefix(kv, workdirEnv+"=")
+		}
+	}
+	return dir
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	for _, tt := range []struct {
+		options []string
+		want    keyOptions
+		wantErr bool
+	}{
+		{options: nil, want: keyOptions{}},
+		{options: []string{`command="uptime"`}, want: keyOptions{command: "uptime"}},
+		{options: []string{`COMMAND="echo \"hi\""`}, want: keyOptions{command: `echo "hi"`}},
+		{options: []string{"no-pty"}, want: keyOptions{noPty: true}},
+		{options: []string{`environment="A=1"`, `environment="B=x y"`}, want: keyOptions{environment: []string{"A=1", "B=x y"}}},
+		{options: []string{"no-port-forwarding", `from="10.0.0.0/8"`, "no-pty"}, want: keyOptions{noPty: true}},
+		{options: []string{"command=uptime"}, wantErr: true},
+		{options: []string{`command="`}, wantErr: true},
+		{options: []string{`environment="A"`}, wantErr: true},
+		{options: []string{`environment="=1"`}, wantErr: true},
+	} {
+		got, err := parseKeyOptions(tt.options)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseKeyOptions(%q) = %+v, %v, want %+v, error %v", tt.options, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// startKeyOptionsServer starts a server running program, which accepts key
+// with the given authorized_keys options.
+func startKeyOptionsServer(t *testing.T, key gossh.Signer, keyOptions ...string) *testServer {
+	t.Helper()
+
+	keyOpts, err := parseKeyOptions(keyOptions)
+	if err != nil {
+		t.Fatalf("failed to parse options: %v", err)
+	}
+	ts := startTestServer(t, options{program: []string{"echo", "program"}}, key.PublicKey())
+	ts.authorizedKeys.set([]authorizedKey{{key: key.PublicKey(), options: keyOpts}})
+	return ts
+}
+
+func TestForcedCommand(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options []string
+		pty     bool
+		want    string
+	}{
+		{"without PTY", []string{`command="echo forced $SSH_ORIGINAL_COMMAND; test -t 0 || echo no tty"`}, false, "forced echo requested\nno tty\n"},
+		{"with PTY", []string{`command="echo forced $SSH_ORIGINAL_COMMAND; test -t 0 && echo tty"`}, true, "forced echo requested\r\ntty\r\n"},
+		{"with no-pty", []string{`command="echo forced $SSH_ORIGINAL_COMMAND; test -t 0 || echo no tty"`, "no-pty"}, true, "forced echo requested\nno tty\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			ts := startKeyOptionsServer(t, key, tt.options...)
+
+			client, err := ts.dial(key)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer client.Close()
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("failed to open session: %v", err)
+			}
+
+			// Like OpenSSH's client, carry on without a PTY if the
+			// request is refused.
+			if tt.pty {
+				err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{})
+				if noPty := strings.Contains(strings.Join(tt.options, ","), "no-pty"); (err != nil) != noPty {
+					t.Errorf("PTY request error = %v, want refused %v", err, noPty)
+				}
+			}
+
+			output, err := session.Output("echo requested")
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if string(output) != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoPty(t *testing.T) {
+	key := newTestKey(t)
+	ts := startKeyOptionsServer(t, key, "no-pty")
+
+	client, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err == nil {
+		t.Error("PTY request from a no-pty key succeeded")
+	}
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	if err := session.Shell(); err != nil {
+		t.Fatalf("failed to start shell: %v", err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if strings.Contains(output.String(), "program") {
+		t.Errorf("program ran in a session with a no-pty key; output %q", output.String())
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a public key from an authorized_keys file, along with the
+// comment which followed it, if any.
+type authorizedKey struct {
+	key     gossh.PublicKey
+	comment string
+
+	// options are the key's supported authorized_keys options.
+	options keyOptions
+}
+
+func filterByComment(keys []authorizedKey, comments []string) []authorizedKey {
+	var filtered []authorizedKey
+	for _, key := range keys {
+		for _, comment := range comments {
+			if key.comment == comment {
+				filtered = append(filtered, key)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func parseAuthorizedKeysFile(path string) ([]authorizedKey, error) {
+	f := os.Stdin
+	if path != "" {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+	}
+
+	return parseAuthorizedKeys(f)
+}
+
+// errNoKeys is returned by parseAuthorizedKeys when the input doesn't contain
+// any keys, such as when it is empty or only contains comments.
+var errNoKeys = errors.New("no keys found: the input is empty or only contains comments and blank lines")
+
+func parseAuthorizedKeys(r io.Reader) ([]authorizedKey, error) {
+	var keys []authorizedKey
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 || b[0] == '#' {
+			continue
+		}
+
+		key, comment, options, _, err := gossh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key on line %v: %w", line, err)
+		}
+
+		keyOpts, err := parseKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key on line %v: %w", line, err)
+		}
+
+		keys = append(keys, authorizedKey{key: key, comment: comment, options: keyOpts})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning file failed: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+
+	return keys, nil
+}
+
+// loadAuthorizedKeys reads the authorized keys from the sources configured by
+// opts.
+func loadAuthorizedKeys(opts options) ([]authorizedKey, error) {
+	keys, err := loadKeys(keySources(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.allowComments) > 0 {
+		keys = filterByComment(keys, opts.allowComments)
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no authorized keys have a comment allowed by -allow-comment")
+		}
+	}
+
+	return keys, nil
+}
+
+// keySet holds the authorized keys, which may be replaced while the server is
+// running.
+type keySet struct {
+	mu   sync.RWMutex
+	keys []authorizedKey
+}
+
+func newKeySet(keys []authorizedKey) *keySet {
+	return &keySet{keys: keys}
+}
+
+func (ks *keySet) get() []authorizedKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys
+}
+
+func (ks *keySet) set(keys []authorizedKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+}
+
+// keysReloadDelay is how long watchAuthorizedKeys waits for changes to the
+// authorized keys file to settle before reloading it, as a file is often
+// written in several steps.
+const keysReloadDelay = 100 * time.Millisecond
+
+// watchAuthorizedKeys starts reloading ks whenever the authorized keys file
+// changes, until done is closed. The file's directory is watched rather than
+// the file itself, so that the file being replaced, as editors and tools which
+// write files atomically do, is noticed too.
+func watchAuthorizedKeys(ks *keySet, opts options, done <-chan struct{}) error {
+	path := filepath.Clean(opts.authorizedKeysPath)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %v: %w", filepath.Dir(path), err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// reload is set while waiting for changes to settle.
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				changed := fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename
+				if filepath.Clean(event.Name) == path && event.Op&changed != 0 {
+					reload = time.After(keysReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logWarn(fmt.Sprintf("failed to watch authorized keys file for changes: %v", err))
+			case <-reload:
+				reload = nil
+				logNotice("authorized keys file changed, reloading")
+				if err := reloadAuthorizedKeys(ks, opts); err != nil {
+					logWarn(fmt.Sprintf("failed to reload authorized keys, keeping previous keys: %v", err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadAuthorizedKeys replaces the keys in ks with those loaded from the
+// sources configured by opts, logging how many keys were added and removed.
+func reloadAuthorizedKeys(ks *keySet, opts options) error {
+	keys, err := loadAuthorizedKeys(opts)
+	if err != nil {
+		return err
+	}
+
+	previous := ks.get()
+	ks.set(keys)
+
+	added, removed := 0, 0
+	for _, key := range keys {
+		if !containsKey(previous, key) {
+			added++
+		}
+	}
+	for _, key := range previous {
+		if !containsKey(keys, key) {
+			removed++
+		}
+	}
+
+	logNotice(fmt.Sprintf("reloaded authorized keys: %v added, %v removed, %v in total", added, removed, len(keys)))
+	return nil
+}
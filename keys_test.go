@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// writeAuthorizedKeys writes an authorized keys file holding keys to path.
+func writeAuthorizedKeys(t *testing.T, path string, keys ...gossh.PublicKey) {
+	t.Helper()
+
+	var b []byte
+	for _, key := range keys {
+		b = append(b, gossh.MarshalAuthorizedKey(key)...)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("failed to write authorized keys: %v", err)
+	}
+}
+
+func TestWatchAuthorizedKeys(t *testing.T) {
+	a, b, c := newTestKey(t).PublicKey(), newTestKey(t).PublicKey(), newTestKey(t).PublicKey()
+
+	dir := t.TempDir()
+	opts := options{authorizedKeysPath: filepath.Join(dir, "authorized_keys")}
+	writeAuthorizedKeys(t, opts.authorizedKeysPath, a)
+
+	keys, err := loadAuthorizedKeys(opts)
+	if err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+	ks := newKeySet(keys)
+
+	done := make(chan struct{})
+	defer close(done)
+	if err := watchAuthorizedKeys(ks, opts, done); err != nil {
+		t.Fatalf("failed to watch keys: %v", err)
+	}
+
+	waitForKeys := func(want ...gossh.PublicKey) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := ks.get()
+			if len(got) == len(want) {
+				matched := true
+				for _, key := range want {
+					matched = matched && containsKey(got, authorizedKey{key: key})
+				}
+				if matched {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("keys = %v, want %v keys", len(got), len(want))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Written in place.
+	writeAuthorizedKeys(t, opts.authorizedKeysPath, a, b)
+	waitForKeys(a, b)
+
+	// Replaced, as editors and tools which write atomically do.
+	tmp := filepath.Join(dir, "authorized_keys.tmp")
+	writeAuthorizedKeys(t, tmp, c)
+	if err := os.Rename(tmp, opts.authorizedKeysPath); err != nil {
+		t.Fatalf("failed to replace authorized keys: %v", err)
+	}
+	waitForKeys(c)
+
+	// An invalid file leaves the previous keys in place.
+	if err := ioutil.WriteFile(opts.authorizedKeysPath, []byte("not a key\n"), 0600); err != nil {
+		t.Fatalf("failed to write authorized keys: %v", err)
+	}
+	time.Sleep(2 * keysReloadDelay)
+	waitForKeys(c)
+}
+
+// newSecurityKeys returns an sk-ssh-ed25519 and an sk-ecdsa-sha2-nistp256
+// public key, as a FIDO security key would generate. Only the public halves
+// are needed, as handlePublicKey is passed the key the client offers.
+func newSecurityKeys(t *testing.T) []gossh.PublicKey {
+	t.Helper()
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	wires := [][]byte{
+		gossh.Marshal(struct {
+			Type, PubKey, Application string
+		}{gossh.KeyAlgoSKED25519, string(edKey), "ssh:"}),
+		gossh.Marshal(struct {
+			Type, Curve, Q, Application string
+		}{gossh.KeyAlgoSKECDSA256, "nistp256", string(elliptic.Marshal(elliptic.P256(), ecKey.X, ecKey.Y)), "ssh:"}),
+	}
+
+	var keys []gossh.PublicKey
+	for _, wire := range wires {
+		key, err := gossh.ParsePublicKey(wire)
+		if err != nil {
+			t.Fatalf("failed to parse security key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestSecurityKeys(t *testing.T) {
+	authorized, other := newSecurityKeys(t), newSecurityKeys(t)
+
+	var file strings.Builder
+	for _, key := range authorized {
+		file.WriteString(strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))) + " " + key.Type() + "\n")
+	}
+	keys, err := parseAuthorizedKeys(strings.NewReader(file.String()))
+	if err != nil {
+		t.Fatalf("failed to parse authorized keys: %v", err)
+	}
+
+	signer, _, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	ots, err := newOneTimeServer(newKeySet(keys), signer, ioutil.Discard, options{addrs: []string{"127.0.0.1:0"}})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	for i := range authorized {
+		t.Run(authorized[i].Type(), func(t *testing.T) {
+			ctx := newTestContext()
+			if !ots.handlePublicKey(ctx, authorized[i]) {
+				t.Errorf("authorized key was rejected")
+			}
+			if got := ctx.Value(keyCommentContextKey); got != authorized[i].Type() {
+				t.Errorf("key comment = %v, want %v", got, authorized[i].Type())
+			}
+
+			if ots.handlePublicKey(newTestContext(), other[i]) {
+				t.Errorf("unauthorized key of the same type was accepted")
+			}
+		})
+	}
+}
+
+func TestFilterByComment(t *testing.T) {
+	keys := []authorizedKey{
+		{key: newTestKey(t).PublicKey(), comment: "alice@laptop"},
+		{key: newTestKey(t).PublicKey(), comment: "bob@desktop"},
+		{key: newTestKey(t).PublicKey()},
+		{key: newTestKey(t).PublicKey(), comment: "alice@laptop"},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		comments []string
+		want     []int
+	}{
+		{"one comment", []string{"bob@desktop"}, []int{1}},
+		{"every key with the comment", []string{"alice@laptop"}, []int{0, 3}},
+		{"several comments, in key order", []string{"bob@desktop", "alice@laptop"}, []int{0, 1, 3}},
+		{"exact match only", []string{"alice", "ALICE@LAPTOP", "alice@laptop "}, nil},
+		{"no comments", nil, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterByComment(keys, tt.comments)
+			if len(got) != len(tt.want) {
+				t.Fatalf("filterByComment kept %v keys, want %v", len(got), len(tt.want))
+			}
+			for i, j := range tt.want {
+				if gossh.FingerprintSHA256(got[i].key) != gossh.FingerprintSHA256(keys[j].key) {
+					t.Errorf("key %v = %v (%q), want key %v", i, gossh.FingerprintSHA256(got[i].key), got[i].comment, j)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowCommentNoneMatch(t *testing.T) {
+	opts := options{authorizedKeysPath: filepath.Join(t.TempDir(), "authorized_keys"), allowComments: []string{"nobody"}}
+	if err := ioutil.WriteFile(opts.authorizedKeysPath, gossh.MarshalAuthorizedKey(newTestKey(t).PublicKey()), 0600); err != nil {
+		t.Fatalf("failed to write authorized keys: %v", err)
+	}
+
+	if _, err := loadAuthorizedKeys(opts); err == nil || !strings.Contains(err.Error(), "-allow-comment") {
+		t.Errorf("loadAuthorizedKeys = %v, want an error about -allow-comment", err)
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(newTestKey(t).PublicKey())))
+
+	for _, tt := range []struct {
+		name     string
+		input    string
+		wantKeys int
+		wantErr  error
+		wantMsg  string
+	}{
+		{name: "empty", input: "", wantErr: errNoKeys},
+		{name: "blank lines", input: "\n  \n\t\n", wantErr: errNoKeys},
+		{name: "only comments", input: "# keys for the deploy\n\n  # none yet\n", wantErr: errNoKeys},
+		{name: "one key", input: key + "\n", wantKeys: 1},
+		{name: "keys among comments", input: "# alice\n" + key + " alice\n\n# bob\n  " + key + " bob\n", wantKeys: 2},
+		{name: "no final newline", input: key, wantKeys: 1},
+		{name: "invalid key", input: "# header\n" + key + "\nnot a key\n", wantMsg: "failed to parse key on line 3"},
+		{name: "invalid option", input: `bogus="x ` + key + "\n", wantMsg: "failed to parse key on line 1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseAuthorizedKeys(strings.NewReader(tt.input))
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("parseAuthorizedKeys = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantMsg != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantMsg) || errors.Is(err, errNoKeys) {
+					t.Errorf("parseAuthorizedKeys = %v, want an error containing %q", err, tt.wantMsg)
+				}
+			case err != nil:
+				t.Errorf("parseAuthorizedKeys failed: %v", err)
+			case len(keys) != tt.wantKeys:
+				t.Errorf("parseAuthorizedKeys returned %v keys, want %v", len(keys), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLoadAuthorizedKeysEmpty(t *testing.T) {
+	opts := options{authorizedKeysPath: filepath.Join(t.TempDir(), "authorized_keys")}
+	if err := ioutil.WriteFile(opts.authorizedKeysPath, []byte("# no keys yet\n"), 0600); err != nil {
+		t.Fatalf("failed to write authorized keys: %v", err)
+	}
+
+	_, err := loadAuthorizedKeys(opts)
+	if !errors.Is(err, errNoKeys) {
+		t.Fatalf("loadAuthorizedKeys = %v, want %v", err, errNoKeys)
+	}
+	if !strings.Contains(err.Error(), opts.authorizedKeysPath) {
+		t.Errorf("error %q doesn't name the file", err)
+	}
+	if got := exitCodeFor(&keysError{err: err}); got != exitNoKeys {
+		t.Errorf("exit status = %v, want %v", got, exitNoKeys)
+	}
+}
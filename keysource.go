@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// keySource is somewhere authorized keys can be loaded from.
+type keySource interface {
+	// name describes the source, for logging.
+	name() string
+	load() ([]authorizedKey, error)
+}
+
+// keySources returns the key sources configured by opts, in priority order.
+// If no sources are configured, keys are read from stdin.
+func keySources(opts options) []keySource {
+	var sources []keySource
+	if opts.authorizedKeysPath != "" {
+		sources = append(sources, fileKeySource{path: opts.authorizedKeysPath})
+	}
+	for _, url := range opts.authorizedKeysURLs {
+		sources = append(sources, urlKeySource{url: url})
+	}
+	for _, user := range opts.githubUsers {
+		sources = append(sources, githubKeySource{user: user})
+	}
+	if opts.authorizedKeysEnv != "" {
+		sources = append(sources, envKeySource{variable: opts.authorizedKeysEnv})
+	}
+
+	if len(sources) == 0 {
+		sources = append(sources, stdinKeySource{})
+	}
+	return sources
+}
+
+// loadKeys loads the keys from each source in turn, logging how many keys each
+// provided. If a key is provided by more than one source, the first source
+// takes priority. An error from any source fails the whole load.
+func loadKeys(sources []keySource) ([]authorizedKey, error) {
+	var keys []authorizedKey
+
+	for _, source := range sources {
+		sourceKeys, err := source.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keys from %v: %w", source.name(), err)
+		}
+
+		added := 0
+		for _, key := range sourceKeys {
+			if !containsKey(keys, key) {
+				keys = append(keys, key)
+				added++
+			}
+		}
+
+		logNotice(fmt.Sprintf("loaded %v keys from %v (%v duplicates ignored)", added, source.name(), len(sourceKeys)-added))
+	}
+
+	return keys, nil
+}
+
+func containsKey(keys []authorizedKey, key authorizedKey) bool {
+	for _, k := range keys {
+		if string(k.key.Marshal()) == string(key.key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileKeySource reads keys from an authorized_keys file.
+type fileKeySource struct {
+	path string
+}
+
+func (s fileKeySource) name() string {
+	return s.path
+}
+
+func (s fileKeySource) load() ([]authorizedKey, error) {
+	return parseAuthorizedKeysFile(s.path)
+}
+
+// stdinKeySource reads keys, in authorized_keys format, from stdin.
+type stdinKeySource struct{}
+
+func (stdinKeySource) name() string {
+	return "stdin"
+}
+
+func (stdinKeySource) load() ([]authorizedKey, error) {
+	keys, err := parseAuthorizedKeysFile("")
+	if errors.Is(err, errNoKeys) {
+		return nil, errors.New("no keys supplied - either pass a file using -authorized-keys, or pipe them in")
+	}
+	return keys, err
+}
+
+// keysHTTPClient is used to fetch keys from URLs.
+var keysHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// urlKeySource fetches keys, in authorized_keys format, from a URL.
+type urlKeySource struct {
+	url string
+}
+
+func (s urlKeySource) name() string {
+	return s.url
+}
+
+func (s urlKeySource) load() ([]authorizedKey, error) {
+	resp, err := keysHTTPClient.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+
+	return parseAuthorizedKeys(resp.Body)
+}
+
+// githubKeySource fetches the public keys of a GitHub user.
+type githubKeySource struct {
+	user string
+}
+
+func (s githubKeySource) name() string {
+	return "GitHub user " + s.user
+}
+
+func (s githubKeySource) load() ([]authorizedKey, error) {
+	return urlKeySource{url: fmt.Sprintf("https://github.com/%s.keys", s.user)}.load()
+}
+
+// envKeySource reads keys, in authorized_keys format, from an environment
+// variable.
+type envKeySource struct {
+	variable string
+}
+
+func (s envKeySource) name() string {
+	return "environment variable " + s.variable
+}
+
+func (s envKeySource) load() ([]authorizedKey, error) {
+	value, ok := os.LookupEnv(s.variable)
+	if !ok {
+		return nil, fmt.Errorf("%v is not set", s.variable)
+	}
+	return parseAuthorizedKeys(strings.NewReader(value))
+}
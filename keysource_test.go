@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKeyLine returns the authorized_keys line for key, with comment.
+func authorizedKeyLine(key gossh.PublicKey, comment string) string {
+	return strings.TrimSuffix(string(gossh.MarshalAuthorizedKey(key)), "\n") + " " + comment + "\n"
+}
+
+func TestKeySources(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts options
+		want []keySource
+	}{
+		{"none", options{}, []keySource{stdinKeySource{}}},
+		{"file", options{authorizedKeysPath: "keys"}, []keySource{fileKeySource{path: "keys"}}},
+		{
+			"all",
+			options{
+				authorizedKeysEnv:  "KEYS",
+				githubUsers:        []string{"octocat"},
+				authorizedKeysURLs: []string{"https://a.example/keys", "https://b.example/keys"},
+				authorizedKeysPath: "keys",
+			},
+			[]keySource{
+				fileKeySource{path: "keys"},
+				urlKeySource{url: "https://a.example/keys"},
+				urlKeySource{url: "https://b.example/keys"},
+				githubKeySource{user: "octocat"},
+				envKeySource{variable: "KEYS"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keySources(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keySources = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	a, b, c := newTestKey(t).PublicKey(), newTestKey(t).PublicKey(), newTestKey(t).PublicKey()
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(path, []byte(authorizedKeyLine(a, "from-file")), 0600); err != nil {
+		t.Fatalf("failed to write keys: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(authorizedKeyLine(a, "from-url") + authorizedKeyLine(b, "from-url")))
+	}))
+	defer srv.Close()
+	t.Setenv("OTSSH_TEST_KEYS", authorizedKeyLine(b, "from-env")+authorizedKeyLine(c, "from-env"))
+
+	// Keys are loaded from every source, with the first source a key comes
+	// from taking priority.
+	keys, err := loadKeys([]keySource{
+		fileKeySource{path: path},
+		urlKeySource{url: srv.URL + "/keys"},
+		envKeySource{variable: "OTSSH_TEST_KEYS"},
+	})
+	if err != nil {
+		t.Fatalf("loadKeys failed: %v", err)
+	}
+	var got []string
+	for _, key := range keys {
+		got = append(got, key.comment)
+	}
+	if want := []string{"from-file", "from-url", "from-env"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded keys with comments %q, want %q", got, want)
+	}
+	for i, want := range []gossh.PublicKey{a, b, c} {
+		if i < len(keys) && gossh.FingerprintSHA256(keys[i].key) != gossh.FingerprintSHA256(want) {
+			t.Errorf("key %v = %v, want %v", i, gossh.FingerprintSHA256(keys[i].key), gossh.FingerprintSHA256(want))
+		}
+	}
+
+	// A failure of any source fails the whole load.
+	for _, tt := range []struct {
+		source  keySource
+		wantErr string
+	}{
+		{fileKeySource{path: path + ".missing"}, "failed to load keys from " + path + ".missing"},
+		{urlKeySource{url: srv.URL + "/missing"}, "unexpected response status 404 Not Found"},
+		{envKeySource{variable: "OTSSH_TEST_UNSET"}, "OTSSH_TEST_UNSET is not set"},
+	} {
+		_, err := loadKeys([]keySource{fileKeySource{path: path}, tt.source})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loading from %v failed with %v, want an error containing %q", tt.source.name(), err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// listenRetryBackoff is how long listenWithRetry first waits before trying
+// again. The wait doubles after each attempt.
+const listenRetryBackoff = 250 * time.Millisecond
+
+// listenConfig sets SO_REUSEADDR on listening sockets, so that otsshd can be
+// restarted on a port whose previous connections are still in TIME_WAIT.
+var listenConfig = net.ListenConfig{
+	Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	},
+}
+
+// listen listens for TCP connections on addr, with listenConfig.
+func listen(addr string) (net.Listener, error) {
+	return listenConfig.Listen(context.Background(), "tcp", addr)
+}
+
+// listenWithRetry listens on addr, trying again up to retries times, with
+// backoff, while the address is in use. Ports are often briefly unavailable
+// just after the process which was using them exits.
+func listenWithRetry(addr string, retries int) (net.Listener, error) {
+	backoff := listenRetryBackoff
+	for attempt := 1; ; attempt++ {
+		listener, err := listen(addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt > retries {
+			return listener, err
+		}
+
+		logWarn(fmt.Sprintf("%v is in use, retrying in %v (retry %v of %v)", addr, backoff, attempt, retries))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
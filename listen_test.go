@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestListenSeveralAddrs(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"echo", "hello"}, addrs: []string{"127.0.0.1:0", "127.0.0.1:0"}}, key.PublicKey())
+
+	addrs := ts.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("Addrs() = %v, want two addresses", addrs)
+	}
+
+	// A client can connect on any of them.
+	client, err := ts.dialAddr(addrs[1].String(), "test", key)
+	if err != nil {
+		t.Fatalf("failed to connect to %v: %v", addrs[1], err)
+	}
+	defer client.Close()
+	if _, err := client.NewSession(); err != nil {
+		t.Errorf("failed to open session on %v: %v", addrs[1], err)
+	}
+}
+
+func TestListenAddrInUse(t *testing.T) {
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer inUse.Close()
+
+	// Find a free port, to check that it is released again.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	signer, _, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	ots, err := newOneTimeServer(newKeySet([]authorizedKey{{key: newTestKey(t).PublicKey()}}), signer, ioutil.Discard, options{
+		addrs: []string{freeAddr, inUse.Addr().String()},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err = ots.Listen()
+	var listenErr *listenError
+	if !errors.As(err, &listenErr) || listenErr.addr != inUse.Addr().String() {
+		t.Fatalf("Listen = %v, want a listenError for %v", err, inUse.Addr())
+	}
+
+	// The addresses which were listened on are closed again.
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Errorf("%v is still in use after Listen failed: %v", freeAddr, err)
+	} else {
+		l.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// fallbackLocale is used in place of a locale requested by the client which
+// isn't installed.
+const fallbackLocale = "C.UTF-8"
+
+var (
+	installedLocalesOnce sync.Once
+	installedLocales     map[string]bool
+	installedLocalesErr  error
+)
+
+// loadInstalledLocales returns the normalized names of the locales installed
+// on this machine, as listed by `locale -a`. The list is only loaded once.
+func loadInstalledLocales() (map[string]bool, error) {
+	installedLocalesOnce.Do(func() {
+		out, err := exec.Command("locale", "-a").Output()
+		if err != nil {
+			installedLocalesErr = fmt.Errorf("failed to list installed locales: %w", err)
+			return
+		}
+
+		installedLocales = make(map[string]bool)
+		for _, name := range strings.Fields(string(out)) {
+			installedLocales[normalizeLocale(name)] = true
+		}
+	})
+	return installedLocales, installedLocalesErr
+}
+
+// normalizeLocale returns name in the form `locale -a` uses, in which the
+// codeset is lowercase and has no hyphens: en_US.UTF-8 becomes en_US.utf8.
+func normalizeLocale(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return name
+	}
+
+	codeset := name[i+1:]
+	modifier := ""
+	if j := strings.IndexByte(codeset, '@'); j >= 0 {
+		codeset, modifier = codeset[:j], codeset[j:]
+	}
+
+	codeset = strings.ToLower(strings.ReplaceAll(codeset, "-", ""))
+	return name[:i+1] + codeset + modifier
+}
+
+// isLocaleVar reports whether name is the name of a locale environment
+// variable.
+func isLocaleVar(name string) bool {
+	return name == "LANG" || strings.HasPrefix(name, "LC_")
+}
+
+// clientLocaleEnv returns the locale variables, LANG and LC_*, from environ,
+// the environment sent by the client. Locales which aren't installed are
+// replaced with fallbackLocale, as setting them would break the shell.
+func clientLocaleEnv(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !isLocaleVar(parts[0]) {
+			continue
+		}
+		name, value := parts[0], parts[1]
+
+		installed, err := loadInstalledLocales()
+		if err != nil {
+			logWarn(fmt.Sprintf("ignoring %v sent by client: %v", name, err))
+			continue
+		}
+
+		if value != "" && !installed[normalizeLocale(value)] {
+			logWarn(fmt.Sprintf("locale %q requested by the client in %v is not installed, using %v", value, name, fallbackLocale))
+			value = fallbackLocale
+		}
+
+		env = append(env, name+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestNormalizeLocale(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"C", "C"},
+		{"en_US.UTF-8", "en_US.utf8"},
+		{"en_US.utf8", "en_US.utf8"},
+		{"de_DE.ISO-8859-15@euro", "de_DE.iso885915@euro"},
+		{"sr_RS@latin", "sr_RS@latin"},
+	} {
+		if got := normalizeLocale(tt.name); got != tt.want {
+			t.Errorf("normalizeLocale(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// requireLocales skips the test if the installed locales can't be listed.
+func requireLocales(t *testing.T) {
+	t.Helper()
+
+	if _, err := loadInstalledLocales(); err != nil {
+		t.Skip(err)
+	}
+}
+
+func TestClientLocaleEnv(t *testing.T) {
+	requireLocales(t)
+
+	// C and POSIX are always installed.
+	got := clientLocaleEnv([]string{
+		"LANG=C",
+		"TERM=xterm",
+		"LC_CTYPE=POSIX",
+		"LC_ALL=xx_XX.UTF-8",
+		"LC_TIME=",
+		"LCX=1",
+		"HOME=/root",
+	})
+	want := []string{"LANG=C", "LC_CTYPE=POSIX", "LC_ALL=" + fallbackLocale, "LC_TIME="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clientLocaleEnv = %q, want %q", got, want)
+	}
+}
+
+func TestLocaleSession(t *testing.T) {
+	requireLocales(t)
+
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", `echo "LANG=$LANG LC_MESSAGES=$LC_MESSAGES FOO=$FOO"`}}, key.PublicKey())
+
+	client, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	for name, value := range map[string]string{"LANG": "C", "LC_MESSAGES": "xx_XX.UTF-8", "FOO": "bar"} {
+		if err := session.Setenv(name, value); err != nil {
+			t.Fatalf("failed to set %v: %v", name, err)
+		}
+	}
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatalf("failed to request PTY: %v", err)
+	}
+
+	// Only locale variables are passed on, with missing locales replaced.
+	var output bytes.Buffer
+	session.Stdout = &output
+	if err := session.Shell(); err != nil {
+		t.Fatalf("failed to start shell: %v", err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if want := "LANG=C LC_MESSAGES=" + fallbackLocale + " FOO="; strings.TrimSpace(output.String()) != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+}
@@ -2,11 +2,21 @@ package main
 
 import (
 	"fmt"
+	"log/syslog"
 	"time"
 
 	"github.com/fatih/color"
 )
 
+// debugLogging enables output from logDebug.
+var debugLogging bool
+
+// logSyslog, if set by -log=syslog, also receives every log message.
+var logSyslog *syslog.Writer
+
+// logRemote, if set by -log-remote, also receives every log message.
+var logRemote *remoteLog
+
 func formatNow() string {
 	return time.Now().Format(time.RFC3339)
 }
@@ -15,22 +25,67 @@ func logNotice(s string) {
 	color.New(color.FgMagenta).Print(formatNow())
 	color.New(color.FgBlue, color.Bold).Print(" notice:\t\t")
 	color.New(color.FgBlue).Println(s)
+
+	if logSyslog != nil {
+		logSyslog.Notice(s)
+	}
+	if logRemote != nil {
+		logRemote.send("notice", s)
+	}
 }
 
 func logSuccess(s string) {
-	fmt.Println()
+	fmt.Fprintln(color.Output)
 	color.New(color.FgMagenta).Print(formatNow())
 	color.New(color.FgGreen, color.Bold).Println(" " + s)
+
+	if logSyslog != nil {
+		logSyslog.Info(s)
+	}
+	if logRemote != nil {
+		logRemote.send("success", s)
+	}
 }
 
 func logError(s string) {
 	color.New(color.FgMagenta).Print(formatNow())
 	color.New(color.FgRed, color.Bold).Print(" error:\t\t")
 	color.New(color.FgRed, color.Bold).Println(s)
+
+	if logSyslog != nil {
+		logSyslog.Err(s)
+	}
+	if logRemote != nil {
+		logRemote.send("error", s)
+	}
 }
 
 func logWarn(s string) {
 	color.New(color.FgMagenta).Print(formatNow())
 	color.New(color.FgYellow, color.Bold).Print(" warning:\t\t")
 	color.New(color.FgYellow, color.Bold).Println(s)
+
+	if logSyslog != nil {
+		logSyslog.Warning(s)
+	}
+	if logRemote != nil {
+		logRemote.send("warning", s)
+	}
+}
+
+func logDebug(s string) {
+	if !debugLogging {
+		return
+	}
+
+	color.New(color.FgMagenta).Print(formatNow())
+	color.New(color.FgCyan, color.Bold).Print(" debug:\t\t")
+	color.New(color.FgCyan).Println(s)
+
+	if logSyslog != nil {
+		logSyslog.Debug(s)
+	}
+	if logRemote != nil {
+		logRemote.send("debug", s)
+	}
 }
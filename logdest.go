@@ -0,0 +1,288 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// logDestination is somewhere the session is logged to.
+type logDestination struct {
+	name string
+	w    io.Writer
+}
+
+// fanoutWriter writes to every log destination. Unlike io.MultiWriter, a
+// destination which fails is dropped, and the others are still written to.
+type fanoutWriter struct {
+	mu    sync.Mutex
+	dests []logDestination
+}
+
+func (f *fanoutWriter) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var remaining []logDestination
+	for _, d := range f.dests {
+		if _, err := writeFull(d.w, b); err != nil {
+			logWarn(fmt.Sprintf("failed to write to log destination %v, no longer logging to it: %v", d.name, err))
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+	f.dests = remaining
+
+	if len(remaining) == 0 {
+		return 0, errors.New("every log destination has failed")
+	}
+	return len(b), nil
+}
+
+// Flush writes out what the destinations have buffered, completing the
+// gzip member of compressed files, so that the log is complete if otsshd is
+// killed before it is closed.
+func (f *fanoutWriter) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, d := range f.dests {
+		if flusher, ok := d.w.(interface{ Flush() error }); ok {
+			if err := flusher.Flush(); err != nil {
+				logWarn(fmt.Sprintf("failed to flush log destination %v: %v", d.name, err))
+			}
+		}
+	}
+}
+
+// gzipFile compresses what is written to a log file. Flush ends the current
+// gzip member, and the next write starts another, which gzip decompresses as
+// if they were one stream, so each session's log can be completed as it ends.
+type gzipFile struct {
+	f  *os.File
+	gz *gzip.Writer
+}
+
+func (g *gzipFile) Write(b []byte) (int, error) {
+	if g.gz == nil {
+		g.gz = gzip.NewWriter(g.f)
+	}
+	return g.gz.Write(b)
+}
+
+// Flush ends the current gzip member, if one has been started.
+func (g *gzipFile) Flush() error {
+	if g.gz == nil {
+		return nil
+	}
+	err := g.gz.Close()
+	g.gz = nil
+	return err
+}
+
+// Close ends the current gzip member and closes the file.
+func (g *gzipFile) Close() error {
+	err := g.Flush()
+	if closeErr := g.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openLogDestinations opens each of the -log destinations: "stdout" (or "-"),
+// "syslog", or the path of a file. If mkdir is set, missing parent
+// directories of files are created, and if compress is set, files are compressed,
+// with ".gz" added to their names. The returned function closes them.
+//
+// When logging to syslog, the session output is sent a line at a time with
+// escape sequences stripped to sys, the syslog connection opened by run,
+// which is left open for the next session.
+func openLogDestinations(targets []string, sys io.Writer, truncate, mkdir, compress bool) (*fanoutWriter, func(), error) {
+	if len(targets) == 0 {
+		return nil, nil, errors.New("no log destinations given")
+	}
+
+	fanout := &fanoutWriter{}
+	var closers []func() error
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	fileFlags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if truncate {
+		fileFlags = os.O_TRUNC | os.O_WRONLY | os.O_CREATE
+	}
+
+	for _, target := range targets {
+		switch target {
+		case "stdout", "-":
+			// By default, writing to stdout once its reader has gone away
+			// kills otsshd with SIGPIPE. Ignoring it makes the write fail
+			// instead, so that the session can carry on.
+			signal.Ignore(syscall.SIGPIPE)
+			fanout.dests = append(fanout.dests, logDestination{name: "stdout", w: os.Stdout})
+		case "syslog":
+			if sys == nil {
+				closeAll()
+				return nil, nil, errors.New("failed to log to syslog: not connected to syslog")
+			}
+
+			lines := &transcriptWriter{w: sys}
+			closers = append(closers, lines.Flush)
+			fanout.dests = append(fanout.dests, logDestination{name: "syslog", w: lines})
+		default:
+			if compress && !strings.HasSuffix(target, ".gz") {
+				target += ".gz"
+			}
+
+			f, err := openLogFile(target, fileFlags, mkdir)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+
+			if !compress {
+				closers = append(closers, f.Close)
+				fanout.dests = append(fanout.dests, logDestination{name: target, w: f})
+				continue
+			}
+
+			// When appending, each run adds new gzip members to the file.
+			gz := &gzipFile{f: f}
+			closers = append(closers, gz.Close)
+			fanout.dests = append(fanout.dests, logDestination{name: target, w: gz})
+		}
+	}
+
+	return fanout, closeAll, nil
+}
+
+// openLogFile opens the log file at path with the given flags, first creating
+// its parent directory if mkdir is set.
+func openLogFile(path string, flags int, mkdir bool) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if mkdir {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create log directory %v: %w", dir, err)
+		}
+	}
+
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("failed to open log file at %v: directory %v does not exist (pass -log-mkdir to create it)", path, dir)
+		}
+		return nil, fmt.Errorf("failed to open log file at %v: %w", path, err)
+	}
+	return f, nil
+}
+
+// openSessionLog opens the -log destinations and the -transcript, returning a
+// writer which logs the session output to all of them, a function which
+// flushes them at the end of a session, and a function which closes them. If
+// name is set, it is added to the names of the files, so that sessions
+// running at the same time can be logged separately.
+func openSessionLog(opts options, name string) (io.Writer, func(), func(), error) {
+	logPaths, transcriptPath := opts.logPaths, opts.transcriptPath
+	if name != "" {
+		logPaths = make([]string, len(opts.logPaths))
+		for i, path := range opts.logPaths {
+			logPaths[i] = sessionLogPath(path, name)
+		}
+		paths := logPaths
+		if transcriptPath != "" {
+			transcriptPath = sessionLogPath(transcriptPath, name)
+			paths = append(paths, transcriptPath)
+		}
+		logNotice(fmt.Sprintf("logging %v to %v", name, strings.Join(paths, ", ")))
+	}
+
+	dests, closeDests, err := openLogDestinations(logPaths, opts.syslog, opts.logTruncate, opts.logMkdir, opts.logGzip)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The writers are flushed and closed in the reverse of the order they
+	// were added in, so that each flushes into the next.
+	flushers := []func(){dests.Flush}
+	closers := []func(){closeDests}
+	flushAll := func() {
+		for i := len(flushers) - 1; i >= 0; i-- {
+			flushers[i]()
+		}
+	}
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	if logRemote != nil && opts.logRemoteSession {
+		lines := &transcriptWriter{w: logRemote}
+		closers = append(closers, func() { lines.Flush() })
+		dests.dests = append(dests.dests, logDestination{name: logRemote.addr, w: lines})
+	}
+
+	var w io.Writer = dests
+	if transcriptPath != "" {
+		transcriptFile, err := os.OpenFile(transcriptPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("failed to open transcript file at %v: %w", transcriptPath, err)
+		}
+
+		transcript := newTranscriptWriter(transcriptFile)
+		flushers = append(flushers, func() { transcript.Flush() })
+		closers = append(closers, func() {
+			transcript.Flush()
+			transcriptFile.Close()
+		})
+
+		w = io.MultiWriter(dests, transcript)
+	}
+
+	if len(opts.logRedact) > 0 {
+		redactor := &redactingWriter{w: w, patterns: opts.logRedact}
+		flushers = append(flushers, func() { redactor.Flush() })
+		closers = append(closers, func() { redactor.Flush() })
+
+		w = redactor
+	}
+
+	if opts.logTail != nil {
+		// -tail-addr viewers watch the session live, like the client, so
+		// they're sent the output as it arrives rather than after
+		// -log-redact, which only applies to what is stored and holds
+		// output back until its line ends.
+		w = io.MultiWriter(opts.logTail, w)
+	}
+
+	return w, flushAll, closeAll, nil
+}
+
+// sessionLogPath adds name to the log file path, before its extension, such
+// as otssh.log becoming otssh.session-1.log. stdout and syslog are returned
+// unchanged.
+func sessionLogPath(path, name string) string {
+	switch path {
+	case "stdout", "-", "syslog":
+		return path
+	}
+
+	gz := ""
+	if strings.HasSuffix(path, ".gz") {
+		path, gz = strings.TrimSuffix(path, ".gz"), ".gz"
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext + gz
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// readGzip returns the decompressed contents of the gzip file at path,
+// failing if it is truncated.
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %v: %v", path, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", path, err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress %v: %v", path, err)
+	}
+	return string(b)
+}
+
+func TestGzipLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otssh.log")
+	opts := options{logPaths: []string{path}, logGzip: true}
+
+	w, flush, closeLog, err := openSessionLog(opts, "")
+	if err != nil {
+		t.Fatalf("openSessionLog failed: %v", err)
+	}
+
+	io.WriteString(w, "first session\n")
+	flush()
+
+	// The flushed log is complete without being closed, as if otsshd had
+	// been killed after the session ended.
+	if got, want := readGzip(t, path+".gz"), "first session\n"; got != want {
+		t.Errorf("log after first session = %q, want %q", got, want)
+	}
+
+	io.WriteString(w, "second session\n")
+	flush()
+	closeLog()
+
+	if got, want := readGzip(t, path+".gz"), "first session\nsecond session\n"; got != want {
+		t.Errorf("log after second session = %q, want %q", got, want)
+	}
+
+	// Appending in a later run adds to the same stream.
+	w, _, closeLog, err = openSessionLog(opts, "")
+	if err != nil {
+		t.Fatalf("openSessionLog failed: %v", err)
+	}
+	io.WriteString(w, "next run\n")
+	closeLog()
+
+	if got, want := readGzip(t, path+".gz"), "first session\nsecond session\nnext run\n"; got != want {
+		t.Errorf("log after next run = %q, want %q", got, want)
+	}
+}
+
+func TestGzipLogPerSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otssh.log")
+	opts := options{logPaths: []string{path}, logGzip: true}
+
+	w, _, closeLog, err := openSessionLog(opts, "session-1")
+	if err != nil {
+		t.Fatalf("openSessionLog failed: %v", err)
+	}
+	io.WriteString(w, "output\n")
+	closeLog()
+
+	if got, want := readGzip(t, filepath.Join(filepath.Dir(path), "otssh.session-1.log.gz")), "output\n"; got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestSessionLogFlushedAtSessionEnd(t *testing.T) {
+	flushed := make(chan struct{}, 1)
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"true"}, flushSessionLog: func() { flushed <- struct{}{} }}, key.PublicKey())
+
+	if err := ts.startSession(t, key, true).wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	ts.wait(t)
+
+	select {
+	case <-flushed:
+	default:
+		t.Error("the log wasn't flushed when the session ended")
+	}
+}
+
+func TestTailNotRedacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otssh.log")
+	tail := &syncBuffer{}
+	opts := options{
+		logPaths:  []string{path},
+		logRedact: []*regexp.Regexp{regexp.MustCompile(`hunter\d`)},
+		logTail:   tail,
+	}
+
+	w, flush, closeLog, err := openSessionLog(opts, "")
+	if err != nil {
+		t.Fatalf("openSessionLog failed: %v", err)
+	}
+	defer closeLog()
+
+	// The tail is sent the incomplete line straight away, while the log
+	// waits for it to end.
+	io.WriteString(w, "password: hunter2")
+	if got, want := tail.String(), "password: hunter2"; got != want {
+		t.Errorf("tail = %q, want %q", got, want)
+	}
+	if b, _ := ioutil.ReadFile(path); len(b) != 0 {
+		t.Errorf("log = %q, want the incomplete line held back", b)
+	}
+
+	flush()
+	if b, _ := ioutil.ReadFile(path); string(b) != "password: ***" {
+		t.Errorf("log = %q, want %q", b, "password: ***")
+	}
+}
+
+func TestLogDestinations(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+	if err := ioutil.WriteFile(first, []byte("earlier run\n"), 0600); err != nil {
+		t.Fatalf("failed to write log: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		truncate  bool
+		wantFirst string
+	}{
+		{"append", false, "earlier run\noutput\n"},
+		{"truncate", true, "output\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w, closeAll, err := openLogDestinations([]string{first, second}, nil, tt.truncate, false, false)
+			if err != nil {
+				t.Fatalf("openLogDestinations failed: %v", err)
+			}
+			if _, err := io.WriteString(w, "output\n"); err != nil {
+				t.Errorf("write failed: %v", err)
+			}
+			closeAll()
+
+			// Every destination is written to.
+			if b, _ := ioutil.ReadFile(first); string(b) != tt.wantFirst {
+				t.Errorf("first log = %q, want %q", b, tt.wantFirst)
+			}
+			if b, _ := ioutil.ReadFile(second); !strings.HasSuffix(string(b), "output\n") {
+				t.Errorf("second log = %q, want the output", b)
+			}
+		})
+	}
+
+	if _, _, err := openLogDestinations(nil, nil, false, false, false); err == nil {
+		t.Error("openLogDestinations succeeded with no destinations")
+	}
+}
+
+func TestLogDestinationsSyslog(t *testing.T) {
+	// Each session's log is sent a line at a time to the one syslog
+	// connection, which is left open for the next.
+	var sys bytes.Buffer
+	for _, s := range []string{"first\r\n", "second\r\n"} {
+		w, closeAll, err := openLogDestinations([]string{"syslog"}, &sys, false, false, false)
+		if err != nil {
+			t.Fatalf("openLogDestinations failed: %v", err)
+		}
+		io.WriteString(w, s)
+		closeAll()
+	}
+	if got, want := sys.String(), "first\nsecond\n"; got != want {
+		t.Errorf("syslog got %q, want %q", got, want)
+	}
+
+	if _, _, err := openLogDestinations([]string{"syslog"}, nil, false, false, false); err == nil {
+		t.Error("openLogDestinations succeeded without a syslog connection")
+	}
+}
+
+func TestFanoutWriter(t *testing.T) {
+	var good bytes.Buffer
+	f := &fanoutWriter{dests: []logDestination{
+		{name: "broken", w: errWriter{errors.New("broken")}},
+		{name: "good", w: &good},
+	}}
+
+	// A destination which fails is dropped, and the rest are still
+	// written to.
+	for _, s := range []string{"one\n", "two\n"} {
+		if n, err := f.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("Write(%q) = %v, %v", s, n, err)
+		}
+	}
+	if got, want := good.String(), "one\ntwo\n"; got != want {
+		t.Errorf("good destination got %q, want %q", got, want)
+	}
+	if len(f.dests) != 1 || f.dests[0].name != "good" {
+		t.Errorf("destinations = %v, want only the good one", f.dests)
+	}
+
+	// Once every destination has failed, so does the writer.
+	f.dests = []logDestination{{name: "broken", w: errWriter{errors.New("broken")}}}
+	if _, err := f.Write([]byte("three\n")); err == nil {
+		t.Error("Write succeeded with every destination failing")
+	}
+}
+
+func TestLogMkdir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "otssh", "session.log")
+
+	_, _, err := openLogDestinations([]string{path}, nil, false, false, false)
+	if want := "directory " + filepath.Dir(path) + " does not exist (pass -log-mkdir to create it)"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("opening a log in a missing directory failed with %v, want an error containing %q", err, want)
+	}
+
+	w, closeAll, err := openLogDestinations([]string{path}, nil, false, true, false)
+	if err != nil {
+		t.Fatalf("openLogDestinations with mkdir failed: %v", err)
+	}
+	io.WriteString(w, "output\n")
+	closeAll()
+
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "output\n" {
+		t.Errorf("log = %q, %v, want the output", b, err)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("failed to stat log directory: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("log directory permissions = %v, want %v", perm, os.FileMode(0o700))
+	}
+}
+
+func TestSessionLogPath(t *testing.T) {
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"otssh.log", "otssh.session-1.log"},
+		{"/var/log/otssh.log.gz", "/var/log/otssh.session-1.log.gz"},
+		{"/var/log/otssh", "/var/log/otssh.session-1"},
+		{"stdout", "stdout"},
+		{"-", "-"},
+		{"syslog", "syslog"},
+	} {
+		if got := sessionLogPath(tt.path, "session-1"); got != tt.want {
+			t.Errorf("sessionLogPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOncePerKeySessionLogs(t *testing.T) {
+	dir := t.TempDir()
+	opts := options{
+		program:    []string{"sh", "-c", `echo "from $OTSSH_KEY_COMMENT"; read line`},
+		oncePerKey: true,
+		logPaths:   []string{filepath.Join(dir, "otssh.log")},
+	}
+	opts.openSessionLog = func(n int) (io.Writer, func(), error) {
+		w, _, closeLog, err := openSessionLog(opts, fmt.Sprintf("session-%v", n))
+		return w, closeLog, err
+	}
+
+	keyA, keyB := newTestKey(t), newTestKey(t)
+	ts := startTestServer(t, opts, keyA.PublicKey(), keyB.PublicKey())
+
+	// The sessions run at the same time, but are logged separately.
+	first := ts.startSession(t, keyA, true)
+	first.waitForOutput(t, "from key-a")
+	second := ts.startSession(t, keyB, true)
+	second.waitForOutput(t, "from key-b")
+	for _, ss := range []*testSession{first, second} {
+		ss.stdin.Write([]byte("\r"))
+		if err := ss.wait(t); err != nil {
+			t.Fatalf("session failed: %v", err)
+		}
+	}
+
+	for name, want := range map[string]string{"otssh.session-1.log": "from key-a", "otssh.session-2.log": "from key-b"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read session log: %v", err)
+			continue
+		}
+		if got := string(b); !strings.Contains(got, want) || strings.Count(got, "from key-") != 1 {
+			t.Errorf("%v = %q, want only %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "otssh.log")); !os.IsNotExist(err) {
+		t.Errorf("shared log exists, want only per-session logs: %v", err)
+	}
+}
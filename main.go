@@ -1,24 +1,37 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/mikesmitty/edkey"
 
+	"github.com/fatih/color"
 	"github.com/gliderlabs/ssh"
 )
 
@@ -26,95 +39,1218 @@ import (
 
 func main() {
 	authorizedKeysPathFlag := flag.String("authorized-keys", "", "path to authorized_keys file. stdin will be used if not passed.")
-	announceCmdFlag := flag.String("announce", "", "command which will be run with the generated public key")
+	authorizedKeysURLFlag := flag.String("authorized-keys-url", "", "comma-separated list of URLs to fetch authorized keys from")
+	githubUsersFlag := flag.String("github-users", "", "comma-separated list of GitHub users whose public keys will be authorized")
+	authorizedKeysEnvFlag := flag.String("authorized-keys-env", "", "name of an environment variable containing authorized keys")
+	announceFlag := flag.String("announce", "", "command which will be run with the generated public key, or the URL or file to announce it to, depending on -announce-mode")
+	announceModeFlag := flag.String("announce-mode", "command", "how to announce the generated public key: command, http or file")
+	timeoutExitCodeFlag := flag.Int("timeout-exit-code", 0, "status to exit with when no session starts within -timeout, so that an unused server can be told apart from a used one. 0 exits successfully.")
+	proxyToFlag := flag.String("proxy-to", "", "proxy sessions to this backend SSH host, in the form [user@]host[:port], instead of starting a shell, making otsshd a one-time jump host")
+	proxyIdentityFlag := flag.String("proxy-identity", "", "path to an unencrypted private key to authenticate to the -proxy-to host with. keys in the SSH agent at $SSH_AUTH_SOCK are also tried.")
+	proxyKnownHostsFlag := flag.String("proxy-known-hosts", "", "path to the known_hosts file to check the -proxy-to host's key against. ~/.ssh/known_hosts is used if not passed.")
+	keyHTTPAddrFlag := flag.String("key-http-addr", "", "address to serve the host public key on over HTTP once the server is listening, as a known_hosts line or JSON, for clients to fetch and pin it before connecting")
+	announceAsyncFlag := flag.Bool("announce-async", false, "announce the generated public key in the background once the server is listening, rather than waiting for the announcement before listening")
 	copyEnvFlag := flag.Bool("copy-env", true, "copy environment to ssh sessions (default true)")
-	logPathFlag := flag.String("log", "otssh.log", "path to log to")
+	logPathFlag := flag.String("log", "otssh.log", "comma-separated list of places to log the session to: file paths, stdout or syslog")
 	timeoutFlag := flag.Int("timeout", 600, "timeout in seconds")
-	addrFlag := flag.String("addr", ":2022", "address to listen for connections on")
+	addrFlag := flag.String("addr", ":2022", "comma-separated list of addresses to listen for connections on, such as :22,:2222")
+	loginShellFlag := flag.Bool("login-shell", false, "run the shell as a login shell")
+	shellArgsFlag := flag.String("shell-args", "", "additional arguments to pass to the shell, separated by spaces")
+	reconnectGraceFlag := flag.Duration("reconnect-grace", 0, "time to keep the shell running after the session disconnects, waiting for it to reconnect")
+	maxAttemptsFlag := flag.Int("max-attempts", 0, "maximum number of connection attempts to accept before exiting, or 0 for no limit")
+	requirePtyFlag := flag.Bool("require-pty", false, "exit with a non-zero status if the client doesn't request a PTY")
+	allowCommentFlag := flag.String("allow-comment", "", "comma-separated list of authorized key comments to accept. all keys are accepted if not passed.")
+	connectionHintFlag := flag.Bool("connection-hint", false, "print the commands a client needs to run to connect")
+	externalHostFlag := flag.String("external-host", "", "hostname clients should use to connect, used in the connection hint")
+	messageFlag := flag.String("message", "", "print this message to the session and disconnect, instead of starting a shell")
+	sftpOnlyFlag := flag.Bool("sftp-only", false, "only allow SFTP sessions, confined to -sftp-root, rejecting shells, commands and PTYs")
+	sftpRootFlag := flag.String("sftp-root", "", "directory to confine -sftp-only sessions to. the current directory is used if not passed.")
+	resolveHostsFlag := flag.Bool("resolve-hosts", false, "log the result of a reverse DNS lookup of the session's remote address")
+	watchKeysFlag := flag.Bool("watch-keys", false, "reload the authorized keys file when it changes")
+	allowUserFlag := flag.String("allow-user", "", "comma-separated list of usernames which clients may connect as. any username is accepted if not passed.")
+	authTimeoutFlag := flag.Duration("auth-timeout", 30*time.Second, "time a connection has to authenticate before it is dropped, or 0 for no limit")
+	logInputFlag := flag.String("log-input", "", "PRIVACY: path to log everything clients type to, including passwords and other input which isn't echoed, separately from the output")
+	transcriptFlag := flag.String("transcript", "", "path to write a timestamped, plain-text transcript of the session output to")
+	warnSensitiveEnvFlag := flag.Bool("warn-sensitive-env", true, "warn when -copy-env copies environment variables which look sensitive")
+	sensitiveEnvFlag := flag.String("sensitive-env", defaultSensitiveEnv, "comma-separated list of glob patterns matching the names of sensitive environment variables")
+	allowAnyKeyFlag := flag.Bool("allow-any-key", false, "INSECURE: accept any public key, for throwaway testing")
+	allowAnyKeyPublicFlag := flag.Bool("allow-any-key-public", false, "allow -allow-any-key to be used when listening on a non-loopback address")
+	hostKeyFlag := flag.String("host-key", "", "path to a private key to use as the host key. a new key is generated if not passed.")
+	hostKeyPassphraseFlag := flag.String("host-key-passphrase", "", "passphrase to decrypt the -host-key with")
+	oncePerKeyFlag := flag.Bool("once-per-key", false, "allow one session per authorized key, rather than one session in total")
+	rlimitFlag := flag.String("rlimit", "", "comma-separated list of resource limits to apply to the shell, such as cpu=60,nofile=256 (linux only)")
+	denyFromFlag := flag.String("deny-from", "", "comma-separated list of CIDR ranges to refuse connections from")
+	outputFlag := flag.String("output", "text", "format of the startup information printed to stdout: text or json")
+	webAddrFlag := flag.String("web-addr", "", "address to serve a terminal in the browser on, for clients without an SSH client. a one-time link to it is printed at startup.")
+	maxLifetimeFlag := flag.Duration("max-lifetime", 0, "time after which the server exits, even if a session is in progress, or 0 for no limit")
+	shutdownGraceFlag := flag.Duration("shutdown-grace", 0, "time to let connections finish when the server shuts down before closing them")
+	serverVersionFlag := flag.String("server-version", "", "SSH protocol version string to send to clients, such as SSH-2.0-OpenSSH_9.0. SSH-2.0-Go is used if not passed.")
+	autoPortFlag := flag.Bool("auto-port", false, "if the port in -addr is in use, listen on the next free port instead")
+	kexFlag := flag.String("kex", defaultKexAlgorithms, "comma-separated list of key exchange algorithms to allow")
+	ciphersFlag := flag.String("ciphers", defaultCiphers, "comma-separated list of ciphers to allow")
+	macsFlag := flag.String("macs", defaultMACs, "comma-separated list of MAC algorithms to allow")
+	logTruncateFlag := flag.Bool("log-truncate", false, "truncate the log file at startup, rather than appending to it")
+	printAuthorizedKeyFlag := flag.String("print-authorized-key", "", "print the authorized_keys line for the given private key file, and exit")
+	checkKeysFlag := flag.Bool("check-keys", false, "check the authorized keys file, report the keys it contains and any invalid lines, and exit")
+	interactiveApproveFlag := flag.Bool("interactive-approve", false, "ask on the terminal whether to allow each session before starting it")
+	approveTimeoutFlag := flag.Duration("approve-timeout", time.Minute, "time to wait for an answer to -interactive-approve before denying the session")
+	maxAuthTriesFlag := flag.Int("max-auth-tries", 6, "maximum number of authentication attempts a connection may make before it is dropped")
+	killRemainingFlag := flag.String("kill-remaining", "", "signal to send to processes left running when the shell exits, such as HUP, TERM or KILL. nothing is sent if not passed.")
+	logMkdirFlag := flag.Bool("log-mkdir", false, "create the directories containing the log files if they don't exist")
+	logGzipFlag := flag.Bool("log-gzip", false, "gzip the log files, adding .gz to their names")
+	subsystemFlag := flag.String("subsystem", "", "only allow sessions which request this subsystem, rejecting shells, commands and other subsystems")
+	subsystemCommandFlag := flag.String("subsystem-command", "", "command to run, using the shell, for the -subsystem subsystem")
+	allowHoursFlag := flag.String("allow-hours", "", "daily window of time in which connections are accepted, such as 09:00-18:00")
+	allowHoursTZFlag := flag.String("allow-hours-tz", "", "time zone of -allow-hours, such as Europe/London. the local time zone is used if not passed.")
+	umaskFlag := flag.String("umask", "", "octal umask to run the shell with, such as 022. the umask otsshd was started with is used if not passed.")
+	logRemoteFlag := flag.String("log-remote", "", "address of a collector to stream log messages to as JSON lines, such as tcp://logs.example.com:5140 or udp://10.0.0.1:5140")
+	logRemoteSessionFlag := flag.Bool("log-remote-session", false, "also stream the session output to -log-remote")
+	clientVersionFlag := flag.String("client-version", "", "regular expression which the client's identification string, such as SSH-2.0-OpenSSH_9.6, must match")
+	minOpenSSHVersionFlag := flag.String("min-openssh-version", "", "oldest version of the OpenSSH client to allow, such as 8.0. other clients aren't affected.")
+	statusFileFlag := flag.String("status-file", "", "path to write a JSON summary of what happened to when otsshd exits, such as whether a session connected and its exit code")
+	noStdoutInfoFlag := flag.Bool("no-stdout-info", false, "don't print the host key block to stdout at startup in -output text mode. the address and host key fingerprint are logged instead.")
+	qrFlag := flag.Bool("qr", false, "print a QR code of the ssh:// URL to connect to at startup, for mobile SSH clients. only printed to a terminal.")
+	programFlag := flag.String("program", "", "program to run in the session's PTY instead of the shell, such as a REPL or menu, with its arguments separated by spaces")
+	hashKnownHostsFlag := flag.Bool("hash-known-hosts", false, "hash the hostname in the known_hosts line of the connection hint and -output json, as OpenSSH's HashKnownHosts does")
+	var logRedactFlag stringsFlag
+	flag.Var(&logRedactFlag, "log-redact", "regular expression matching text to replace with *** in the log and transcript, such as passwords or tokens. may be passed more than once.")
+	monitorAddrFlag := flag.String("monitor-addr", "", "address to serve a websocket on, which streams session events such as connects, resizes and disconnects as JSON")
+	monitorTokenFlag := flag.String("monitor-token", "", "token -monitor-addr clients must present, as a bearer token or the token query parameter")
+	monitorOutputFlag := flag.Bool("monitor-output", false, "also stream the output of sessions to -monitor-addr clients")
+	sealOnFailureFlag := flag.Bool("seal-on-failure", false, "shut down as soon as any key is rejected, treating it as an attack. clients must offer only the right key, such as with ssh -o IdentitiesOnly=yes -i <key>.")
+	logResizesFlag := flag.String("log-resizes", "", "path to record the window sizes of sessions to, as JSON lines giving when each was set and how much of the output had been logged by then, so that replaying the log can redraw full-screen programs correctly")
+	multiplexFlag := flag.String("multiplex", "", "run the session in a tmux or screen session named otssh, creating it or attaching to it if it already exists, so that the work in it survives disconnects")
+	listenRetriesFlag := flag.Int("listen-retries", 3, "number of times to retry, with backoff, if an -addr address is in use. not used with -auto-port.")
+	tailAddrFlag := flag.String("tail-addr", "", "address to serve the session log on over HTTP, streaming it as it is written, like tail -f")
+	tailTokenFlag := flag.String("tail-token", "", "token -tail-addr viewers must present, as a bearer token or the token query parameter")
+	backlogKBFlag := flag.Int("backlog-kb", 64, "KiB of the most recent session output to keep, and send to -tail-addr viewers and -monitor-output clients when they connect, so that they see what came before. 0 disables it.")
+	readyCommandFlag := flag.String("ready-command", "", "command which must succeed before sessions start. it is run with /bin/sh every -ready-interval until it does, and clients which connect before then are held in a waiting room.")
+	readyIntervalFlag := flag.Duration("ready-interval", 2*time.Second, "how often to run -ready-command until it succeeds")
+	minShellDurationFlag := flag.Duration("min-shell-duration", 0, "tell the client when the shell fails within this long of starting, such as from a bad -shell. 0 disables the check.")
+	retryShellFlag := flag.Bool("retry-shell", false, "when the shell fails within -min-shell-duration, don't count the session, and wait for another")
+	motdFlag := flag.String("motd", "", "message of the day to show clients when their shell starts, or @ followed by the path of a file containing it. may refer to {{.RemoteAddress}}, {{.User}}, {{.Fingerprint}}, {{.KeyComment}}, {{.Hostname}} and {{.Time}}.")
+	readOnlyFlag := flag.Bool("read-only", false, "ignore what clients type, so that sessions can only watch the output of the shell or -program")
+	daemonFlag := flag.Bool("daemon", false, "run in the background once the server is listening and the startup information has been printed, returning control to the shell")
+	daemonLogFlag := flag.String("daemon-log", "otsshd.log", "path to log messages to once running in the background with -daemon")
+	debugFlag := flag.Bool("debug", false, "enable debug logging")
 
 	flag.Parse()
 
+	if err := applyEnvDefaults(flag.CommandLine); err != nil {
+		logError(err.Error())
+		os.Exit(2)
+	}
+
+	debugLogging = *debugFlag
+
+	// The copy of otsshd started in the background by -daemon validates the
+	// flags and reports any errors itself.
+	daemonChild := os.Getenv(daemonChildEnv) != ""
+	os.Unsetenv(daemonChildEnv)
+	if *daemonFlag && !daemonChild {
+		os.Exit(startDaemon())
+	}
+
+	switch *outputFlag {
+	case "text":
+	case "json":
+		// Keep stdout free for the JSON object.
+		color.Output = os.Stderr
+	default:
+		logError(fmt.Sprintf("invalid -output %q: must be text or json", *outputFlag))
+		os.Exit(2)
+	}
+
+	if *printAuthorizedKeyFlag != "" {
+		if err := printAuthorizedKey(os.Stdout, *printAuthorizedKeyFlag); err != nil {
+			logError(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	authorizedKeysPath := *authorizedKeysPathFlag
-	if authorizedKeysPath == "" {
+	authorizedKeysURLs := splitList(*authorizedKeysURLFlag)
+	githubUsers := splitList(*githubUsersFlag)
+	authorizedKeysEnv := *authorizedKeysEnvFlag
+	if authorizedKeysPath == "" && len(authorizedKeysURLs) == 0 && len(githubUsers) == 0 && authorizedKeysEnv == "" && !*allowAnyKeyFlag {
 		logNotice("-authorized-keys not passed: reading authorized keys from stdin")
 	}
 
-	announceCmd := *announceCmdFlag
-	copyEnv := *copyEnvFlag
-	logPath := *logPathFlag
-	timeout := *timeoutFlag
-	addr := *addrFlag
+	rlimits, err := parseRlimits(*rlimitFlag)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -rlimit: %v", err))
+		os.Exit(2)
+	}
+
+	denyFrom, err := parseCIDRs(splitList(*denyFromFlag))
+	if err != nil {
+		logError(fmt.Sprintf("invalid -deny-from: %v", err))
+		os.Exit(2)
+	}
+
+	if *serverVersionFlag != "" {
+		if err := validateServerVersion(*serverVersionFlag); err != nil {
+			logError(fmt.Sprintf("invalid -server-version: %v", err))
+			os.Exit(2)
+		}
+	}
+
+	kexAlgorithms, err := parseAlgorithms(*kexFlag, supportedKexAlgorithms)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -kex: %v", err))
+		os.Exit(2)
+	}
+
+	ciphers, err := parseAlgorithms(*ciphersFlag, supportedCiphers)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -ciphers: %v", err))
+		os.Exit(2)
+	}
+
+	macs, err := parseAlgorithms(*macsFlag, supportedMACs)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -macs: %v", err))
+		os.Exit(2)
+	}
+
+	if *maxAuthTriesFlag < 1 {
+		logError(fmt.Sprintf("invalid -max-auth-tries %v: must be at least 1", *maxAuthTriesFlag))
+		os.Exit(2)
+	}
+
+	var killRemainingSignal syscall.Signal
+	if *killRemainingFlag != "" {
+		killRemainingSignal, err = parseSignal(*killRemainingFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -kill-remaining: %v", err))
+			os.Exit(2)
+		}
+	}
+
+	if (*subsystemFlag == "") != (*subsystemCommandFlag == "") {
+		logError("-subsystem and -subsystem-command must be passed together")
+		os.Exit(2)
+	}
+
+	subsystem, sftpRoot := *subsystemFlag, ""
+	if *sftpOnlyFlag {
+		if *subsystemFlag != "" {
+			logError("-sftp-only can't be used with -subsystem")
+			os.Exit(2)
+		}
+		sftpRoot, err = sftpRootDir(*sftpRootFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -sftp-root: %v", err))
+			os.Exit(2)
+		}
+		subsystem = "sftp"
+	} else if *sftpRootFlag != "" {
+		logError("-sftp-root requires -sftp-only")
+		os.Exit(2)
+	}
+
+	var allowHours *timeWindow
+	if *allowHoursFlag != "" {
+		allowHours, err = parseTimeWindow(*allowHoursFlag, *allowHoursTZFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -allow-hours: %v", err))
+			os.Exit(2)
+		}
+	}
+
+	var umask *int
+	if *umaskFlag != "" {
+		mask, err := parseUmask(*umaskFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -umask: %v", err))
+			os.Exit(2)
+		}
+		umask = &mask
+	}
+
+	logRedact, err := parseRedactPatterns(logRedactFlag)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -log-redact: %v", err))
+		os.Exit(2)
+	}
+
+	if *logRemoteFlag != "" {
+		if _, _, err := parseRemoteLogAddr(*logRemoteFlag); err != nil {
+			logError(fmt.Sprintf("invalid -log-remote: %v", err))
+			os.Exit(2)
+		}
+	} else if *logRemoteSessionFlag {
+		logError("-log-remote-session requires -log-remote")
+		os.Exit(2)
+	}
+
+	var clientPolicy clientPolicy
+	if *clientVersionFlag != "" {
+		clientPolicy.versionPattern, err = regexp.Compile(*clientVersionFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -client-version: %v", err))
+			os.Exit(2)
+		}
+	}
+	if *minOpenSSHVersionFlag != "" {
+		clientPolicy.minOpenSSH, err = parseVersion(*minOpenSSHVersionFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -min-openssh-version: %v", err))
+			os.Exit(2)
+		}
+	}
+
+	addrs := splitList(*addrFlag)
+	if len(addrs) == 0 {
+		logError("-addr must contain at least one address")
+		os.Exit(2)
+	}
+
+	if *monitorAddrFlag != "" && *monitorTokenFlag == "" {
+		logError("-monitor-addr requires -monitor-token")
+		os.Exit(2)
+	}
+
+	if *noStdoutInfoFlag && *connectionHintFlag {
+		logError("-no-stdout-info can't be used with -connection-hint")
+		os.Exit(2)
+	}
+
+	if *tailAddrFlag != "" && *tailTokenFlag == "" {
+		logError("-tail-addr requires -tail-token")
+		os.Exit(2)
+	}
+
+	if *backlogKBFlag < 0 {
+		logError("-backlog-kb must not be negative")
+		os.Exit(2)
+	}
+
+	if *timeoutExitCodeFlag < 0 || *timeoutExitCodeFlag > 255 {
+		logError("-timeout-exit-code must be between 0 and 255")
+		os.Exit(2)
+	}
+
+	var motd *template.Template
+	if *motdFlag != "" {
+		motd, err = parseMOTD(*motdFlag)
+		if err != nil {
+			logError(fmt.Sprintf("invalid -motd: %v", err))
+			os.Exit(2)
+		}
+	}
+
+	if *daemonFlag && *interactiveApproveFlag {
+		logError("-daemon can't be used with -interactive-approve, as there is no terminal to ask on once in the background")
+		os.Exit(2)
+	}
+
+	if *announceAsyncFlag && *announceFlag == "" {
+		logError("-announce-async requires -announce")
+		os.Exit(2)
+	}
+
+	if *listenRetriesFlag < 0 {
+		logError("-listen-retries must not be negative")
+		os.Exit(2)
+	}
+
+	if *readyIntervalFlag <= 0 {
+		logError("-ready-interval must be positive")
+		os.Exit(2)
+	}
+
+	if *retryShellFlag && *minShellDurationFlag <= 0 {
+		logError("-retry-shell requires -min-shell-duration")
+		os.Exit(2)
+	}
+
+	program := strings.Fields(*programFlag)
+	if len(program) > 0 && (*loginShellFlag || *shellArgsFlag != "") {
+		logError("-program can't be used with -login-shell or -shell-args")
+		os.Exit(2)
+	}
+
+	multiplex, err := parseMultiplexer(*multiplexFlag)
+	if err != nil {
+		logError(fmt.Sprintf("invalid -multiplex: %v", err))
+		os.Exit(2)
+	}
+	if multiplex != "" && (len(program) > 0 || *loginShellFlag || *shellArgsFlag != "") {
+		logError("-multiplex can't be used with -program, -login-shell or -shell-args")
+		os.Exit(2)
+	}
+
+	if *proxyToFlag != "" && (len(program) > 0 || multiplex != "" || *messageFlag != "" || subsystem != "" || *reconnectGraceFlag != 0) {
+		logError("-proxy-to can't be used with -program, -multiplex, -message, -subsystem, -sftp-only or -reconnect-grace")
+		os.Exit(2)
+	}
+	if *proxyToFlag == "" && (*proxyIdentityFlag != "" || *proxyKnownHostsFlag != "") {
+		logError("-proxy-identity and -proxy-known-hosts require -proxy-to")
+		os.Exit(2)
+	}
+
+	opts := options{
+		authorizedKeysPath:   authorizedKeysPath,
+		authorizedKeysURLs:   authorizedKeysURLs,
+		githubUsers:          githubUsers,
+		authorizedKeysEnv:    authorizedKeysEnv,
+		announce:             *announceFlag,
+		announceMode:         *announceModeFlag,
+		announceAsync:        *announceAsyncFlag,
+		keyHTTPAddr:          *keyHTTPAddrFlag,
+		timeoutExitCode:      *timeoutExitCodeFlag,
+		proxyTo:              *proxyToFlag,
+		proxyIdentity:        *proxyIdentityFlag,
+		proxyKnownHosts:      *proxyKnownHostsFlag,
+		copyEnv:              *copyEnvFlag,
+		logPaths:             splitList(*logPathFlag),
+		timeout:              time.Duration(*timeoutFlag) * time.Second,
+		addrs:                addrs,
+		loginShell:           *loginShellFlag,
+		shellArgs:            strings.Fields(*shellArgsFlag),
+		reconnectGrace:       *reconnectGraceFlag,
+		maxAttempts:          *maxAttemptsFlag,
+		requirePty:           *requirePtyFlag,
+		allowComments:        splitList(*allowCommentFlag),
+		connectionHint:       *connectionHintFlag,
+		externalHost:         *externalHostFlag,
+		message:              *messageFlag,
+		sftpRoot:             sftpRoot,
+		resolveHosts:         *resolveHostsFlag,
+		watchKeys:            *watchKeysFlag,
+		allowUsers:           splitList(*allowUserFlag),
+		authTimeout:          *authTimeoutFlag,
+		transcriptPath:       *transcriptFlag,
+		inputLogPath:         *logInputFlag,
+		readOnly:             *readOnlyFlag,
+		motd:                 motd,
+		daemon:               daemonChild,
+		daemonLog:            *daemonLogFlag,
+		warnSensitiveEnv:     *warnSensitiveEnvFlag,
+		sensitiveEnvPatterns: splitList(*sensitiveEnvFlag),
+		allowAnyKey:          *allowAnyKeyFlag,
+		allowAnyKeyPublic:    *allowAnyKeyPublicFlag,
+		hostKeyPath:          *hostKeyFlag,
+		hostKeyPassphrase:    *hostKeyPassphraseFlag,
+		oncePerKey:           *oncePerKeyFlag,
+		rlimits:              rlimits,
+		denyFrom:             denyFrom,
+		outputFormat:         *outputFlag,
+		webAddr:              *webAddrFlag,
+		maxLifetime:          *maxLifetimeFlag,
+		shutdownGrace:        *shutdownGraceFlag,
+		serverVersion:        *serverVersionFlag,
+		autoPort:             *autoPortFlag,
+		kexAlgorithms:        kexAlgorithms,
+		ciphers:              ciphers,
+		macs:                 macs,
+		logTruncate:          *logTruncateFlag,
+		interactiveApprove:   *interactiveApproveFlag,
+		approveTimeout:       *approveTimeoutFlag,
+		maxAuthTries:         *maxAuthTriesFlag,
+		killRemaining:        killRemainingSignal,
+		logMkdir:             *logMkdirFlag,
+		logGzip:              *logGzipFlag,
+		subsystem:            subsystem,
+		subsystemCommand:     *subsystemCommandFlag,
+		allowHours:           allowHours,
+		umask:                umask,
+		logRedact:            logRedact,
+		logRemote:            *logRemoteFlag,
+		logRemoteSession:     *logRemoteSessionFlag,
+		hashKnownHosts:       *hashKnownHostsFlag,
+		program:              program,
+		qr:                   *qrFlag,
+		clientPolicy:         clientPolicy,
+		statusFile:           *statusFileFlag,
+		minShellDuration:     *minShellDurationFlag,
+		retryShell:           *retryShellFlag,
+		monitorAddr:          *monitorAddrFlag,
+		monitorToken:         *monitorTokenFlag,
+		monitorOutput:        *monitorOutputFlag,
+		noStdoutInfo:         *noStdoutInfoFlag,
+		readyCommand:         *readyCommandFlag,
+		readyInterval:        *readyIntervalFlag,
+		tailAddr:             *tailAddrFlag,
+		tailToken:            *tailTokenFlag,
+		backlogSize:          *backlogKBFlag * 1024,
+		listenRetries:        *listenRetriesFlag,
+		multiplex:            multiplex,
+		resizeLogPath:        *logResizesFlag,
+		sealOnFailure:        *sealOnFailureFlag,
+	}
 
-	if err := run(authorizedKeysPath, announceCmd, logPath, addr, timeout, copyEnv); err != nil {
-		code := 0
+	if *checkKeysFlag {
+		ok, err := checkKeys(os.Stdout, opts.authorizedKeysPath, opts.outputFormat)
+		if err != nil {
+			logError(err.Error())
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
 
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-			code = exitErr.ProcessState.ExitCode()
+	result, err := run(opts)
+	if opts.statusFile != "" {
+		if err := writeStatusFile(opts.statusFile, result, err); err != nil {
+			logWarn(fmt.Sprintf("failed to write status file: %v", err))
 		}
+	}
 
+	if err != nil {
 		logError(err.Error())
-		os.Exit(code)
+		os.Exit(exitCodeFor(err))
 	}
 }
 
-func run(authorizedKeysPath, announceCmd, logPath, addr string, timeout int, copyEnv bool) error {
+// envName returns the name of the environment variable which can be used to
+// set the flag with the given name, for example OTSSH_AUTHORIZED_KEYS for
+// -authorized-keys.
+func envName(flagName string) string {
+	return "OTSSH_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvDefaults sets each flag in fs which wasn't passed on the command
+// line from its environment variable, if that variable is set. It must be
+// called after fs is parsed, so that flags passed on the command line take
+// precedence, rather than being added to the environment's values for flags
+// which may be repeated.
+func applyEnvDefaults(fs *flag.FlagSet) error {
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || passed[f.Name] || err != nil {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %v: %w", value, envName(f.Name), setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Containers are commonly configured with a port rather than an
+	// address, so OTSSH_PORT listens on that port on every address, unless
+	// -addr or OTSSH_ADDR is set.
+	port, ok := os.LookupEnv("OTSSH_PORT")
+	if _, addrSet := os.LookupEnv(envName("addr")); !ok || addrSet || passed["addr"] || fs.Lookup("addr") == nil {
+		return nil
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid value %q for OTSSH_PORT: must be a port number", port)
+	}
+	return fs.Set("addr", ":"+port)
+}
+
+// options holds the configuration of a single otsshd run, as parsed from the
+// command line.
+type options struct {
+	authorizedKeysPath string
+	authorizedKeysURLs []string
+	githubUsers        []string
+	authorizedKeysEnv  string
+	announce           string
+	announceMode       string
+	copyEnv            bool
+	logPaths           []string
+	timeout            time.Duration
+	addrs              []string
+
+	// announceAsync makes the announcement in the background once the server
+	// is listening, rather than before it listens.
+	announceAsync bool
+
+	// keyHTTPAddr, if set, is where the host public key is served over
+	// HTTP once the server is listening.
+	keyHTTPAddr string
+
+	// timeoutExitCode, if not 0, is the status otsshd exits with when no
+	// session starts within the timeout.
+	timeoutExitCode int
+
+	// proxyTo, if set, is the backend host sessions are proxied to, which
+	// is authenticated to with proxyIdentity or the SSH agent and whose
+	// host key is checked against proxyKnownHosts.
+	proxyTo         string
+	proxyIdentity   string
+	proxyKnownHosts string
+
+	// proxy is the backend for proxyTo, set up by run.
+	proxy *proxyBackend
+
+	// loginShell causes the shell to be started as a login shell, by prefixing
+	// its argv[0] with a dash.
+	loginShell bool
+
+	// shellArgs are passed to the shell after its path.
+	shellArgs []string
+
+	// reconnectGrace is how long the shell is kept alive after its session
+	// disconnects, so that the same key can reconnect and reattach to it.
+	reconnectGrace time.Duration
+
+	// maxAttempts is the total number of connection attempts, from any
+	// address, that the server will accept before shutting down. Zero means
+	// no limit.
+	maxAttempts int
+
+	// requirePty causes sessions without a PTY to be rejected with a non-zero
+	// exit status, rather than just a message.
+	requirePty bool
+
+	// allowComments, if non-empty, restricts the authorized keys to those
+	// whose comment is in the list.
+	allowComments []string
+
+	// connectionHint causes the commands needed to connect to be printed at
+	// startup. externalHost is the hostname used in them.
+	connectionHint bool
+	externalHost   string
+
+	// message, if set, is written to the session instead of starting a shell.
+	message string
+
+	// sftpRoot, if set, is the directory -sftp-only sessions are confined
+	// to. subsystem is then sftp, which is served by otsshd itself rather
+	// than by subsystemCommand, and PTYs are rejected.
+	sftpRoot string
+
+	// resolveHosts enables reverse DNS lookups of the session's remote
+	// address.
+	resolveHosts bool
+
+	// watchKeys causes the authorized keys file to be reloaded whenever it
+	// changes.
+	watchKeys bool
+
+	// allowUsers, if non-empty, restricts the usernames clients may connect
+	// as.
+	allowUsers []string
+
+	// authTimeout is how long a connection may take to authenticate before
+	// it is dropped. Zero means no limit.
+	authTimeout time.Duration
+
+	// transcriptPath, if set, is where a plain-text transcript of the session
+	// output is written, in addition to the raw log.
+	transcriptPath string
+
+	// inputLogPath, if set, is where the raw input sent by clients is
+	// logged.
+	inputLogPath string
+
+	// motd, if set, is shown to clients when their shell starts.
+	motd *template.Template
+
+	// readOnly drops the input sent by clients of shell sessions, rather
+	// than passing it to the shell.
+	readOnly bool
+
+	// daemon is set in the copy of otsshd which -daemon runs in the
+	// background. It detaches from the terminal once the startup
+	// information has been printed, logging to daemonLog from then on.
+	daemon    bool
+	daemonLog string
+
+	// warnSensitiveEnv causes a warning to be logged if copyEnv would copy
+	// any variables whose names match sensitiveEnvPatterns into the session.
+	warnSensitiveEnv     bool
+	sensitiveEnvPatterns []string
+
+	// allowAnyKey causes any public key to be accepted. Unless
+	// allowAnyKeyPublic is also set, it may only be used when listening on a
+	// loopback address.
+	allowAnyKey       bool
+	allowAnyKeyPublic bool
+
+	// hostKeyPath, if set, is the private key file to use as the host key,
+	// rather than generating a new one. hostKeyPassphrase decrypts it.
+	hostKeyPath       string
+	hostKeyPassphrase string
+
+	// oncePerKey allows each authorized key to be used for one session,
+	// rather than allowing one session in total.
+	oncePerKey bool
+
+	// authHook, if set, customises how connections are authenticated. It
+	// isn't exposed as a flag, but allows authentication against other
+	// systems, such as LDAP or a database, to be plugged in.
+	authHook authHook
+
+	// rlimits are applied to the shell once it has started.
+	rlimits []rlimit
+
+	// denyFrom lists the ranges of addresses which connections are always
+	// refused from.
+	denyFrom []*net.IPNet
+
+	// outputFormat is the format of the startup information printed to
+	// stdout: "text" or "json".
+	outputFormat string
+
+	// webAddr, if set, is the address to serve the web terminal on.
+	webAddr string
+
+	// maxLifetime is how long the server may run for in total, including
+	// any session in progress. Zero means no limit.
+	maxLifetime time.Duration
+
+	// shutdownGrace is how long connections are given to end when the
+	// server shuts down, before they are closed. Zero closes them
+	// immediately.
+	shutdownGrace time.Duration
+
+	// serverVersion, if set, is the SSH protocol version string sent to
+	// clients, in place of the default.
+	serverVersion string
+
+	// autoPort causes the server to listen on the next free port if the
+	// port in an address is in use.
+	autoPort bool
+
+	// kexAlgorithms, ciphers and macs are the algorithms clients may
+	// negotiate, in order of preference.
+	kexAlgorithms []string
+	ciphers       []string
+	macs          []string
+
+	// logTruncate causes the log file to be truncated at startup, rather
+	// than appended to.
+	logTruncate bool
+
+	// interactiveApprove causes the operator to be asked on the terminal
+	// whether to allow each session, denying it if there is no answer
+	// within approveTimeout.
+	interactiveApprove bool
+	approveTimeout     time.Duration
+
+	// approveSession, if set, is called once a session has authenticated,
+	// and the session is only started if it returns true. It is set by
+	// -interactive-approve.
+	approveSession approveFunc
+
+	// maxAuthTries is the number of authentication attempts a connection
+	// may make before it is dropped.
+	maxAuthTries int
+
+	// killRemaining, if non-zero, is sent to the processes in the shell's
+	// process group which are still running when the shell exits, such as
+	// background jobs.
+	killRemaining syscall.Signal
+
+	// logMkdir causes the directories containing the log files to be
+	// created if they don't exist.
+	logMkdir bool
+
+	// logGzip causes the log files to be gzipped.
+	logGzip bool
+
+	// subsystem, if set, is the only subsystem sessions may request: shells,
+	// commands and other subsystems are rejected. subsystemCommand is run,
+	// using the shell, to handle it.
+	subsystem        string
+	subsystemCommand string
+
+	// allowHours, if set, is the daily window of time in which clients may
+	// authenticate.
+	allowHours *timeWindow
+
+	// umask, if set, is the umask the shell and subsystem commands are run
+	// with.
+	umask *int
+
+	// logRedact are patterns matching text which is replaced in the log and
+	// transcript, but not in the output sent to the client.
+	logRedact []*regexp.Regexp
+
+	// logRemote, if set, is the address of a collector to stream log
+	// messages to, and the session output too if logRemoteSession is set.
+	logRemote        string
+	logRemoteSession bool
+
+	// hashKnownHosts causes the host in the known_hosts lines printed at
+	// startup to be hashed.
+	hashKnownHosts bool
+
+	// program, if set, is the command line of a program which is run in the
+	// session's PTY in place of the shell.
+	program []string
+
+	// openSessionLog, if set, opens a separate log for the nth session, in
+	// place of the log shared by every session.
+	openSessionLog func(n int) (io.Writer, func(), error)
+
+	// flushSessionLog, if set, is called when a session written to the log
+	// shared by every session ends, so that its log is complete even if
+	// otsshd is killed before closing it.
+	flushSessionLog func()
+
+	// qr causes a QR code of the URL to connect to to be printed at startup.
+	qr bool
+
+	// clientPolicy is the minimum clients must meet to authenticate.
+	clientPolicy clientPolicy
+
+	// statusFile, if set, is where a summary of the run is written when
+	// otsshd exits.
+	statusFile string
+
+	// minShellDuration, if positive, is how long the shell must run for
+	// before failing for the failure not to be reported to the client as an
+	// early exit.
+	minShellDuration time.Duration
+
+	// retryShell frees the slot of a session whose shell exits early, so
+	// that another session can take its place.
+	retryShell bool
+
+	// monitorAddr, if set, is where session events are served to monitors
+	// over a websocket, which must present monitorToken.
+	monitorAddr  string
+	monitorToken string
+
+	// monitorOutput includes the output of sessions in the events.
+	monitorOutput bool
+
+	// onEvent, if set, is called with each event during sessions.
+	onEvent func(event sessionEvent)
+
+	// noStdoutInfo stops the host key block being printed to stdout at
+	// startup, for scripts which capture stdout.
+	noStdoutInfo bool
+
+	// readyCommand, if set, must succeed before sessions start. It is run
+	// every readyInterval until it does.
+	readyCommand  string
+	readyInterval time.Duration
+
+	// tailAddr, if set, is where the session log is served over HTTP to
+	// viewers, which must present tailToken.
+	tailAddr  string
+	tailToken string
+
+	// backlogSize is the number of bytes of the most recent session output
+	// sent to tail viewers and monitors when they connect.
+	backlogSize int
+
+	// logTail, if set, is sent the session output as it is written to the
+	// session log, before any redaction.
+	logTail io.Writer
+
+	// syslog, if set, is the connection to syslog opened by run for
+	// -log=syslog, shared by the log messages and every session's log.
+	syslog io.Writer
+
+	// listenRetries is the number of times listening on an address which is
+	// in use is retried.
+	listenRetries int
+
+	// multiplex, if set, is the multiplexer, tmux or screen, to run the
+	// session in.
+	multiplex string
+
+	// resizeLogPath, if set, is where the window sizes of PTY sessions are
+	// recorded.
+	resizeLogPath string
+
+	// sealOnFailure shuts the server down when any key is rejected.
+	sealOnFailure bool
+}
+
+// defaultSensitiveEnv is the default value of -sensitive-env.
+const defaultSensitiveEnv = "AWS_*,*_TOKEN,*_SECRET,*_PASSWORD"
+
+// splitList splits a comma-separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
+
+func run(opts options) (runResult, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		return fmt.Errorf("failed to open log file at %v: %w", logPath, err)
+	if opts.proxyTo != "" {
+		proxy, err := newProxyBackend(opts.proxyTo, opts.proxyIdentity, opts.proxyKnownHosts)
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to set up -proxy-to: %w", err)
+		}
+		opts.proxy = proxy
+	} else if opts.message == "" && opts.multiplex != "" {
+		if _, err := exec.LookPath(opts.multiplex); err != nil {
+			return runResult{}, fmt.Errorf("multiplexer %v is not runnable: %w", opts.multiplex, err)
+		}
+	} else if opts.message == "" && len(opts.program) > 0 {
+		if _, err := exec.LookPath(opts.program[0]); err != nil {
+			return runResult{}, fmt.Errorf("program %v is not runnable: %w", opts.program[0], err)
+		}
+	} else if opts.message == "" {
+		if _, err := exec.LookPath(userShell()); err != nil {
+			return runResult{}, fmt.Errorf("shell %v is not runnable: %w", userShell(), err)
+		}
 	}
 
-	authorizedKeys, err := parseAuthorizedKeysFile(authorizedKeysPath)
-	if err != nil {
-		return fmt.Errorf("failed to parse authorized keys file: %w", err)
+	if opts.inputLogPath != "" {
+		logWarn(fmt.Sprintf("-log-input is set: everything clients type, including passwords which aren't shown on screen, will be recorded in %v", opts.inputLogPath))
+		if len(opts.logRedact) > 0 {
+			logWarn("-log-redact isn't applied to -log-input, which records the raw input as typed")
+		}
 	}
 
-	pub, priv, err := generateKey()
+	if opts.allowAnyKey && !opts.allowAnyKeyPublic {
+		for _, addr := range opts.addrs {
+			if !isLoopbackAddr(addr) {
+				return runResult{}, fmt.Errorf("refusing to accept any key while listening on %v, which may be publicly reachable: "+
+					"listen on a loopback address, or also pass -allow-any-key-public", addr)
+			}
+		}
+	}
+
+	if opts.interactiveApprove {
+		approver, err := newTTYApprover(opts.approveTimeout)
+		if err != nil {
+			return runResult{}, fmt.Errorf("-interactive-approve needs a terminal: %w", err)
+		}
+		opts.approveSession = func(s ssh.Session) bool {
+			return approver.approve(fmt.Sprintf("Allow connection from %v with key %v?", s.RemoteAddr(), gossh.FingerprintSHA256(s.PublicKey())))
+		}
+	}
+
+	if opts.watchKeys && opts.authorizedKeysPath == "" {
+		return runResult{}, errors.New("-watch-keys requires -authorized-keys")
+	}
+
+	var announcer announcer
+	if opts.announce != "" {
+		var err error
+		announcer, err = newAnnouncer(opts.announceMode, opts.announce)
+		if err != nil {
+			return runResult{}, &announceError{err: err}
+		}
+	}
+
+	if contains(opts.logPaths, "syslog") {
+		sw, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "otsshd")
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		logSyslog = sw
+		opts.syslog = sw
+		defer sw.Close()
+	}
+
+	if opts.logRemote != "" {
+		remote, err := newRemoteLog(opts.logRemote)
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to set up -log-remote: %w", err)
+		}
+		logRemote = remote
+		defer remote.Close()
+	}
+
+	if opts.monitorAddr != "" {
+		monitor, err := newMonitor(opts.monitorAddr, opts.monitorToken, opts.backlogSize)
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to set up -monitor-addr: %w", err)
+		}
+		defer monitor.Close()
+
+		opts.onEvent = monitor.publish
+		logNotice(fmt.Sprintf("serving session events to monitors on %v", monitor.Addr()))
+	}
+
+	if opts.tailAddr != "" {
+		tail, err := newTailServer(opts.tailAddr, opts.tailToken, opts.backlogSize)
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to set up -tail-addr: %w", err)
+		}
+		defer tail.Close()
+
+		opts.logTail = tail
+		logNotice(fmt.Sprintf("serving the session log to viewers on %v", tail.Addr()))
+	}
+
+	var (
+		logWriter io.Writer
+		err       error
+	)
+	if opts.oncePerKey {
+		// Sessions may run at the same time, so each is logged to its own
+		// files, rather than interleaving their output in one log.
+		opts.openSessionLog = func(n int) (io.Writer, func(), error) {
+			w, _, closeLog, err := openSessionLog(opts, fmt.Sprintf("session-%v", n))
+			return w, closeLog, err
+		}
+	} else {
+		var closeLog func()
+		logWriter, opts.flushSessionLog, closeLog, err = openSessionLog(opts, "")
+		if err != nil {
+			return runResult{}, err
+		}
+		defer closeLog()
+	}
+
+	var authorizedKeys []authorizedKey
+	if opts.allowAnyKey {
+		logWarn("-allow-any-key is set: ANYONE who can connect to the server will be given a shell")
+	} else {
+		authorizedKeys, err = loadAuthorizedKeys(opts)
+		if err != nil {
+			return runResult{}, &keysError{err: err}
+		}
+	}
+
+	keys := newKeySet(authorizedKeys)
+	if opts.watchKeys {
+		if err := watchAuthorizedKeys(keys, opts, ctx.Done()); err != nil {
+			return runResult{}, &keysError{err: fmt.Errorf("failed to watch authorized keys file: %w", err)}
+		}
+	}
+
+	var signer ssh.Signer
+	var pubKey gossh.PublicKey
+	if opts.hostKeyPath != "" {
+		signer, pubKey, err = loadHostKey(opts.hostKeyPath, opts.hostKeyPassphrase)
+	} else {
+		signer, pubKey, err = newHostKey()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to generate key: %w", err)
+		return runResult{}, err
 	}
 
-	privPEM := generatePrivateKeyPEM(priv)
-	signer, err := gossh.ParsePrivateKey(privPEM)
+	if announcer != nil && !opts.announceAsync {
+		announceHostKey(announcer, pubKey)
+	}
+
+	server, err := newOneTimeServer(keys, signer, logWriter, opts)
 	if err != nil {
-		return fmt.Errorf("failed to convert private key to format expected by ssh server: %w", err)
+		return runResult{}, fmt.Errorf("failed to create server: %w", err)
+	}
+	if err := server.Listen(); err != nil {
+		return runResult{}, err
 	}
 
-	pubKey, err := gossh.NewPublicKey(pub)
+	if announcer != nil && opts.announceAsync {
+		// The server is already listening, so clients which act on the
+		// announcement can connect as soon as it is made.
+		go announceHostKey(announcer, pubKey)
+	}
+
+	if opts.keyHTTPAddr != "" {
+		keyServer, err := newKeyServer(opts.keyHTTPAddr, opts.externalHost, server.Addrs(), pubKey, opts.hashKnownHosts)
+		if err != nil {
+			return runResult{}, fmt.Errorf("failed to set up -key-http-addr: %w", err)
+		}
+		defer keyServer.Close()
+
+		logNotice(fmt.Sprintf("serving the host public key on http://%v/", keyServer.Addr()))
+	}
+
+	if opts.maxLifetime > 0 {
+		lifetime := time.AfterFunc(opts.maxLifetime, func() {
+			logWarn(fmt.Sprintf("maximum lifetime (%v) reached, exiting", opts.maxLifetime))
+			server.Close()
+		})
+		defer lifetime.Stop()
+	}
+
+	webURL, err := server.WebURL(opts.externalHost)
 	if err != nil {
-		return fmt.Errorf("failed to convert public key to ssh.PublicKey: %w", err)
+		logWarn(fmt.Sprintf("failed to build the web terminal link: %v", err))
+	}
+
+	if opts.outputFormat == "json" {
+		if err := writeStartupInfo(os.Stdout, opts.externalHost, server.Addrs(), pubKey, opts.hashKnownHosts, webURL); err != nil {
+			return runResult{}, fmt.Errorf("failed to write startup info: %w", err)
+		}
+	} else if opts.noStdoutInfo {
+		logNotice(fmt.Sprintf("listening on %v with host key %v", joinAddrs(server.Addrs()), gossh.FingerprintSHA256(pubKey)))
+		if webURL != "" {
+			logNotice(fmt.Sprintf("serving the web terminal at %v", webURL))
+		}
+	} else {
+		logSuccess(fmt.Sprintf("Starting server listening on %v. The server will use the following key:", joinAddrs(server.Addrs())))
+
+		fmt.Printf("\n%v\n\n", formatKnownHosts(pubKey))
+
+		if opts.connectionHint {
+			hint, err := formatConnectionHint(opts.externalHost, server.Addr(), pubKey, opts.hashKnownHosts)
+			if err != nil {
+				logWarn(fmt.Sprintf("failed to build connection hint: %v", err))
+			} else {
+				logSuccess("To connect, run:")
+				fmt.Printf("\n%v\n\n", hint)
+			}
+		}
+
+		if webURL != "" {
+			logSuccess("To connect from a browser, open:")
+			fmt.Printf("\n%v\n\n", webURL)
+		}
 	}
 
-	if announceCmd != "" {
-		if stderr, err := performAnnouncement(announceCmd, pubKey); err != nil {
-			logWarn(fmt.Sprintf("announcement failed: %v", err))
-			logWarn(fmt.Sprintf("stderr from announcement: %v", stderr))
+	if opts.qr {
+		// With -output json, stdout is kept for the JSON object.
+		out := os.Stdout
+		if opts.outputFormat == "json" || opts.noStdoutInfo {
+			out = os.Stderr
+		}
+
+		if err := printConnectionQR(out, opts.externalHost, server.Addr()); err != nil {
+			logWarn(fmt.Sprintf("not printing QR code: %v", err))
 		}
 	}
 
-	timeoutDuration := time.Duration(timeout) * time.Second
+	if opts.daemon {
+		if err := detachDaemon(opts.daemonLog, opts.statusFile, opts.logMkdir); err != nil {
+			return runResult{}, fmt.Errorf("failed to run in the background: %w", err)
+		}
+	}
 
-	logSuccess(fmt.Sprintf("Starting server listening on %v. The server will use the following key:", addr))
-	server := newOneTimeServer(addr, authorizedKeys, signer, logFile, copyEnv, timeoutDuration)
+	resetSignals := make(chan os.Signal, 1)
+	signal.Notify(resetSignals, syscall.SIGUSR1)
+	defer signal.Stop(resetSignals)
 
-	fmt.Printf("\n%v\n\n", formatKnownHosts(pubKey))
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	defer signal.Stop(reloadSignals)
 
-	if err = server.ListenAndServe(ctx); err != nil {
-		if errors.Is(err, ssh.ErrServerClosed) {
-			return nil
+	// Suspending otsshd with Ctrl-Z would freeze the client's session
+	// without telling them why, so catch the signal to stay running.
+	suspendSignals := make(chan os.Signal, 1)
+	signal.Notify(suspendSignals, syscall.SIGTSTP)
+	defer signal.Stop(suspendSignals)
+
+	// Rather than dying straight away, closing the server on SIGINT or
+	// SIGTERM ends the session and completes its logs, which would
+	// otherwise be cut short, leaving compressed logs unreadable.
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stopSignals)
+	stoppedBy := make(chan syscall.Signal, 1)
+
+	go func() {
+		for {
+			select {
+			case <-resetSignals:
+				server.ResetTimeout()
+			case <-reloadSignals:
+				reload(keys, opts)
+			case <-suspendSignals:
+				logWarn("not suspending: it would freeze the session. Press Ctrl-C to stop otsshd instead")
+			case sig := <-stopSignals:
+				select {
+				case stoppedBy <- sig.(syscall.Signal):
+					logWarn(fmt.Sprintf("received %v, closing the server", sig))
+					go server.Close()
+				default:
+					logError(fmt.Sprintf("received %v again, exiting without waiting for the server to close", sig))
+					os.Exit(128 + int(sig.(syscall.Signal)))
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		return err
+	err = server.Serve(ctx)
+	result := server.Result()
+	if err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+		return result, err
 	}
 
-	if err := server.Close(); err != nil {
-		return fmt.Errorf("failed to ")
+	select {
+	case sig := <-stoppedBy:
+		return result, &signalError{sig: sig}
+	default:
 	}
 
-	return server.SessionError()
+	// If the shell exited with a non-zero status, this will be an
+	// *exec.ExitError, which main uses as the exit code of the process.
+	return result, server.SessionError()
+}
+
+// reload handles SIGHUP by reloading the authorized keys.
+func reload(keys *keySet, opts options) {
+	if opts.allowAnyKey {
+		logNotice("received SIGHUP, but -allow-any-key is set: nothing to reload")
+		return
+	}
+
+	sources := keySources(opts)
+	if _, ok := sources[0].(stdinKeySource); ok {
+		logWarn("received SIGHUP, but authorized keys were read from stdin and can't be reloaded")
+		return
+	}
+
+	logNotice("received SIGHUP, reloading authorized keys")
+	if err := reloadAuthorizedKeys(keys, opts); err != nil {
+		logWarn(fmt.Sprintf("failed to reload authorized keys, keeping previous keys: %v", err))
+	}
+}
+
+// newHostKey generates a new host key, returning it as both a signer for the
+// server and the public key clients should expect.
+func newHostKey() (ssh.Signer, gossh.PublicKey, error) {
+	pub, priv, err := generateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	privPEM := generatePrivateKeyPEM(priv)
+	signer, err := gossh.ParsePrivateKey(privPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert private key to format expected by ssh server: %w", err)
+	}
+
+	pubKey, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert public key to ssh.PublicKey: %w", err)
+	}
+
+	return signer, pubKey, nil
+}
+
+// loadHostKey reads a host key from the private key file at path, which is
+// decrypted with passphrase if it is encrypted.
+func loadHostKey(path, passphrase string) (ssh.Signer, gossh.PublicKey, error) {
+	privPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+
+	var signer gossh.Signer
+	if passphrase != "" {
+		signer, err = gossh.ParsePrivateKeyWithPassphrase(privPEM, []byte(passphrase))
+	} else {
+		signer, err = gossh.ParsePrivateKey(privPEM)
+	}
+
+	var missingErr *gossh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		return nil, nil, fmt.Errorf("host key %v is encrypted: pass its passphrase using -host-key-passphrase", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse host key %v: %w", path, err)
+	}
+
+	return signer, signer.PublicKey(), nil
 }
 
 func generateKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
@@ -129,51 +1265,103 @@ func formatKnownHosts(key ssh.PublicKey) string {
 	return fmt.Sprintf("%v %s", key.Type(), base64.StdEncoding.EncodeToString(key.Marshal()))
 }
 
-func performAnnouncement(command string, key ssh.PublicKey) (stderr string, err error) {
-	args := strings.Fields(command)
-	args = append(args, formatKnownHosts(key))
-	_, err = exec.Command(args[0], args[1:]...).Output()
+// joinAddrs formats a list of addresses, separated by commas.
+func joinAddrs(addrs []net.Addr) string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// isLoopbackAddr reports whether addr, a host:port address to listen on, only
+// listens on a loopback interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		var eerr *exec.ExitError
-		if errors.As(err, &eerr) {
-			return string(eerr.Stderr), err
-		}
-		return "", err
+		return false
+	}
+
+	if host == "localhost" {
+		return true
 	}
-	return "", nil
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
-func parseAuthorizedKeysFile(path string) ([]gossh.PublicKey, error) {
-	f := os.Stdin
-	if path != "" {
-		var err error
-		f, err = os.Open(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open file: %w", err)
-		}
+// formatConnectionHint returns the commands a client needs to run to trust the
+// host key and connect to the server listening on addr. If host is empty, the
+// listening address is used, falling back to this machine's hostname. If
+// hashHost is set, the host is hashed in the known_hosts line.
+func formatConnectionHint(host string, addr net.Addr, key ssh.PublicKey, hashHost bool) (string, error) {
+	knownHostsLine, command, err := connectionInfo(host, addr, key, hashHost)
+	if err != nil {
+		return "", err
 	}
 
-	var keys []gossh.PublicKey
+	return fmt.Sprintf("echo '%s' >> ~/.ssh/known_hosts\n%s", knownHostsLine, command), nil
+}
 
-	scanner := bufio.NewScanner(f)
+// connectionHost returns the host and port a client should connect to, to
+// reach the server listening on addr. host is interpreted as by
+// formatConnectionHint.
+func connectionHost(host string, addr net.Addr) (string, string, error) {
+	listenHost, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse listening address: %w", err)
+	}
 
-	for scanner.Scan() {
-		bytes := scanner.Bytes()
-		if len(keys) == 0 && len(bytes) == 0 {
-			return nil, fmt.Errorf("no keys supplied - either pass a file using -authorized-keys, or pipe them in")
+	if host == "" {
+		host = listenHost
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+			host, err = os.Hostname()
+			if err != nil {
+				return "", "", fmt.Errorf("failed to determine hostname: %w", err)
+			}
 		}
+	}
 
-		key, _, _, _, err := gossh.ParseAuthorizedKey(bytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse key on line %v: %w", len(keys), err)
-		}
+	return host, port, nil
+}
+
+// connectionInfo returns the known_hosts line a client needs to trust the host
+// key, and the command it needs to run to connect to the server listening on
+// addr. host is interpreted as by formatConnectionHint.
+//
+// If hashHost is set, the host in the known_hosts line is hashed, as OpenSSH
+// does with HashKnownHosts, so that it isn't stored in plain text.
+func connectionInfo(host string, addr net.Addr, key ssh.PublicKey, hashHost bool) (knownHostsLine, command string, err error) {
+	host, port, err := connectionHost(host, addr)
+	if err != nil {
+		return "", "", err
+	}
 
-		keys = append(keys, key)
+	destination := host
+	if u, err := user.Current(); err == nil {
+		destination = u.Username + "@" + host
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanning file failed: %w", err)
+	knownHost := knownhosts.Normalize(net.JoinHostPort(host, port))
+	if hashHost {
+		salt := make([]byte, sha1.Size)
+		if _, err := rand.Read(salt); err != nil {
+			return "", "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		knownHost = hashKnownHost(knownHost, salt)
 	}
 
-	return keys, nil
+	knownHostsLine = knownhosts.Line([]string{knownHost}, key)
+	command = fmt.Sprintf("ssh -t -p %s %s", port, destination)
+
+	return knownHostsLine, command, nil
+}
+
+// hashKnownHost hashes host, as normalized for a known_hosts file, with salt,
+// in the format ssh-keygen -H writes: the salt and the HMAC-SHA1 of the host,
+// keyed with the salt.
+func hashKnownHost(host string, salt []byte) string {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestApplyEnvDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantTimeout int
+		wantRedact  []string
+		wantAddr    string
+	}{
+		{
+			name:        "defaults",
+			wantTimeout: 600,
+		},
+		{
+			name:        "env only",
+			env:         map[string]string{"OTSSH_TIMEOUT": "60", "OTSSH_LOG_REDACT": "token"},
+			wantTimeout: 60,
+			wantRedact:  []string{"token"},
+		},
+		{
+			name:        "flags only",
+			args:        []string{"-timeout=30", "-log-redact=a", "-log-redact=b"},
+			wantTimeout: 30,
+			wantRedact:  []string{"a", "b"},
+		},
+		{
+			name:        "flags take precedence",
+			env:         map[string]string{"OTSSH_TIMEOUT": "60", "OTSSH_LOG_REDACT": "token"},
+			args:        []string{"-timeout=30", "-log-redact=a"},
+			wantTimeout: 30,
+			wantRedact:  []string{"a"},
+		},
+		{
+			name:        "env fills flags not passed",
+			env:         map[string]string{"OTSSH_TIMEOUT": "60", "OTSSH_LOG_REDACT": "token"},
+			args:        []string{"-log-redact=a"},
+			wantTimeout: 60,
+			wantRedact:  []string{"a"},
+		},
+		{
+			name:        "port",
+			env:         map[string]string{"OTSSH_PORT": "2200"},
+			wantTimeout: 600,
+			wantAddr:    ":2200",
+		},
+		{
+			name:        "address takes precedence over port",
+			env:         map[string]string{"OTSSH_PORT": "2200", "OTSSH_ADDR": "127.0.0.1:2300"},
+			wantTimeout: 600,
+			wantAddr:    "127.0.0.1:2300",
+		},
+		{
+			name:        "address flag takes precedence over port",
+			env:         map[string]string{"OTSSH_PORT": "2200"},
+			args:        []string{"-addr=:2400"},
+			wantTimeout: 600,
+			wantAddr:    ":2400",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			fs := flag.NewFlagSet("otsshd", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			timeout := fs.Int("timeout", 600, "")
+			addr := fs.String("addr", ":2022", "")
+			var redact stringsFlag
+			fs.Var(&redact, "log-redact", "")
+
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if err := applyEnvDefaults(fs); err != nil {
+				t.Fatalf("applyEnvDefaults failed: %v", err)
+			}
+
+			if *timeout != tt.wantTimeout {
+				t.Errorf("timeout = %v, want %v", *timeout, tt.wantTimeout)
+			}
+			if !reflect.DeepEqual([]string(redact), tt.wantRedact) {
+				t.Errorf("log-redact = %q, want %q", redact, tt.wantRedact)
+			}
+			if tt.wantAddr == "" {
+				tt.wantAddr = ":2022"
+			}
+			if *addr != tt.wantAddr {
+				t.Errorf("addr = %q, want %q", *addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestApplyEnvDefaultsInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name, env, value string
+	}{
+		{"timeout", "OTSSH_TIMEOUT", "soon"},
+		{"port name", "OTSSH_PORT", "ssh"},
+		{"port out of range", "OTSSH_PORT", "70000"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+
+			fs := flag.NewFlagSet("otsshd", flag.ContinueOnError)
+			fs.Int("timeout", 600, "")
+			fs.String("addr", ":2022", "")
+			if err := fs.Parse(nil); err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			if err := applyEnvDefaults(fs); err == nil {
+				t.Errorf("applyEnvDefaults succeeded with %v=%v", tt.env, tt.value)
+			}
+		})
+	}
+}
+
+func TestConnectionInfoHashKnownHosts(t *testing.T) {
+	_, hostKey, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 2222}
+
+	for _, tt := range []struct {
+		name     string
+		hashHost bool
+	}{
+		{"plain", false},
+		{"hashed", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			line, _, err := connectionInfo("", addr, hostKey, tt.hashHost)
+			if err != nil {
+				t.Fatalf("connectionInfo failed: %v", err)
+			}
+			if got := strings.Contains(line, "192.0.2.10"); got == tt.hashHost {
+				t.Errorf("known_hosts line %q contains the host = %v, want %v", line, got, !tt.hashHost)
+			}
+			if tt.hashHost && !strings.HasPrefix(line, "|1|") {
+				t.Errorf("known_hosts line %q isn't hashed", line)
+			}
+
+			// Whether hashed or not, OpenSSH accepts the line for the
+			// address it was printed for, and only that address.
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if err := ioutil.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+				t.Fatalf("failed to write known_hosts: %v", err)
+			}
+			callback, err := knownhosts.New(path)
+			if err != nil {
+				t.Fatalf("failed to parse known_hosts line %q: %v", line, err)
+			}
+			if err := callback("192.0.2.10:2222", addr, hostKey); err != nil {
+				t.Errorf("known_hosts line %q doesn't match the server: %v", line, err)
+			}
+			other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 11), Port: 2222}
+			if err := callback(other.String(), other, hostKey); err == nil {
+				t.Errorf("known_hosts line %q matches another host", line)
+			}
+		})
+	}
+}
+
+func TestHashKnownHost(t *testing.T) {
+	// The expected lines were written by ssh-keygen -H, whose salts are
+	// reused here.
+	for _, tt := range []struct {
+		host string
+		salt string
+		want string
+	}{
+		{"[192.0.2.10]:2222", "jWEh5NfKlZLqsSg03uJiLkTjyQA=", "|1|jWEh5NfKlZLqsSg03uJiLkTjyQA=|hI052z0u1lfW9B20CuASZ222RCk="},
+		{"example.com", "aggQpVB5BEaLw+FC12uQ2cuDSF0=", "|1|aggQpVB5BEaLw+FC12uQ2cuDSF0=|UijtdpkFKEybg9fWZCYa8fLVrrM="},
+	} {
+		salt, err := base64.StdEncoding.DecodeString(tt.salt)
+		if err != nil {
+			t.Fatalf("invalid salt %q: %v", tt.salt, err)
+		}
+		if got := hashKnownHost(tt.host, salt); got != tt.want {
+			t.Errorf("hashKnownHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHostKey(t *testing.T) {
+	_, priv, err := generateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	encrypted, err := gossh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to encrypt key: %v", err)
+	}
+	want, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	dir := t.TempDir()
+	plainPath, encryptedPath := filepath.Join(dir, "plain"), filepath.Join(dir, "encrypted")
+	if err := ioutil.WriteFile(plainPath, generatePrivateKeyPEM(priv), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	if err := ioutil.WriteFile(encryptedPath, pem.EncodeToMemory(encrypted), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		path       string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "plain", path: plainPath},
+		{name: "encrypted", path: encryptedPath, passphrase: "secret"},
+		{name: "encrypted without passphrase", path: encryptedPath, wantErr: "is encrypted: pass its passphrase using -host-key-passphrase"},
+		{name: "wrong passphrase", path: encryptedPath, passphrase: "wrong", wantErr: "failed to parse host key"},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: "failed to read host key"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, pubKey, err := loadHostKey(tt.path, tt.passphrase)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadHostKey = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadHostKey failed: %v", err)
+			}
+
+			fingerprint := gossh.FingerprintSHA256(want.PublicKey())
+			if gossh.FingerprintSHA256(signer.PublicKey()) != fingerprint || gossh.FingerprintSHA256(pubKey) != fingerprint {
+				t.Errorf("loadHostKey loaded %v, want %v", gossh.FingerprintSHA256(pubKey), fingerprint)
+			}
+		})
+	}
+}
+
+// TestOtsshdProcess isn't a real test: it is the entry point runOtsshd uses
+// to run the test binary as otsshd.
+func TestOtsshdProcess(t *testing.T) {
+	if os.Getenv("OTSSHD_TEST_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"otsshd"}, args...)
+	flag.CommandLine = flag.NewFlagSet("otsshd", flag.ExitOnError)
+	main()
+	os.Exit(0)
+}
+
+// runOtsshd runs otsshd with args until it exits, with authorized keys for
+// key and its session log in a temporary directory, and returns its output
+// and exit code.
+func runOtsshd(t *testing.T, key gossh.PublicKey, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	keysPath := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(keysPath, gossh.MarshalAuthorizedKey(key), 0600); err != nil {
+		t.Fatalf("failed to write authorized keys: %v", err)
+	}
+	args = append([]string{"-authorized-keys", keysPath, "-log", filepath.Join(dir, "otssh.log"), "-addr", "127.0.0.1:0"}, args...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestOtsshdProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "OTSSHD_TEST_PROCESS=1")
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("failed to run otsshd: %v", err)
+	}
+	return outBuf.String(), errBuf.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestNoStdoutInfo(t *testing.T) {
+	key := newTestKey(t).PublicKey()
+
+	stdout, _, code := runOtsshd(t, key, "-timeout", "1")
+	if code != 0 {
+		t.Fatalf("otsshd exited with %v: %v", code, stdout)
+	}
+	if !regexp.MustCompile(`(?m)^ssh-ed25519 AAAA\S+$`).MatchString(stdout) {
+		t.Errorf("stdout = %q, want the host key block", stdout)
+	}
+
+	// With -no-stdout-info, the address and fingerprint are logged instead.
+	stdout, _, code = runOtsshd(t, key, "-timeout", "1", "-no-stdout-info")
+	if code != 0 {
+		t.Fatalf("otsshd exited with %v: %v", code, stdout)
+	}
+	if regexp.MustCompile(`(?m)^ssh-ed25519 `).MatchString(stdout) {
+		t.Errorf("stdout = %q, want no host key block", stdout)
+	}
+	if !regexp.MustCompile(`listening on 127\.0\.0\.1:\d+ with host key SHA256:`).MatchString(stdout) {
+		t.Errorf("stdout = %q, want the address and fingerprint logged", stdout)
+	}
+}
+
+func TestTimeoutExitCode(t *testing.T) {
+	key := newTestKey(t).PublicKey()
+
+	for _, tt := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-timeout", "1"}, 0},
+		{[]string{"-timeout", "1", "-timeout-exit-code", "3"}, 3},
+		{[]string{"-timeout-exit-code", "256"}, 2},
+		{[]string{"-timeout-exit-code", "-1"}, 2},
+	} {
+		if stdout, _, code := runOtsshd(t, key, tt.args...); code != tt.want {
+			t.Errorf("otsshd %q exited with %v, want %v: %v", tt.args, code, tt.want, stdout)
+		}
+	}
+}
+
+func TestAnnounceAsync(t *testing.T) {
+	key := newTestKey(t).PublicKey()
+
+	for _, tt := range []struct {
+		name          string
+		async         bool
+		wantListening bool
+	}{
+		{"before listening", false, false},
+		{"async", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to find a free port: %v", err)
+			}
+			addr := l.Addr().String()
+			l.Close()
+
+			// The announcement checks whether the server is listening
+			// when it is made.
+			listening := make(chan bool, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := net.Dial("tcp", addr)
+				if err == nil {
+					conn.Close()
+				}
+				listening <- err == nil
+			}))
+			defer srv.Close()
+
+			args := []string{"-addr", addr, "-timeout", "1", "-announce-mode", "http", "-announce", srv.URL}
+			if tt.async {
+				args = append(args, "-announce-async")
+			}
+			if stdout, _, code := runOtsshd(t, key, args...); code != 0 {
+				t.Fatalf("otsshd exited with %v: %v", code, stdout)
+			}
+
+			select {
+			case got := <-listening:
+				if got != tt.wantListening {
+					t.Errorf("listening when the announcement was made = %v, want %v", got, tt.wantListening)
+				}
+			default:
+				t.Error("the host key wasn't announced")
+			}
+		})
+	}
+
+	if _, _, code := runOtsshd(t, key, "-announce-async"); code != 2 {
+		t.Errorf("otsshd -announce-async without -announce exited with %v, want 2", code)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// monitorQueueSize is the number of events buffered for each monitor
+	// client. A client which falls this far behind is disconnected.
+	monitorQueueSize = 256
+
+	monitorWriteTimeout = 10 * time.Second
+
+	// monitorCloseTimeout is how long Close waits for queued events to be
+	// sent.
+	monitorCloseTimeout = 5 * time.Second
+)
+
+// monitor streams session events as JSON, one per message, to the clients of
+// a websocket endpoint, for -monitor-addr. Clients must present the token,
+// either as a bearer token in the Authorization header, or for browsers,
+// which can't set headers on websockets, in the token query parameter.
+type monitor struct {
+	token    string
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	clients map[*monitorClient]bool
+	closed  bool
+
+	// backlog keeps the most recent output, from output events, to send to
+	// clients when they connect.
+	backlog *ringBuffer
+
+	// writers tracks the goroutines sending events to clients.
+	writers sync.WaitGroup
+}
+
+// monitorClient is a websocket connected to the monitor.
+type monitorClient struct {
+	conn  *websocket.Conn
+	queue chan []byte
+}
+
+// newMonitor starts serving session events on addr to clients which present
+// token. Clients are sent the last backlogSize bytes of output, as a backlog
+// event, when they connect.
+func newMonitor(addr, token string, backlogSize int) (*monitor, error) {
+	if token == "" {
+		return nil, errors.New("a token is required")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	m := &monitor{
+		token:    token,
+		listener: listener,
+		clients:  make(map[*monitorClient]bool),
+		backlog:  newRingBuffer(backlogSize),
+		upgrader: websocket.Upgrader{
+			// Clients are authenticated by the token rather than by
+			// where the page connecting to the monitor came from.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	m.server = &http.Server{Handler: m}
+	go m.server.Serve(listener)
+	return m, nil
+}
+
+// Addr returns the address the monitor is listening on.
+func (m *monitor) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// hasToken reports whether r presents token, as a bearer token in its
+// Authorization header or in the token query parameter.
+func hasToken(r *http.Request, token string) bool {
+	presented := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		presented = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+func (m *monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasToken(r, m.token) {
+		logWarn(fmt.Sprintf("rejected monitor connection from %v: invalid token", r.RemoteAddr))
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+
+	client := &monitorClient{conn: conn, queue: make(chan []byte, monitorQueueSize)}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if backlog := m.backlog.Bytes(); len(backlog) > 0 {
+		event := sessionEvent{Time: formatNow(), Type: "backlog", Data: string(backlog)}
+		if b, err := json.Marshal(event); err == nil {
+			client.queue <- b
+		}
+	}
+	m.clients[client] = true
+	m.writers.Add(1)
+	m.mu.Unlock()
+
+	logNotice(fmt.Sprintf("monitor connected from %v", r.RemoteAddr))
+
+	go func() {
+		defer m.writers.Done()
+		client.write()
+	}()
+
+	// Nothing is expected from the client, but reading is needed to handle
+	// control messages, and notices when the client goes away.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	m.remove(client)
+	logNotice(fmt.Sprintf("monitor disconnected from %v", r.RemoteAddr))
+}
+
+// write sends queued events to the client until the queue is closed.
+func (c *monitorClient) write() {
+	defer c.conn.Close()
+
+	for b := range c.queue {
+		c.conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			return
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+}
+
+// remove stops sending events to client, closing its connection once the
+// events already queued have been sent.
+func (m *monitor) remove(client *monitorClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients[client] {
+		delete(m.clients, client)
+		close(client.queue)
+	}
+}
+
+// publish sends event to every connected client. It is used as
+// opts.onEvent.
+func (m *monitor) publish(event sessionEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	if event.Type == "output" {
+		m.backlog.Write([]byte(event.Data))
+	}
+
+	var slow []*monitorClient
+	for client := range m.clients {
+		select {
+		case client.queue <- b:
+		default:
+			slow = append(slow, client)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, client := range slow {
+		logWarn(fmt.Sprintf("monitor %v is falling behind, disconnecting it", client.conn.RemoteAddr()))
+		m.remove(client)
+	}
+}
+
+// Close stops accepting clients, and disconnects those which are connected,
+// waiting a short time for their queued events to be sent.
+func (m *monitor) Close() {
+	m.mu.Lock()
+	m.closed = true
+	clients := m.clients
+	m.clients = make(map[*monitorClient]bool)
+	m.mu.Unlock()
+
+	m.server.Close()
+	for client := range clients {
+		close(client.queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.writers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(monitorCloseTimeout):
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialMonitor connects to the monitor at addr with the given query and
+// headers.
+func dialMonitor(addr net.Addr, query string, header http.Header) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr.String()+"/?"+query, header)
+	return conn, err
+}
+
+// readMonitorEvents reads the events sent to conn up to and including the
+// first of type last.
+func readMonitorEvents(t *testing.T, conn *websocket.Conn, last string) []sessionEvent {
+	t.Helper()
+
+	var events []sessionEvent
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read event after %+v: %v", events, err)
+		}
+		var event sessionEvent
+		if err := json.Unmarshal(b, &event); err != nil {
+			t.Fatalf("invalid event %q: %v", b, err)
+		}
+		events = append(events, event)
+		if event.Type == last {
+			return events
+		}
+	}
+}
+
+func TestMonitorToken(t *testing.T) {
+	if _, err := newMonitor("127.0.0.1:0", "", 0); err == nil {
+		t.Error("newMonitor succeeded without a token")
+	}
+
+	m, err := newMonitor("127.0.0.1:0", "secret", 0)
+	if err != nil {
+		t.Fatalf("newMonitor failed: %v", err)
+	}
+	defer m.Close()
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		auth   string
+	}{
+		{"none", "/", ""},
+		{"wrong query", "/?token=wrong", ""},
+		{"wrong bearer", "/", "Bearer wrong"},
+		{"not bearer", "/", "Basic secret"},
+		{"wrong bearer overrides query", "/?token=secret", "Bearer wrong"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %v, want %v", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+
+	// The token is accepted in the query, for browsers, or as a bearer
+	// token.
+	for _, dial := range []func() (*websocket.Conn, error){
+		func() (*websocket.Conn, error) { return dialMonitor(m.Addr(), "token=secret", nil) },
+		func() (*websocket.Conn, error) {
+			return dialMonitor(m.Addr(), "", http.Header{"Authorization": {"Bearer secret"}})
+		},
+	} {
+		conn, err := dial()
+		if err != nil {
+			t.Errorf("failed to connect with the token: %v", err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestMonitorSessionEvents(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		monitorOutput bool
+	}{
+		{"without output", false},
+		{"with output", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMonitor("127.0.0.1:0", "secret", 1024)
+			if err != nil {
+				t.Fatalf("newMonitor failed: %v", err)
+			}
+			defer m.Close()
+
+			conn, err := dialMonitor(m.Addr(), "token=secret", nil)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			key := newTestKey(t)
+			ts := startTestServer(t, options{
+				program:       []string{"echo", "top-secret-output"},
+				onEvent:       m.publish,
+				monitorOutput: tt.monitorOutput,
+			}, key.PublicKey())
+			ss := ts.startSession(t, key, true)
+			if err := ss.wait(t); err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+
+			events := readMonitorEvents(t, conn, "disconnect")
+			if first := events[0]; first.Type != "connect" || first.User != "test" || first.Width != 80 || first.Height != 24 {
+				t.Errorf("first event = %+v, want the connect event", first)
+			}
+
+			// The terminal contents are only sent with -monitor-output.
+			var output string
+			for _, event := range events {
+				output += event.Data
+				if event.Type == "output" && !tt.monitorOutput {
+					t.Errorf("output event %+v sent without -monitor-output", event)
+				}
+			}
+			if got := strings.Contains(output, "top-secret-output"); got != tt.monitorOutput {
+				t.Errorf("output sent = %v, want %v; events: %+v", got, tt.monitorOutput, events)
+			}
+		})
+	}
+}
+
+func TestMonitorShutdown(t *testing.T) {
+	// Find a free port for the monitor, as run doesn't say which it chose.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr()
+	l.Close()
+
+	opts := options{
+		addrs:        []string{"127.0.0.1:0"},
+		allowAnyKey:  true,
+		timeout:      time.Second,
+		logPaths:     []string{filepath.Join(t.TempDir(), "otssh.log")},
+		monitorAddr:  addr.String(),
+		monitorToken: "secret",
+		noStdoutInfo: true,
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := run(opts)
+		done <- err
+	}()
+
+	var conn *websocket.Conn
+	for deadline := time.Now().Add(5 * time.Second); conn == nil; {
+		if conn, err = dialMonitor(addr, "token=secret", nil); err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("failed to connect to the monitor: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer conn.Close()
+
+	// Nobody connects, so the server times out, and the monitor is shut
+	// down with it, telling its clients why.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run didn't return")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after shutdown = %v, want a going away close", err)
+	}
+	if conn, err := dialMonitor(addr, "token=secret", nil); err == nil {
+		conn.Close()
+		t.Error("connected to the monitor after the server shut down")
+	}
+}
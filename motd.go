@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// motdData is what a -motd template can refer to, such as
+// {{.RemoteAddress}}.
+type motdData struct {
+	RemoteAddress string
+	User          string
+	Fingerprint   string
+	KeyComment    string
+	Hostname      string
+	Time          string
+}
+
+// parseMOTD parses a -motd: the message of the day itself, or with an @
+// prefix, the path of a file containing it. It is a text/template, executed
+// with a motdData.
+func parseMOTD(value string) (*template.Template, error) {
+	text := value
+	if strings.HasPrefix(value, "@") {
+		b, err := ioutil.ReadFile(value[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		text = string(b)
+	}
+
+	tmpl, err := template.New("motd").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Referring to a field which doesn't exist is only an error when the
+	// template is executed, so catch it now rather than in every session.
+	if err := tmpl.Execute(ioutil.Discard, motdData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// writeMOTD writes the -motd, filled in for s, to the client of s through w,
+// and to log, as if it were the start of the shell's output. The PTY's line
+// endings are used, so that it renders as the shell's output would.
+func writeMOTD(w, log io.Writer, tmpl *template.Template, s ssh.Session) error {
+	hostname, _ := os.Hostname()
+
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, motdData{
+		RemoteAddress: s.RemoteAddr().String(),
+		User:          s.User(),
+		Fingerprint:   gossh.FingerprintSHA256(s.PublicKey()),
+		KeyComment:    keyComment(s),
+		Hostname:      hostname,
+		Time:          formatNow(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fill in -motd: %w", err)
+	}
+
+	motd := strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n")
+	if motd != "" && !strings.HasSuffix(motd, "\r\n") {
+		motd += "\r\n"
+	}
+
+	if _, err := io.WriteString(log, motd); err != nil {
+		return fmt.Errorf("failed to write to log: %w", err)
+	}
+	_, err = io.WriteString(w, motd)
+	return err
+}
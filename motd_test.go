@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMOTD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd")
+	if err := ioutil.WriteFile(path, []byte("from {{.Hostname}}\n"), 0600); err != nil {
+		t.Fatalf("failed to write motd: %v", err)
+	}
+
+	for _, tt := range []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{value: "hello {{.User}}", want: "hello alice"},
+		{value: "@" + path, want: "from host\n"},
+		{value: "@" + path + ".missing", wantErr: "failed to read file"},
+		{value: "hello {{.User", wantErr: "unclosed action"},
+		{value: "hello {{.Username}}", wantErr: "can't evaluate field Username"},
+	} {
+		tmpl, err := parseMOTD(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseMOTD(%q) = %v, want an error containing %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMOTD(%q) failed: %v", tt.value, err)
+			continue
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, motdData{User: "alice", Hostname: "host"}); err != nil {
+			t.Errorf("executing parseMOTD(%q) failed: %v", tt.value, err)
+		} else if b.String() != tt.want {
+			t.Errorf("parseMOTD(%q) = %q, want %q", tt.value, b.String(), tt.want)
+		}
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	motd, err := parseMOTD("Welcome, {{.User}}\nYour key is {{.KeyComment}}")
+	if err != nil {
+		t.Fatalf("failed to parse motd: %v", err)
+	}
+
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"echo", "program"}, motd: motd}, key.PublicKey())
+	ss := ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	// The message comes before the shell's output, with the PTY's line
+	// endings.
+	want := "Welcome, test\r\nYour key is key-a\r\nprogram\r\n"
+	if got := ss.stdout.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if got := ts.log.String(); !strings.Contains(got, "Welcome, test\r\nYour key is key-a\r\n") {
+		t.Errorf("session log = %q, want it to contain the message", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// multiplexSessionName is the name of the tmux or screen session which
+// -multiplex attaches sessions to.
+const multiplexSessionName = "otssh"
+
+// multiplexEnv clears the variables which tell tmux and screen that they are
+// running inside another of their sessions, which they are if -copy-env is
+// set and otsshd itself was started in one. Otherwise, the otssh session
+// would be created in the operator's multiplexer, next to their own sessions.
+var multiplexEnv = []string{"TMUX=", "STY="}
+
+// parseMultiplexer validates a -multiplex value.
+func parseMultiplexer(s string) (string, error) {
+	switch s {
+	case "", "tmux", "screen":
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported multiplexer %q: must be tmux or screen", s)
+}
+
+// multiplexCommand returns the command which attaches to the otssh session of
+// multiplexer, creating it if it doesn't exist yet. The shell runs inside the
+// multiplexer, so it keeps running if the session disconnects, and the work in
+// it can be picked up by the next session which attaches.
+func multiplexCommand(multiplexer string) *exec.Cmd {
+	if multiplexer == "screen" {
+		return exec.Command("screen", "-xRR", "-S", multiplexSessionName)
+	}
+	return exec.Command("tmux", "new-session", "-A", "-s", multiplexSessionName)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startupInfo is the information printed at startup by -output json.
+type startupInfo struct {
+	HostKey        string   `json:"host_key"`
+	Fingerprint    string   `json:"fingerprint"`
+	Address        string   `json:"address"`
+	Port           int      `json:"port"`
+	Addresses      []string `json:"addresses"`
+	KnownHostsLine string   `json:"known_hosts_line,omitempty"`
+	Command        string   `json:"command,omitempty"`
+	WebURL         string   `json:"web_url,omitempty"`
+}
+
+// writeStartupInfo writes a JSON object describing the server listening on
+// addrs with the host key key to w. host is interpreted as by
+// formatConnectionHint, and the host in the known_hosts line is hashed if
+// hashHost is set. webURL is the link to the web terminal, if it is served.
+func writeStartupInfo(w io.Writer, host string, addrs []net.Addr, key ssh.PublicKey, hashHost bool, webURL string) error {
+	// Clients are told to connect to the first address.
+	addr := addrs[0]
+
+	_, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return fmt.Errorf("failed to parse listening address: %w", err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("failed to parse listening port: %w", err)
+	}
+
+	info := startupInfo{
+		HostKey:     formatKnownHosts(key),
+		Fingerprint: gossh.FingerprintSHA256(key),
+		Address:     addr.String(),
+		Port:        port,
+		WebURL:      webURL,
+	}
+	for _, a := range addrs {
+		info.Addresses = append(info.Addresses, a.String())
+	}
+
+	knownHostsLine, command, err := connectionInfo(host, addr, key, hashHost)
+	if err != nil {
+		logWarn(fmt.Sprintf("failed to build connection command: %v", err))
+	} else {
+		info.KnownHostsLine, info.Command = knownHostsLine, command
+	}
+
+	return json.NewEncoder(w).Encode(info)
+}
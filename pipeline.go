@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// copyOutput copies the shell's output from its PTY to the session, writing
+// it to the log on the way, until the PTY is closed.
+func copyOutput(session, log io.Writer, pty io.Reader) error {
+	output := io.TeeReader(ptyReader{pty}, labeledWriter{w: fullWriter{log}, name: "log"})
+	cr := &crWriter{w: fullWriter{session}}
+	if _, err := io.Copy(labeledWriter{w: cr, name: "session"}, output); err != nil {
+		return err
+	}
+	if err := cr.flush(); err != nil {
+		return fmt.Errorf("failed to write to session: %w", err)
+	}
+	return nil
+}
+
+// crWriter holds back a carriage return at the end of a write until the next
+// one. Sessions with a PTY turn every "\n" written to them into "\r\n", unless
+// it already follows a "\r" in the same write, so a "\r\n" from the PTY split
+// across two reads would reach the client as "\r\r\n".
+type crWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crWriter) Write(b []byte) (int, error) {
+	out := b
+	if c.cr {
+		out = append([]byte{'\r'}, b...)
+	}
+	c.cr = len(out) > 0 && out[len(out)-1] == '\r'
+	if c.cr {
+		out = out[:len(out)-1]
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush writes the carriage return held back from the last write, if any.
+func (c *crWriter) flush() error {
+	if !c.cr {
+		return nil
+	}
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+	return err
+}
+
+// writeFull writes all of b to w. Writers should return an error when they
+// write less than they were given, but some just return the short count, so
+// the rest is written again until w accepts nothing more.
+func writeFull(w io.Writer, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// fullWriter writes all of every write to w, with writeFull.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(b []byte) (int, error) {
+	return writeFull(f.w, b)
+}
+
+// ptyReader reads the output of a shell from its PTY. Once the shell, and
+// anything else with the PTY open, has exited, reading from the PTY fails
+// with a *os.PathError, which ptyReader reports as io.EOF. Any output read
+// along with the error is still returned, and io.Copy and io.TeeReader write
+// it before stopping, so the last of the shell's output isn't lost.
+type ptyReader struct {
+	r io.Reader
+}
+
+func (p ptyReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return n, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to read from command: %w", err)
+	}
+	return n, err
+}
+
+// labeledWriter names the destination in the errors returned by w, so that
+// they can be told apart once they have passed through copyOutput.
+type labeledWriter struct {
+	w    io.Writer
+	name string
+}
+
+func (l labeledWriter) Write(b []byte) (int, error) {
+	n, err := l.w.Write(b)
+	if err != nil {
+		err = fmt.Errorf("failed to write to %v: %w", l.name, err)
+	}
+	return n, err
+}
+
+// bestEffortWriter writes to the log without letting its failures reach the
+// session: the client's experience shouldn't depend on the health of the log,
+// such as a pipe whose reader has gone away. The first error is logged as a
+// warning, and writes keep being attempted in case the log recovers.
+type bestEffortWriter struct {
+	w      io.Writer
+	warned sync.Once
+}
+
+func (b *bestEffortWriter) Write(p []byte) (int, error) {
+	if _, err := writeFull(b.w, p); err != nil {
+		b.warned.Do(func() {
+			logWarn(fmt.Sprintf("failed to write to the log, the session will continue but may not be logged: %v", err))
+		})
+	}
+	return len(p), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+
+	"github.com/creack/pty"
+)
+
+// shortWriter accepts at most max bytes of each write, returning the short
+// count without an error, as some writers do.
+type shortWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (s *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > s.max {
+		b = b[:s.max]
+	}
+	return s.buf.Write(b)
+}
+
+// closingPtyReader returns its chunks one read at a time, returning the last
+// along with the error reading a PTY fails with once the shell has exited.
+type closingPtyReader struct {
+	chunks []string
+}
+
+func (c *closingPtyReader) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, &os.PathError{Op: "read", Path: "/dev/ptmx", Err: syscall.EIO}
+	}
+
+	n := copy(b, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	if len(c.chunks) == 0 {
+		return n, &os.PathError{Op: "read", Path: "/dev/ptmx", Err: syscall.EIO}
+	}
+	return n, nil
+}
+
+func TestCopyOutput(t *testing.T) {
+	chunks := []string{"first line\r\n", "second ", "line\r\n", "last output before exit"}
+	want := strings.Join(chunks, "")
+
+	session, log := &shortWriter{max: 3}, &shortWriter{max: 1}
+	if err := copyOutput(session, log, &closingPtyReader{chunks: chunks}); err != nil {
+		t.Fatalf("copyOutput failed: %v", err)
+	}
+
+	if got := session.buf.String(); got != want {
+		t.Errorf("session got %q, want %q", got, want)
+	}
+	if got := log.buf.String(); got != want {
+		t.Errorf("log got %q, want %q", got, want)
+	}
+}
+
+func TestCopyOutputSplitCRLF(t *testing.T) {
+	chunks := []string{"one\r", "\ntwo\r", "\r", "\nprogress\r"}
+	want := strings.Join(chunks, "")
+
+	session := &recordingWriter{}
+	if err := copyOutput(session, ioutil.Discard, &closingPtyReader{chunks: chunks}); err != nil {
+		t.Fatalf("copyOutput failed: %v", err)
+	}
+
+	if got := strings.Join(session.writes, ""); got != want {
+		t.Errorf("session got %q, want %q", got, want)
+	}
+	// A "\n" at the start of a write must not follow a "\r" at the end of
+	// the last, or a session with a PTY would add another "\r" before it.
+	for i := 1; i < len(session.writes); i++ {
+		if strings.HasSuffix(session.writes[i-1], "\r") && strings.HasPrefix(session.writes[i], "\n") {
+			t.Errorf("\"\\r\\n\" split between writes %q and %q", session.writes[i-1], session.writes[i])
+		}
+	}
+}
+
+// recordingWriter records each write made to it.
+type recordingWriter struct {
+	writes []string
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	r.writes = append(r.writes, string(b))
+	return len(b), nil
+}
+
+func TestCopyOutputErrors(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	for _, tt := range []struct {
+		name    string
+		session io.Writer
+		log     io.Writer
+		want    string
+	}{
+		{"session", errWriter{errBroken}, &bytes.Buffer{}, "failed to write to session: broken"},
+		{"log", &bytes.Buffer{}, errWriter{errBroken}, "failed to write to log: broken"},
+		{"nothing accepted", &shortWriter{max: 0}, &bytes.Buffer{}, "failed to write to session: short write"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := copyOutput(tt.session, tt.log, &closingPtyReader{chunks: []string{"output"}})
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("copyOutput = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// errWriter fails every write with err.
+type errWriter struct {
+	err error
+}
+
+func (e errWriter) Write(b []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestOutputBeforeExit(t *testing.T) {
+	// The shell exits as soon as it has written its output, racing the
+	// output being read from the PTY.
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "seq 1 5000; printf end"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	ts.wait(t)
+
+	var want strings.Builder
+	for i := 1; i <= 5000; i++ {
+		want.WriteString(strconv.Itoa(i) + "\r\n")
+	}
+	want.WriteString("end")
+
+	if got := ss.stdout.String(); got != want.String() {
+		t.Errorf("client got %v bytes of output, want %v", len(got), want.Len())
+	}
+	if got := ts.log.String(); !strings.HasSuffix(got, "\n"+want.String()) {
+		t.Errorf("log doesn't end with the whole output: %q", got[max(0, len(got)-64):])
+	}
+}
+
+func TestPtyReader(t *testing.T) {
+	// Once the command has exited, reading its PTY ends its output rather
+	// than failing.
+	f, err := pty.Start(exec.Command("printf", "output"))
+	if err != nil {
+		t.Fatalf("failed to start command: %v", err)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(ptyReader{f})
+	if string(b) != "output" || err != nil {
+		t.Errorf("ReadAll = %q, %v, want %q", b, err, "output")
+	}
+
+	// Other errors are still reported.
+	_, err = ioutil.ReadAll(ptyReader{iotest.ErrReader(errors.New("broken"))})
+	if err == nil || err.Error() != "failed to read from command: broken" {
+		t.Errorf("ReadAll = %v, want the error", err)
+	}
+}
+
+func TestLogFailureKeepsSession(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "echo first; sleep 0.1; echo second"}}, key.PublicKey())
+	ts.logWriter = &bestEffortWriter{w: errWriter{errors.New("disk full")}}
+
+	ss := ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got, want := ss.stdout.String(), "first\r\nsecond\r\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestWriteFull(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	for _, tt := range []struct {
+		name    string
+		w       io.Writer
+		want    int
+		wantErr error
+	}{
+		{"whole write", &shortWriter{max: 100}, 10, nil},
+		{"short writes", &shortWriter{max: 3}, 10, nil},
+		{"one byte at a time", &shortWriter{max: 1}, 10, nil},
+		{"nothing accepted", &shortWriter{max: 0}, 0, io.ErrShortWrite},
+		{"error", errWriter{errBroken}, 0, errBroken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := writeFull(tt.w, []byte("0123456789"))
+			if n != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("writeFull = %v, %v, want %v, %v", n, err, tt.want, tt.wantErr)
+			}
+			if sw, ok := tt.w.(*shortWriter); ok && sw.buf.String() != "0123456789"[:tt.want] {
+				t.Errorf("wrote %q", sw.buf.String())
+			}
+		})
+	}
+}
+
+func TestBestEffortWriterShortWrites(t *testing.T) {
+	// The log is written in full, even by a writer which takes a little at
+	// a time.
+	log := &shortWriter{max: 2}
+	w := &bestEffortWriter{w: log}
+	if n, err := io.WriteString(w, "session output"); n != 14 || err != nil {
+		t.Errorf("Write = %v, %v", n, err)
+	}
+	if got := log.buf.String(); got != "session output" {
+		t.Errorf("log got %q, want %q", got, "session output")
+	}
+}
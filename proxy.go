@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// proxyDialTimeout is how long connecting to the -proxy-to host may take.
+const proxyDialTimeout = 15 * time.Second
+
+// proxyBackend is the host sessions are proxied to with -proxy-to, making
+// otsshd a one-time jump host: clients authenticate to otsshd with their
+// authorized keys, and otsshd authenticates to the backend with its own
+// -proxy-identity or the keys in its SSH agent.
+type proxyBackend struct {
+	user string
+	addr string
+
+	signer         gossh.Signer
+	hostKeyChecker gossh.HostKeyCallback
+}
+
+// newProxyBackend returns the backend for target, in the form
+// [user@]host[:port]. It is authenticated to with the private key at
+// identityPath, if set, and the keys in the agent at $SSH_AUTH_SOCK, and its
+// host key must be in the known_hosts file at knownHostsPath.
+func newProxyBackend(target, identityPath, knownHostsPath string) (*proxyBackend, error) {
+	username, addr, err := parseProxyTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the default known_hosts file: %w", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyChecker, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts file: %w", err)
+	}
+
+	b := &proxyBackend{user: username, addr: addr, hostKeyChecker: hostKeyChecker}
+	if identityPath != "" {
+		if b.signer, err = loadProxyIdentity(identityPath); err != nil {
+			return nil, err
+		}
+	} else if os.Getenv("SSH_AUTH_SOCK") == "" {
+		return nil, errors.New("either -proxy-identity or an SSH agent, with SSH_AUTH_SOCK set, is needed to authenticate to the backend")
+	}
+	return b, nil
+}
+
+// loadProxyIdentity loads the private key used to authenticate to the backend.
+// Encrypted keys aren't supported, as there is no terminal to ask for their
+// passphrase on once the server is running, so should be added to an agent.
+func loadProxyIdentity(path string) (gossh.Signer, error) {
+	privPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -proxy-identity: %w", err)
+	}
+
+	signer, err := gossh.ParsePrivateKey(privPEM)
+	var missingErr *gossh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("-proxy-identity %v is encrypted: add it to an SSH agent instead", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse -proxy-identity %v: %w", path, err)
+	}
+	return signer, nil
+}
+
+// parseProxyTarget splits a -proxy-to target into the user, defaulting to the
+// current user, and the address, defaulting to port 22.
+func parseProxyTarget(target string) (username, addr string, err error) {
+	host := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		username, host = target[:i], target[i+1:]
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to find the current user: %w", err)
+		}
+		username = u.Username
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	if h, _, _ := net.SplitHostPort(host); h == "" {
+		return "", "", fmt.Errorf("%q has no host", target)
+	}
+	return username, host, nil
+}
+
+func (b *proxyBackend) String() string {
+	return b.user + "@" + b.addr
+}
+
+// dial connects and authenticates to the backend.
+func (b *proxyBackend) dial() (*gossh.Client, error) {
+	var auth []gossh.AuthMethod
+	if b.signer != nil {
+		auth = append(auth, gossh.PublicKeys(b.signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			logWarn(fmt.Sprintf("failed to connect to the SSH agent, not using it for -proxy-to: %v", err))
+		} else {
+			defer conn.Close()
+			auth = append(auth, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	return gossh.Dial("tcp", b.addr, &gossh.ClientConfig{
+		User:            b.user,
+		Auth:            auth,
+		HostKeyCallback: b.hostKeyChecker,
+		Timeout:         proxyDialTimeout,
+	})
+}
+
+// handleProxySession bridges s to a session on the -proxy-to backend,
+// passing through its PTY, window size changes, signals, and command, and
+// logging the backend's output. The client is sent the backend session's exit
+// status, and a non-zero status is returned as a *gossh.ExitError.
+func handleProxySession(logs sessionLogs, opts options, s ssh.Session) error {
+	logWriter, inputLog := logs.output, logs.input
+	ptyReq, winCh, isPty := s.Pty()
+	if !isPty && opts.requirePty {
+		rejectNoPty(s, true)
+		return nil
+	}
+
+	client, err := opts.proxy.dial()
+	if err != nil {
+		io.WriteString(s.Stderr(), "Failed to start the session: the server could not connect to the backend host.\n")
+		s.Exit(1)
+		return fmt.Errorf("failed to connect to -proxy-to %v: %w", opts.proxy, err)
+	}
+	defer client.Close()
+
+	// Closing the client ends the backend session if the client goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.Context().Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	backend, err := client.NewSession()
+	if err != nil {
+		io.WriteString(s.Stderr(), "Failed to start the session on the backend host.\n")
+		s.Exit(1)
+		return fmt.Errorf("failed to start a session on %v: %w", opts.proxy, err)
+	}
+	defer backend.Close()
+
+	for _, kv := range s.Environ() {
+		// Servers commonly only accept a few variables, so failures are
+		// ignored, as OpenSSH does.
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			backend.Setenv(parts[0], parts[1])
+		}
+	}
+
+	if err := writeSessionHeader(logWriter, s, ptyReq); err != nil {
+		return fmt.Errorf("failed to write to log: %w", err)
+	}
+
+	if isPty {
+		if err := backend.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, gossh.TerminalModes{}); err != nil {
+			io.WriteString(s.Stderr(), "Failed to start the session: the backend host refused a PTY.\n")
+			s.Exit(1)
+			return fmt.Errorf("failed to request a PTY on %v: %w", opts.proxy, err)
+		}
+
+		winCh = watchResizes(opts, s, winCh)
+		if logs.resizes != nil {
+			logWriter = logs.resizes.countOutput(logWriter)
+			winCh = logResizes(logs.resizes, winCh)
+		}
+		go func() {
+			// The first size sent is usually that of the PTY request,
+			// which the backend already has.
+			last := ptyReq.Window
+			for win := range winCh {
+				if win != last {
+					last = win
+					backend.WindowChange(win.Height, win.Width)
+				}
+			}
+		}()
+	}
+
+	signals := make(chan ssh.Signal, 1)
+	s.Signals(signals)
+	defer s.Signals(nil)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				backend.Signal(gossh.Signal(sig))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stdin, err := backend.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to connect to backend session: %w", err)
+	}
+	stdout, err := backend.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to connect to backend session: %w", err)
+	}
+	backend.Stderr = s.Stderr()
+
+	if opts.readOnly {
+		// The backend's stdin is left open, as closing it would end the
+		// shell.
+		newline := "\n"
+		if isPty {
+			newline = "\r\n"
+		}
+		io.WriteString(s.Stderr(), readOnlyNotice+newline)
+		go discardInput(s, inputLog)
+	} else {
+		go func() {
+			io.Copy(stdin, teeInput(s, inputLog))
+			stdin.Close()
+		}()
+	}
+
+	command := s.RawCommand()
+	if forced := sessionKeyOptions(s).command; forced != "" {
+		command = forced
+	}
+
+	switch {
+	case command == "" && s.Subsystem() != "":
+		logNotice(fmt.Sprintf("proxying session to %v, requesting subsystem %q", opts.proxy, s.Subsystem()))
+		err = backend.RequestSubsystem(s.Subsystem())
+	case command != "":
+		logNotice(fmt.Sprintf("proxying session to %v, running %q", opts.proxy, command))
+		err = backend.Start(command)
+	default:
+		logNotice(fmt.Sprintf("proxying session to %v", opts.proxy))
+		err = backend.Shell()
+	}
+	if err != nil {
+		io.WriteString(s.Stderr(), "Failed to start the session on the backend host.\n")
+		s.Exit(1)
+		return fmt.Errorf("failed to start shell on %v: %w", opts.proxy, err)
+	}
+
+	output := withEventOutput(opts, s, logWriter)
+	if opts.motd != nil && isPty && command == "" && s.Subsystem() == "" {
+		if err := writeMOTD(s, output, opts.motd, s); err != nil {
+			logWarn(fmt.Sprintf("failed to write -motd: %v", err))
+		}
+	}
+
+	if err := copyOutput(s, output, stdout); err != nil {
+		return err
+	}
+
+	err = backend.Wait()
+	logNotice(fmt.Sprintf("backend session on %v exited (%v)", opts.proxy, describeProxyExit(err)))
+	sendProxyExit(s, err)
+	return err
+}
+
+// describeProxyExit describes how a backend session ended with err, as
+// returned by Wait.
+func describeProxyExit(err error) string {
+	var exitErr *gossh.ExitError
+	switch {
+	case err == nil:
+		return "exit status 0"
+	case errors.As(err, &exitErr) && exitErr.Signal() != "":
+		return "signal: " + exitErr.Signal()
+	case errors.As(err, &exitErr):
+		return fmt.Sprintf("exit status %v", exitErr.ExitStatus())
+	default:
+		return err.Error()
+	}
+}
+
+// sendProxyExit tells the client how the backend session ended, as sendExit
+// does for a local shell, then closes the session.
+func sendProxyExit(s ssh.Session, err error) error {
+	var exitErr *gossh.ExitError
+	switch {
+	case err == nil:
+		return s.Exit(0)
+	case errors.As(err, &exitErr) && exitErr.Signal() != "":
+		msg := struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Language   string
+		}{Signal: exitErr.Signal(), Error: exitErr.Msg(), Language: exitErr.Lang()}
+
+		if _, err := s.SendRequest("exit-signal", false, gossh.Marshal(&msg)); err != nil {
+			return err
+		}
+		return s.Close()
+	case errors.As(err, &exitErr):
+		return s.Exit(exitErr.ExitStatus())
+	default:
+		return s.Exit(1)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseProxyTarget(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to find the current user: %v", err)
+	}
+
+	for _, tt := range []struct {
+		target   string
+		wantUser string
+		wantAddr string
+		wantErr  bool
+	}{
+		{target: "alice@example.com:2222", wantUser: "alice", wantAddr: "example.com:2222"},
+		{target: "alice@example.com", wantUser: "alice", wantAddr: "example.com:22"},
+		{target: "example.com:2222", wantUser: u.Username, wantAddr: "example.com:2222"},
+		{target: "example.com", wantUser: u.Username, wantAddr: "example.com:22"},
+		{target: "@example.com", wantUser: u.Username, wantAddr: "example.com:22"},
+		{target: "alice@[2001:db8::1]:2222", wantUser: "alice", wantAddr: "[2001:db8::1]:2222"},
+		{target: "alice@[2001:db8::1]", wantUser: "alice", wantAddr: "[2001:db8::1]:22"},
+		{target: "alice@2001:db8::1", wantUser: "alice", wantAddr: "[2001:db8::1]:22"},
+		{target: "alice@host@example.com", wantUser: "alice@host", wantAddr: "example.com:22"},
+		{target: "", wantErr: true},
+		{target: "alice@", wantErr: true},
+		{target: "alice@:2222", wantErr: true},
+		{target: "[]:2222", wantErr: true},
+	} {
+		t.Run(tt.target, func(t *testing.T) {
+			gotUser, gotAddr, err := parseProxyTarget(tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseProxyTarget(%q) = %q, %q, want an error", tt.target, gotUser, gotAddr)
+				}
+				return
+			}
+			if err != nil || gotUser != tt.wantUser || gotAddr != tt.wantAddr {
+				t.Errorf("parseProxyTarget(%q) = %q, %q, %v, want %q, %q", tt.target, gotUser, gotAddr, err, tt.wantUser, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestLoadProxyIdentity(t *testing.T) {
+	_, priv, err := generateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	encrypted, err := gossh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to encrypt key: %v", err)
+	}
+	want, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	dir := t.TempDir()
+	plainPath, encryptedPath, garbagePath := filepath.Join(dir, "plain"), filepath.Join(dir, "encrypted"), filepath.Join(dir, "garbage")
+	for path, b := range map[string][]byte{
+		plainPath:     generatePrivateKeyPEM(priv),
+		encryptedPath: pem.EncodeToMemory(encrypted),
+		garbagePath:   []byte("not a key\n"),
+	} {
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatalf("failed to write key: %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "plain", path: plainPath},
+		{name: "encrypted", path: encryptedPath, wantErr: "is encrypted: add it to an SSH agent instead"},
+		{name: "garbage", path: garbagePath, wantErr: "failed to parse -proxy-identity"},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: "failed to read -proxy-identity"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := loadProxyIdentity(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadProxyIdentity = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadProxyIdentity failed: %v", err)
+			}
+			if !ssh.KeysEqual(signer.PublicKey(), want.PublicKey()) {
+				t.Error("loadProxyIdentity returned a different key")
+			}
+		})
+	}
+}
+
+// startTestBackend starts an SSH server for -proxy-to to connect to, which
+// accepts key and runs handler for each session. It returns the backend,
+// configured to authenticate with key and to trust only the server's host
+// key.
+func startTestBackend(t *testing.T, key gossh.Signer, handler ssh.Handler) *proxyBackend {
+	t.Helper()
+
+	// Only the backend's own key is offered to it, not the agent's.
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	hostKey, hostPubKey, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := &ssh.Server{
+		Handler: handler,
+		PublicKeyHandler: func(ctx ssh.Context, k ssh.PublicKey) bool {
+			return ssh.KeysEqual(k, key.PublicKey())
+		},
+	}
+	server.AddHostKey(hostKey)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return &proxyBackend{
+		user:           "backend",
+		addr:           listener.Addr().String(),
+		signer:         key,
+		hostKeyChecker: gossh.FixedHostKey(hostPubKey),
+	}
+}
+
+func TestProxyWindowChange(t *testing.T) {
+	backend := startTestBackend(t, newTestKey(t), func(s ssh.Session) {
+		ptyReq, winCh, isPty := s.Pty()
+		if !isPty {
+			io.WriteString(s, "no pty\n")
+			s.Exit(1)
+			return
+		}
+		fmt.Fprintf(s, "pty %v %vx%v\n", ptyReq.Term, ptyReq.Window.Width, ptyReq.Window.Height)
+		go func() {
+			for win := range winCh {
+				fmt.Fprintf(s, "window %vx%v\n", win.Width, win.Height)
+			}
+		}()
+
+		// The session ends once the client types something.
+		s.Read(make([]byte, 1))
+		s.Exit(0)
+	})
+
+	key := newTestKey(t)
+	ts := startTestServer(t, options{proxy: backend}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	ss.waitForOutput(t, "pty xterm 80x24")
+	if err := ss.WindowChange(40, 120); err != nil {
+		t.Fatalf("failed to change window size: %v", err)
+	}
+	ss.waitForOutput(t, "window 120x40")
+
+	ss.stdin.Write([]byte("\r"))
+	if err := ss.wait(t); err != nil {
+		t.Errorf("session failed: %v", err)
+	}
+	if log := ts.log.String(); !strings.Contains(log, "window 120x40") {
+		t.Errorf("log = %q, want the backend's output", log)
+	}
+}
+
+func TestProxyExit(t *testing.T) {
+	backend := startTestBackend(t, newTestKey(t), func(s ssh.Session) {
+		switch s.RawCommand() {
+		case "exit 3":
+			s.Exit(3)
+		case "kill":
+			msg := struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Language   string
+			}{Signal: "TERM", Error: "terminated"}
+			s.SendRequest("exit-signal", false, gossh.Marshal(&msg))
+			s.Close()
+		default:
+			s.Exit(0)
+		}
+	})
+
+	run := func(command string) error {
+		t.Helper()
+
+		key := newTestKey(t)
+		ts := startTestServer(t, options{proxy: backend}, key.PublicKey())
+		client, err := ts.dial(key)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer client.Close()
+
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("failed to open session: %v", err)
+		}
+		return session.Run(command)
+	}
+
+	// The client is sent the backend session's exit status.
+	if err := run("true"); err != nil {
+		t.Errorf("successful command failed: %v", err)
+	}
+	if got := exitStatus(t, run("exit 3")); got != 3 {
+		t.Errorf("exit status = %v, want 3", got)
+	}
+
+	// A backend session killed by a signal is reported as such, rather than
+	// as a plain exit status.
+	var exitErr *gossh.ExitError
+	if err := run("kill"); !errors.As(err, &exitErr) || exitErr.Signal() != "TERM" || exitErr.Msg() != "terminated" {
+		t.Errorf("killed command = %v, want exit signal TERM", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// printAuthorizedKey writes the authorized_keys line for the private key at
+// path to w, as `ssh-keygen -y` does, for building an -authorized-keys file.
+// If the key is encrypted and its public key isn't stored alongside it, the
+// passphrase is asked for on the terminal.
+func printAuthorizedKey(w io.Writer, path string) error {
+	privPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	var pubKey gossh.PublicKey
+	signer, err := gossh.ParsePrivateKey(privPEM)
+
+	var missingErr *gossh.PassphraseMissingError
+	switch {
+	case errors.As(err, &missingErr) && missingErr.PublicKey != nil:
+		// OpenSSH private keys store the public key unencrypted.
+		pubKey = missingErr.PublicKey
+	case errors.As(err, &missingErr):
+		passphrase, err := readPassphrase(fmt.Sprintf("Enter passphrase for %v: ", path))
+		if err != nil {
+			return fmt.Errorf("private key %v is encrypted, and its passphrase couldn't be read: %w", path, err)
+		}
+
+		signer, err = gossh.ParsePrivateKeyWithPassphrase(privPEM, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to parse private key %v: %w", path, err)
+		}
+		pubKey = signer.PublicKey()
+	case err != nil:
+		return fmt.Errorf("failed to parse private key %v: %w", path, err)
+	default:
+		pubKey = signer.PublicKey()
+	}
+
+	_, err = fmt.Fprintln(w, formatKnownHosts(pubKey))
+	return err
+}
+
+// readPassphrase asks for a passphrase on the terminal, without echoing it.
+func readPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	defer fmt.Fprintln(tty)
+	return term.ReadPassword(int(tty.Fd()))
+}
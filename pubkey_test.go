@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestPrintAuthorizedKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pubKey, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to convert public key: %v", err)
+	}
+	encrypted, err := gossh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to encrypt key: %v", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	ecdsaKeys := make(map[elliptic.Curve]*ecdsa.PrivateKey)
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if ecdsaKeys[curve], err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			t.Fatalf("failed to generate %v key: %v", curve.Params().Name, err)
+		}
+	}
+
+	// Keys are written in the OpenSSH format ssh-keygen uses by default,
+	// and in the PEM formats it uses with -m PEM.
+	openSSHPEM := func(key crypto.PrivateKey) []byte {
+		block, err := gossh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		return pem.EncodeToMemory(block)
+	}
+	publicKey := func(key crypto.PublicKey) gossh.PublicKey {
+		sshKey, err := gossh.NewPublicKey(key)
+		if err != nil {
+			t.Fatalf("failed to convert public key: %v", err)
+		}
+		return sshKey
+	}
+	ecPEM := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	p256, p384, p521 := ecdsaKeys[elliptic.P256()], ecdsaKeys[elliptic.P384()], ecdsaKeys[elliptic.P521()]
+
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		pem     []byte
+		want    gossh.PublicKey
+		wantErr string
+	}{
+		{name: "plain", pem: generatePrivateKeyPEM(priv), want: pubKey},
+		// The public key of an encrypted OpenSSH key is read without
+		// asking for the passphrase.
+		{name: "encrypted", pem: pem.EncodeToMemory(encrypted), want: pubKey},
+		{name: "rsa", pem: openSSHPEM(rsaKey), want: publicKey(&rsaKey.PublicKey)},
+		{name: "rsa pem", pem: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), want: publicKey(&rsaKey.PublicKey)},
+		{name: "ecdsa p256", pem: openSSHPEM(p256), want: publicKey(&p256.PublicKey)},
+		{name: "ecdsa p384", pem: openSSHPEM(p384), want: publicKey(&p384.PublicKey)},
+		{name: "ecdsa p521", pem: openSSHPEM(p521), want: publicKey(&p521.PublicKey)},
+		{name: "ecdsa p256 pem", pem: ecPEM(p256), want: publicKey(&p256.PublicKey)},
+		{name: "ecdsa p384 pem", pem: ecPEM(p384), want: publicKey(&p384.PublicKey)},
+		{name: "ecdsa p521 pem", pem: ecPEM(p521), want: publicKey(&p521.PublicKey)},
+		{name: "not a key", pem: []byte("hello\n"), wantErr: "failed to parse private key"},
+		{name: "missing", wantErr: "failed to read private key"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if tt.pem != nil {
+				if err := ioutil.WriteFile(path, tt.pem, 0600); err != nil {
+					t.Fatalf("failed to write key: %v", err)
+				}
+			}
+
+			var buf bytes.Buffer
+			err := printAuthorizedKey(&buf, path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("printAuthorizedKey = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("printAuthorizedKey failed: %v", err)
+			}
+
+			// The line is accepted as an authorized key by the server.
+			keys, err := parseAuthorizedKeys(strings.NewReader(buf.String()))
+			if err != nil {
+				t.Fatalf("failed to parse %q: %v", buf.String(), err)
+			}
+			if len(keys) != 1 || gossh.FingerprintSHA256(keys[0].key) != gossh.FingerprintSHA256(tt.want) {
+				t.Errorf("printAuthorizedKey wrote %q, want the key's public key", buf.String())
+			}
+			if !strings.HasPrefix(buf.String(), tt.want.Type()+" ") {
+				t.Errorf("printAuthorizedKey wrote %q, want a %v key", buf.String(), tt.want.Type())
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// connectionURL returns the ssh:// URL of the server listening on addr, as
+// understood by mobile SSH clients. host is interpreted as by
+// formatConnectionHint.
+func connectionURL(host string, addr net.Addr) (string, error) {
+	host, port, err := connectionHost(host, addr)
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{Scheme: "ssh", Host: net.JoinHostPort(host, port)}
+	if current, err := user.Current(); err == nil {
+		u.User = url.User(current.Username)
+	}
+	return u.String(), nil
+}
+
+// printConnectionQR prints a QR code of the URL to connect to the server
+// listening on addr to out, followed by the URL itself. Nothing is printed if
+// out isn't a terminal, as the QR code is only useful on screen.
+func printConnectionQR(out *os.File, host string, addr net.Addr) error {
+	info, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("output is not a terminal")
+	}
+
+	connURL, err := connectionURL(host, addr)
+	if err != nil {
+		return err
+	}
+
+	code, err := qrcode.New(connURL, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("failed to encode QR code: %w", err)
+	}
+
+	logSuccess("To connect from a mobile SSH client, scan:")
+	fmt.Fprintf(out, "\n%v\n%v\n\n", code.ToSmallString(false), connURL)
+	return nil
+}
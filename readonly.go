@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// readOnlyNotice is shown to the clients of -read-only sessions. They can't
+// exit the shell, so are told how to disconnect with OpenSSH's escape
+// sequence.
+const readOnlyNotice = "This session is read-only: what you type is ignored. To disconnect, press Enter, then ~ and ."
+
+// discardInput reads the input sent by the client of s, a -read-only
+// session, and drops it, so that the client isn't left blocked sending it.
+// It is still written to input, if that isn't nil, so that attempts to type
+// are logged by -log-input.
+func discardInput(s ssh.Session, input io.Writer) {
+	io.Copy(ioutil.Discard, teeInput(s, input))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "timeout 1 cat; echo done"}, readOnly: true}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if _, err := ss.stdin.Write([]byte("typed\r")); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	// Input reaching the PTY would be echoed, and copied by cat.
+	if got := ss.stdout.String(); strings.Contains(got, "typed") || !strings.Contains(got, "done") {
+		t.Errorf("output = %q, want only the shell's output", got)
+	}
+	if got := ss.stderr.String(); !strings.Contains(got, readOnlyNotice) {
+		t.Errorf("stderr = %q, want the read-only notice", got)
+	}
+}
+
+func TestReadOnlyDisconnect(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sleep", "300"}, readOnly: true}, key.PublicKey())
+
+	// The client of a read-only session can't exit the shell, so the
+	// session ends when it disconnects.
+	ss := ts.startSession(t, key, true)
+	ss.client.Close()
+	ts.wait(t)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// waitingRoomInterval is how often clients held by a readinessCheck are told
+// that they are still waiting.
+const waitingRoomInterval = 10 * time.Second
+
+// readinessCheck holds sessions until the server is ready for them, as
+// decided by -ready-command, such as when a service the session needs is
+// still starting. Clients which connect before then are shown a waiting room
+// message rather than being refused.
+type readinessCheck struct {
+	command  string
+	interval time.Duration
+	ready    chan struct{}
+}
+
+func newReadinessCheck(command string, interval time.Duration) *readinessCheck {
+	return &readinessCheck{
+		command:  command,
+		interval: interval,
+		ready:    make(chan struct{}),
+	}
+}
+
+// run runs the command every interval until it succeeds, at which point the
+// server is ready, or ctx is done.
+func (r *readinessCheck) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", r.command)
+		err := cmd.Run()
+		if err == nil {
+			logNotice("-ready-command succeeded, sessions may start")
+			close(r.ready)
+			return
+		}
+		logDebug(fmt.Sprintf("-ready-command failed, retrying in %v: %v", r.interval, err))
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wait holds s until the server is ready, telling the client why it is
+// waiting. It reports whether the server became ready before s ended.
+func (r *readinessCheck) wait(s ssh.Session) bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+	}
+
+	newline := "\n"
+	if _, _, isPty := s.Pty(); isPty {
+		newline = "\r\n"
+	}
+
+	logNotice("holding session " + describeSession(s) + " until the server is ready")
+	io.WriteString(s.Stderr(), "This server isn't ready yet. Please wait, the session will start once it is..."+newline)
+
+	ticker := time.NewTicker(waitingRoomInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ready:
+			io.WriteString(s.Stderr(), "The server is ready, starting the session."+newline)
+			return true
+		case <-ticker.C:
+			io.WriteString(s.Stderr(), "Still waiting for the server to be ready..."+newline)
+		case <-s.Context().Done():
+			logNotice("session " + describeSession(s) + " disconnected while waiting for the server to be ready")
+			return false
+		}
+	}
+}
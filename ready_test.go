@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyCommand(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	key := newTestKey(t)
+	ts := startTestServer(t, options{
+		program:       []string{"echo", "program"},
+		readyCommand:  "test -f " + ready,
+		readyInterval: 20 * time.Millisecond,
+	}, key.PublicKey())
+
+	// A client which disconnects from the waiting room doesn't use up the
+	// server.
+	early := ts.startSession(t, key, true)
+	waitForStderr(t, early, "This server isn't ready yet.")
+	early.client.Close()
+
+	ss := ts.startSession(t, key, true)
+	waitForStderr(t, ss, "This server isn't ready yet.")
+	time.Sleep(100 * time.Millisecond)
+	if got := ss.stdout.String(); got != "" {
+		t.Fatalf("output = %q before the server was ready", got)
+	}
+
+	if err := ioutil.WriteFile(ready, nil, 0600); err != nil {
+		t.Fatalf("failed to make the server ready: %v", err)
+	}
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := ss.stdout.String(); got != "program\r\n" {
+		t.Errorf("output = %q, want the program's", got)
+	}
+	if got := ss.stderr.String(); !strings.Contains(got, "The server is ready, starting the session.\r\n") {
+		t.Errorf("stderr = %q, want to be told the session is starting", got)
+	}
+}
+
+// waitForStderr waits until the session's error output contains s.
+func waitForStderr(t *testing.T, ss *testSession, s string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(ss.stderr.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stderr %q never contained %q", ss.stderr.String(), s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
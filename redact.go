@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// redactedText replaces the text matched by -log-redact patterns.
+const redactedText = "***"
+
+// maxRedactPending is the most output redactingWriter holds back waiting for
+// the end of a line. Beyond this, such as when a full-screen program is
+// running, the output is redacted and written as it is.
+const maxRedactPending = 64 * 1024
+
+// stringsFlag is a flag which may be passed more than once, collecting every
+// value.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// parseRedactPatterns compiles the -log-redact regular expressions.
+func parseRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// redactingWriter replaces the text matching any of patterns with
+// redactedText before writing it to w.
+//
+// The output of the session arrives in arbitrary chunks, so a secret may be
+// split across writes. To catch it, output is held back until a line is
+// complete and the patterns are then matched against whole lines, so that
+// matches can't span lines. Flush writes any incomplete final line.
+type redactingWriter struct {
+	w        io.Writer
+	patterns []*regexp.Regexp
+	pending  []byte
+}
+
+func (r *redactingWriter) Write(b []byte) (int, error) {
+	r.pending = append(r.pending, b...)
+
+	end := bytes.LastIndexByte(r.pending, '\n') + 1
+	if len(r.pending) > maxRedactPending {
+		end = len(r.pending)
+	}
+	if end == 0 {
+		return len(b), nil
+	}
+
+	out := r.redact(r.pending[:end])
+	r.pending = append(r.pending[:0], r.pending[end:]...)
+
+	if _, err := writeFull(r.w, out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes any output held back waiting for the end of its line.
+func (r *redactingWriter) Flush() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	out := r.redact(r.pending)
+	r.pending = r.pending[:0]
+
+	_, err := writeFull(r.w, out)
+	return err
+}
+
+// redact replaces the text matching the patterns in each of the lines in b.
+func (r *redactingWriter) redact(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '\n') + 1
+		if end == 0 {
+			end = len(b)
+		}
+
+		line := b[:end]
+		for _, re := range r.patterns {
+			line = re.ReplaceAllLiteral(line, []byte(redactedText))
+		}
+		out = append(out, line...)
+		b = b[end:]
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	long := strings.Repeat("x", maxRedactPending)
+
+	for _, tt := range []struct {
+		name     string
+		patterns []string
+		writes   []string
+
+		// written is what has been written before Flush, and flushed what
+		// has been written after it.
+		written string
+		flushed string
+	}{
+		{
+			name:     "line",
+			patterns: []string{`hunter\d`},
+			writes:   []string{"password: hunter2\n"},
+			written:  "password: ***\n",
+			flushed:  "password: ***\n",
+		},
+		{
+			name:     "split across writes",
+			patterns: []string{`hunter\d`},
+			writes:   []string{"password: hu", "nte", "r2\nnext"},
+			written:  "password: ***\n",
+			flushed:  "password: ***\nnext",
+		},
+		{
+			name:     "incomplete line",
+			patterns: []string{`hunter\d`},
+			writes:   []string{"password: hunter2"},
+			written:  "",
+			flushed:  "password: ***",
+		},
+		{
+			name:     "several patterns",
+			patterns: []string{`hunter\d`, `ghp_\w+`},
+			writes:   []string{"hunter2 ghp_abc123\r\n"},
+			written:  "*** ***\r\n",
+			flushed:  "*** ***\r\n",
+		},
+		{
+			name:     "no match across lines",
+			patterns: []string{`hunter\s+2`},
+			writes:   []string{"hunter\n2\n"},
+			written:  "hunter\n2\n",
+			flushed:  "hunter\n2\n",
+		},
+		{
+			name:     "line longer than the limit",
+			patterns: []string{`hunter\d`},
+			writes:   []string{long, "hunter2"},
+			written:  long + "***",
+			flushed:  long + "***",
+		},
+		{
+			name:     "line up to the limit",
+			patterns: []string{`hunter\d`},
+			writes:   []string{long[7:], "hunter2"},
+			written:  "",
+			flushed:  long[7:] + "***",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := parseRedactPatterns(tt.patterns)
+			if err != nil {
+				t.Fatalf("invalid patterns: %v", err)
+			}
+
+			var buf bytes.Buffer
+			r := &redactingWriter{w: &buf, patterns: patterns}
+			for _, w := range tt.writes {
+				if n, err := r.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write = %v, %v, want %v, nil", n, err, len(w))
+				}
+			}
+			if got := buf.String(); got != tt.written {
+				t.Errorf("written before Flush = %q, want %q", truncate(got), truncate(tt.written))
+			}
+
+			if err := r.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if got := buf.String(); got != tt.flushed {
+				t.Errorf("written after Flush = %q, want %q", truncate(got), truncate(tt.flushed))
+			}
+		})
+	}
+}
+
+// truncate shortens s to keep failure messages readable.
+func truncate(s string) string {
+	if len(s) > 64 {
+		return s[:32] + "..." + s[len(s)-29:]
+	}
+	return s
+}
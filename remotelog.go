@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// remoteLogQueueSize is the number of records buffered for the remote
+	// collector, such as while reconnecting to it. Records sent while the
+	// buffer is full are dropped.
+	remoteLogQueueSize = 4096
+
+	remoteLogDialTimeout  = 5 * time.Second
+	remoteLogWriteTimeout = 5 * time.Second
+	remoteLogMaxBackoff   = 30 * time.Second
+
+	// remoteLogCloseTimeout is how long Close waits for buffered records to
+	// be sent.
+	remoteLogCloseTimeout = 5 * time.Second
+)
+
+// remoteLogRecord is a record sent to the -log-remote collector, as a line of
+// JSON. Session output, sent with -log-remote-session, has the level
+// "output", and each line of it is a separate record.
+type remoteLogRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// remoteLog streams log records to a collector over TCP or UDP. Records are
+// queued and sent in the background, reconnecting when the connection fails,
+// so that logging never blocks the session.
+type remoteLog struct {
+	network string
+	addr    string
+	queue   chan []byte
+	done    chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	dropping bool
+}
+
+// parseRemoteLogAddr parses a -log-remote address of the form tcp://host:port
+// or udp://host:port. An address without a scheme uses TCP.
+func parseRemoteLogAddr(s string) (network, addr string, err error) {
+	network, addr = "tcp", s
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		network, addr = u.Scheme, u.Host
+	}
+
+	if network != "tcp" && network != "udp" {
+		return "", "", fmt.Errorf("unsupported network %q: must be tcp or udp", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return network, addr, nil
+}
+
+// newRemoteLog starts sending records to the collector at s, parsed by
+// parseRemoteLogAddr.
+func newRemoteLog(s string) (*remoteLog, error) {
+	network, addr, err := parseRemoteLogAddr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &remoteLog{
+		network: network,
+		addr:    addr,
+		queue:   make(chan []byte, remoteLogQueueSize),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// send queues a record for the collector. If the queue is full, the record is
+// dropped, with a warning the first time this happens until the queue drains.
+func (r *remoteLog) send(level, message string) {
+	b, err := json.Marshal(remoteLogRecord{
+		Time:    formatNow(),
+		Level:   level,
+		Message: message,
+	})
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+
+	select {
+	case r.queue <- b:
+		r.mu.Unlock()
+		return
+	default:
+	}
+
+	// The warning is logged, and so sent here again, after dropping is set
+	// so that it doesn't warn again.
+	warn := !r.dropping
+	r.dropping = true
+	r.mu.Unlock()
+
+	if warn {
+		logWarn(fmt.Sprintf("remote log collector %v is falling behind, dropping log records", r.addr))
+	}
+}
+
+// Write sends each write as a record of session output. It is used behind a
+// transcriptWriter, which writes a line at a time.
+func (r *remoteLog) Write(b []byte) (int, error) {
+	r.send("output", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+// Close stops accepting records, and waits a short time for those already
+// queued to be sent.
+func (r *remoteLog) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(remoteLogCloseTimeout):
+	}
+}
+
+func (r *remoteLog) run() {
+	defer close(r.done)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	backoff := time.Second
+	failing := false
+
+	for record := range r.queue {
+		for {
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout(r.network, r.addr, remoteLogDialTimeout)
+				if err != nil {
+					if !failing {
+						failing = true
+						logWarn(fmt.Sprintf("failed to connect to remote log collector %v, retrying: %v", r.addr, err))
+					}
+					time.Sleep(backoff)
+					if backoff *= 2; backoff > remoteLogMaxBackoff {
+						backoff = remoteLogMaxBackoff
+					}
+					continue
+				}
+
+				if failing {
+					failing = false
+					logNotice(fmt.Sprintf("reconnected to remote log collector %v", r.addr))
+				}
+				backoff = time.Second
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(remoteLogWriteTimeout))
+			if _, err := conn.Write(record); err != nil {
+				conn.Close()
+				conn = nil
+				continue
+			}
+			break
+		}
+
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			r.dropping = false
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRemoteLogRecords accepts a connection on l and reads n records from it.
+func readRemoteLogRecords(t *testing.T, l net.Listener, n int) []remoteLogRecord {
+	t.Helper()
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("collector failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var records []remoteLogRecord
+	scanner := bufio.NewScanner(conn)
+	for len(records) < n && scanner.Scan() {
+		var record remoteLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("collector received invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) < n {
+		t.Fatalf("collector received %v records, want %v: %v", len(records), n, scanner.Err())
+	}
+	return records
+}
+
+func TestRemoteLog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	r, err := newRemoteLog("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("newRemoteLog failed: %v", err)
+	}
+	defer r.Close()
+
+	r.send("notice", "server started")
+	r.Write([]byte("$ ls\n"))
+
+	records := readRemoteLogRecords(t, l, 2)
+	for i, want := range []remoteLogRecord{{Level: "notice", Message: "server started"}, {Level: "output", Message: "$ ls"}} {
+		if got := records[i]; got.Level != want.Level || got.Message != want.Message {
+			t.Errorf("record %v = %+v, want %+v", i, got, want)
+		}
+		if _, err := time.Parse(time.RFC3339, records[i].Time); err != nil {
+			t.Errorf("record %v has invalid time %q: %v", i, records[i].Time, err)
+		}
+	}
+}
+
+func TestRemoteLogOutage(t *testing.T) {
+	// Find a free port, and leave nothing listening on it for now.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r, err := newRemoteLog("tcp://" + addr)
+	if err != nil {
+		t.Fatalf("newRemoteLog failed: %v", err)
+	}
+	defer r.Close()
+
+	// The records are buffered while the collector is down, and sent in
+	// order once it comes up.
+	for _, message := range []string{"one", "two", "three"} {
+		r.send("notice", message)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("failed to listen again: %v", err)
+	}
+	defer l.Close()
+
+	records := readRemoteLogRecords(t, l, 3)
+	for i, want := range []string{"one", "two", "three"} {
+		if records[i].Message != want {
+			t.Errorf("record %v = %q, want %q", i, records[i].Message, want)
+		}
+	}
+}
+
+func TestRemoteLogFull(t *testing.T) {
+	// Nothing sends the queued records, so the queue stays full.
+	r := &remoteLog{addr: "collector:514", queue: make(chan []byte, 2), done: make(chan struct{})}
+
+	// The warning is sent to the remote log too, which is another one here,
+	// so that it can be seen.
+	watcher := &remoteLog{queue: make(chan []byte, 16)}
+	logRemote = watcher
+	defer func() { logRemote = nil }()
+
+	for _, message := range []string{"one", "two", "three", "four"} {
+		r.send("notice", message)
+	}
+	if got := len(r.queue); got != 2 {
+		t.Errorf("queued %v records, want 2", got)
+	}
+	if first := string(<-r.queue); !strings.Contains(first, `"message":"one"`) {
+		t.Errorf("first record = %q, want the first sent", first)
+	}
+
+	// The records are dropped with one warning, however many are dropped.
+	var warnings []string
+	for len(watcher.queue) > 0 {
+		if record := string(<-watcher.queue); strings.Contains(record, "falling behind") {
+			warnings = append(warnings, record)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"level":"warning"`) {
+		t.Errorf("warnings = %q, want one about collector:514 falling behind", warnings)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// resizeRecord is a line of the -log-resizes file.
+type resizeRecord struct {
+	// Event is "start" for the window size a session started with, and
+	// "resize" for a change to it.
+	Event string `json:"event"`
+	Time  string `json:"time"`
+
+	// Offset is the number of bytes of the session's output, after its
+	// header, which had been written to the log when the size was set.
+	Offset int64 `json:"offset"`
+
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// resizeLog records a session's window sizes to the -log-resizes file, as JSON
+// lines. Each is recorded with how much of the session's output had been
+// logged when it was set, so that a replay of the log can resize the terminal
+// at the same point, which full-screen programs need to be redrawn correctly.
+// The output is counted as it is written through countOutput.
+type resizeLog struct {
+	f *os.File
+
+	mu     sync.Mutex
+	offset int64
+	window ssh.Window
+}
+
+// openResizeLogFile opens the -log-resizes file for s, adding name to its path
+// as openSessionLog does, and records the size of its window.
+func openResizeLogFile(opts options, s ssh.Session, name string) (*resizeLog, error) {
+	path := opts.resizeLogPath
+	if name != "" {
+		path = sessionLogPath(path, name)
+		logNotice(fmt.Sprintf("logging the window sizes of %v to %v", name, path))
+	}
+
+	f, err := openLogFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, opts.logMkdir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &resizeLog{f: f}
+	ptyReq, _, _ := s.Pty()
+	r.record("start", ptyReq.Window)
+	return r, nil
+}
+
+func (r *resizeLog) Close() error {
+	return r.f.Close()
+}
+
+// record writes a record of the window size, unless it is the size already
+// recorded.
+func (r *resizeLog) record(event string, win ssh.Window) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event == "resize" && win == r.window {
+		return
+	}
+	r.window = win
+
+	b, err := json.Marshal(resizeRecord{
+		Event:  event,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Offset: r.offset,
+		Width:  win.Width,
+		Height: win.Height,
+	})
+	if err == nil {
+		_, err = r.f.Write(append(b, '\n'))
+	}
+	if err != nil {
+		logWarn(fmt.Sprintf("failed to write to -log-resizes: %v", err))
+	}
+}
+
+// countOutput returns a writer which writes the session's output to log,
+// counting it for the offsets of the records.
+func (r *resizeLog) countOutput(log io.Writer) io.Writer {
+	return &countingWriter{r: r, w: log}
+}
+
+// countingWriter writes to w, adding what was written to r's offset.
+type countingWriter struct {
+	r *resizeLog
+	w io.Writer
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	n, err := c.w.Write(b)
+	c.r.offset += int64(n)
+	return n, err
+}
+
+// logResizes records each window size sent on winCh to r, and passes it on
+// through the returned channel.
+func logResizes(r *resizeLog, winCh <-chan ssh.Window) <-chan ssh.Window {
+	logged := make(chan ssh.Window)
+	go func() {
+		defer close(logged)
+		for win := range winCh {
+			r.record("resize", win)
+			logged <- win
+		}
+	}()
+	return logged
+}
+
+const (
+	// maxWindowSize is the largest width or height a client may set its
+	// window to. The kernel stores window sizes as uint16s, and programs
+	// often allocate a screen buffer of width by height, so larger sizes
+	// are clamped to it.
+	maxWindowSize = 9999
+
+	// defaultWidth and defaultHeight replace a width or height of 0, which
+	// some clients send when they don't know the size of their terminal.
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// clampWindow returns win with its width and height between 1 and
+// maxWindowSize, and whether they had to be changed.
+func clampWindow(win ssh.Window) (ssh.Window, bool) {
+	clamped := win
+	if clamped.Width <= 0 {
+		clamped.Width = defaultWidth
+	} else if clamped.Width > maxWindowSize {
+		clamped.Width = maxWindowSize
+	}
+	if clamped.Height <= 0 {
+		clamped.Height = defaultHeight
+	} else if clamped.Height > maxWindowSize {
+		clamped.Height = maxWindowSize
+	}
+	return clamped, clamped != win
+}
+
+// clampWindowLogged is clampWindow, logging a warning if win was changed.
+func clampWindowLogged(win ssh.Window) ssh.Window {
+	clamped, changed := clampWindow(win)
+	if changed {
+		logWarn(fmt.Sprintf("client requested a window size of %vx%v, using %vx%v instead", win.Width, win.Height, clamped.Width, clamped.Height))
+	}
+	return clamped
+}
+
+// clampedPtySession is a session whose window sizes, from its PTY request
+// and window changes, have been passed through clampWindow, so that nothing
+// sees a size which would be truncated or wrap around.
+type clampedPtySession struct {
+	ssh.Session
+
+	once  sync.Once
+	pty   ssh.Pty
+	winCh <-chan ssh.Window
+	isPty bool
+}
+
+func clampPty(s ssh.Session) ssh.Session {
+	return &clampedPtySession{Session: s}
+}
+
+func (c *clampedPtySession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	// The window changes can only be clamped by one goroutine, however many
+	// times Pty is called.
+	c.once.Do(func() {
+		pty, winCh, isPty := c.Session.Pty()
+		c.pty, c.winCh, c.isPty = pty, winCh, isPty
+		if !isPty || winCh == nil {
+			// Sessions without a PTY have no window to clamp.
+			return
+		}
+
+		last := pty.Window
+		c.pty.Window = clampWindowLogged(pty.Window)
+		clamped := make(chan ssh.Window)
+		go func() {
+			defer close(clamped)
+			for win := range winCh {
+				// The first size sent is usually that of the PTY
+				// request, which has already been logged.
+				if win == last {
+					win, _ = clampWindow(win)
+				} else {
+					last = win
+					win = clampWindowLogged(win)
+				}
+				clamped <- win
+			}
+		}()
+		c.winCh = clamped
+	})
+	return c.pty, c.winCh, c.isPty
+}
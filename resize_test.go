@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// readResizeLog returns the records in the -log-resizes file at path.
+func readResizeLog(t *testing.T, path string) []resizeRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open resize log: %v", err)
+	}
+	defer f.Close()
+
+	var records []resizeRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record resizeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestResizeLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resizes.jsonl")
+	key := newTestKey(t)
+	ts := startTestServer(t, options{
+		resizeLogPath: path,
+		program:       []string{"sh", "-c", "printf before; read line; printf after"},
+	}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	ss.waitForOutput(t, "before")
+
+	// The output is counted once it has been logged, which may be after
+	// the client has been sent it.
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(ts.log.String(), "before") {
+		if time.Now().After(deadline) {
+			t.Fatalf("log %q never contained the output", ts.log.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := ss.WindowChange(50, 132); err != nil {
+		t.Fatalf("failed to resize: %v", err)
+	}
+	for len(readResizeLog(t, path)) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("resize was never recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ss.stdin.Write([]byte("\n"))
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	records := readResizeLog(t, path)
+	want := []resizeRecord{
+		{Event: "start", Offset: 0, Width: 80, Height: 24},
+		{Event: "resize", Offset: int64(len("before")), Width: 132, Height: 50},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("records = %+v, want %+v", records, want)
+	}
+	for i, record := range records {
+		if _, err := time.Parse(time.RFC3339Nano, record.Time); err != nil {
+			t.Errorf("record %v has invalid time %q", i, record.Time)
+		}
+		record.Time = ""
+		if record != want[i] {
+			t.Errorf("record %v = %+v, want %+v", i, record, want[i])
+		}
+	}
+}
+
+func TestClampWindow(t *testing.T) {
+	for _, tt := range []struct {
+		win         ssh.Window
+		want        ssh.Window
+		wantChanged bool
+	}{
+		{ssh.Window{Width: 80, Height: 24}, ssh.Window{Width: 80, Height: 24}, false},
+		{ssh.Window{Width: 1, Height: 1}, ssh.Window{Width: 1, Height: 1}, false},
+		{ssh.Window{Width: maxWindowSize, Height: maxWindowSize}, ssh.Window{Width: maxWindowSize, Height: maxWindowSize}, false},
+		{ssh.Window{Width: 0, Height: 0}, ssh.Window{Width: defaultWidth, Height: defaultHeight}, true},
+		{ssh.Window{Width: -1, Height: 50}, ssh.Window{Width: defaultWidth, Height: 50}, true},
+		{ssh.Window{Width: 132, Height: 0}, ssh.Window{Width: 132, Height: defaultHeight}, true},
+		{ssh.Window{Width: 65536, Height: 24}, ssh.Window{Width: maxWindowSize, Height: 24}, true},
+		{ssh.Window{Width: 80, Height: maxWindowSize + 1}, ssh.Window{Width: 80, Height: maxWindowSize}, true},
+	} {
+		got, changed := clampWindow(tt.win)
+		if got != tt.want || changed != tt.wantChanged {
+			t.Errorf("clampWindow(%+v) = %+v, %v, want %+v, %v", tt.win, got, changed, tt.want, tt.wantChanged)
+		}
+	}
+}
+
+// ptySession is a session with a fixed PTY, for clampPty.
+type ptySession struct {
+	ssh.Session
+
+	pty   ssh.Pty
+	winCh chan ssh.Window
+	isPty bool
+}
+
+func (s *ptySession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return s.pty, s.winCh, s.isPty
+}
+
+func TestClampPty(t *testing.T) {
+	winCh := make(chan ssh.Window, 3)
+	winCh <- ssh.Window{Width: 0, Height: 0}
+	winCh <- ssh.Window{Width: 100000, Height: 40}
+	winCh <- ssh.Window{Width: 120, Height: 40}
+	close(winCh)
+
+	s := clampPty(&ptySession{pty: ssh.Pty{Term: "xterm", Window: ssh.Window{Width: 0, Height: 0}}, winCh: winCh, isPty: true})
+	pty, clamped, isPty := s.Pty()
+	if !isPty || pty.Term != "xterm" || pty.Window != (ssh.Window{Width: defaultWidth, Height: defaultHeight}) {
+		t.Errorf("Pty() = %+v, %v, want an xterm of %vx%v", pty, isPty, defaultWidth, defaultHeight)
+	}
+
+	want := []ssh.Window{{Width: defaultWidth, Height: defaultHeight}, {Width: maxWindowSize, Height: 40}, {Width: 120, Height: 40}}
+	var got []ssh.Window
+	for win := range clamped {
+		got = append(got, win)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("window changes = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("window change %v = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// The window changes are only clamped once, however many times Pty is
+	// called.
+	if _, again, _ := s.Pty(); again != clamped {
+		t.Errorf("Pty() returned a different window channel the second time")
+	}
+
+	// Sessions without a PTY are left alone.
+	pty, clamped, isPty = clampPty(&ptySession{}).Pty()
+	if isPty || clamped != nil || pty != (ssh.Pty{}) {
+		t.Errorf("Pty() without a PTY = %+v, %v, %v, want nothing", pty, clamped, isPty)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// runResult describes what happened while otsshd ran. It is returned by run,
+// and written to the -status-file as JSON.
+type runResult struct {
+	// Sessions is the number of sessions which were started. It is at most
+	// 1, unless -once-per-key is set.
+	Sessions int `json:"sessions"`
+
+	// RemoteAddress is the address the first session connected from.
+	RemoteAddress string `json:"remote_address,omitempty"`
+
+	// ExitCode is the exit code of the session's shell, as used for
+	// otsshd's own exit code. It is omitted if no shell exited.
+	ExitCode *int `json:"exit_code,omitempty"`
+
+	// DurationSeconds is the time from the start of the first session to
+	// the end of the last.
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	// BytesIn and BytesOut are the number of bytes of session data received
+	// from and sent to clients.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// FirstConnectionSeconds and FirstAuthSeconds are the time from the
+	// server starting to listen to the first connection attempt, and to the
+	// first client authenticating. They are omitted if that didn't happen.
+	FirstConnectionSeconds *float64 `json:"first_connection_seconds,omitempty"`
+	FirstAuthSeconds       *float64 `json:"first_auth_seconds,omitempty"`
+
+	// TimedOut is set if the server exited because no session started
+	// within the -timeout.
+	TimedOut bool `json:"timed_out"`
+
+	// Error is the error otsshd exited with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Result describes what happened while the server ran. It should be called
+// once the server has shut down.
+func (ots *oneTimeServer) Result() runResult {
+	ots.mu.Lock()
+	defer ots.mu.Unlock()
+
+	result := runResult{
+		Sessions:      ots.result.sessions,
+		RemoteAddress: ots.result.remoteAddress,
+		BytesIn:       atomic.LoadInt64(&ots.result.bytesIn),
+		BytesOut:      atomic.LoadInt64(&ots.result.bytesOut),
+		TimedOut:      ots.result.timedOut && ots.result.sessions == 0,
+	}
+
+	result.FirstConnectionSeconds = secondsSince(ots.result.listening, ots.result.firstConnection)
+	result.FirstAuthSeconds = secondsSince(ots.result.listening, ots.result.firstAuth)
+
+	if ots.result.sessions > 0 {
+		result.DurationSeconds = ots.result.end.Sub(ots.result.start).Seconds()
+
+		code, isExit := shellExitCode(ots.sessionErr)
+		if ots.sessionErr == nil || isExit {
+			result.ExitCode = &code
+		}
+	}
+
+	return result
+}
+
+// secondsSince returns the number of seconds from start to t, or nil if t is
+// zero.
+func secondsSince(start, t time.Time) *float64 {
+	if t.IsZero() {
+		return nil
+	}
+	seconds := t.Sub(start).Seconds()
+	return &seconds
+}
+
+// recordFirst sets *first, one of the times in the server's result, to now if
+// it isn't already set. It returns the time since the server started
+// listening, and whether *first was set.
+func (ots *oneTimeServer) recordFirst(first *time.Time) (time.Duration, bool) {
+	ots.mu.Lock()
+	defer ots.mu.Unlock()
+
+	if !first.IsZero() {
+		return 0, false
+	}
+	*first = time.Now()
+	return first.Sub(ots.result.listening).Round(time.Millisecond), true
+}
+
+// writeStatusFile writes result, and err if it isn't nil, to path as JSON.
+func writeStatusFile(path string, result runResult, err error) error {
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0o600)
+}
+
+// countingSession counts the bytes of session data read from and written to
+// a session.
+type countingSession struct {
+	ssh.Session
+	in, out *int64
+}
+
+// countSession wraps s to add the data it carries to the server's result.
+func (ots *oneTimeServer) countSession(s ssh.Session) ssh.Session {
+	return &countingSession{Session: s, in: &ots.result.bytesIn, out: &ots.result.bytesOut}
+}
+
+func (c *countingSession) Read(b []byte) (int, error) {
+	n, err := c.Session.Read(b)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countingSession) Write(b []byte) (int, error) {
+	n, err := c.Session.Write(b)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+func (c *countingSession) Stderr() io.ReadWriter {
+	return countingStderr{rw: c.Session.Stderr(), out: c.out}
+}
+
+// countingStderr counts the bytes written to a session's stderr.
+type countingStderr struct {
+	rw  io.ReadWriter
+	out *int64
+}
+
+func (c countingStderr) Read(b []byte) (int, error) {
+	return c.rw.Read(b)
+}
+
+func (c countingStderr) Write(b []byte) (int, error) {
+	n, err := c.rw.Write(b)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
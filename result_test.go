@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultExit(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "echo done; exit 3"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if got := exitStatus(t, ss.wait(t)); got != 3 {
+		t.Fatalf("exit status = %v, want 3", got)
+	}
+	ts.wait(t)
+
+	result := ts.Result()
+	if result.Sessions != 1 {
+		t.Errorf("Sessions = %v, want 1", result.Sessions)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 3 {
+		t.Errorf("ExitCode = %v, want 3", result.ExitCode)
+	}
+	if result.RemoteAddress == "" {
+		t.Error("RemoteAddress is empty")
+	}
+	if result.BytesOut == 0 {
+		t.Error("BytesOut = 0, want the session's output counted")
+	}
+	if result.FirstAuthSeconds == nil {
+		t.Error("FirstAuthSeconds is unset")
+	}
+	if result.TimedOut {
+		t.Error("TimedOut is set")
+	}
+}
+
+func TestResultTimeout(t *testing.T) {
+	ts := startTestServer(t, options{timeout: 50 * time.Millisecond}, newTestKey(t).PublicKey())
+	ts.wait(t)
+
+	result := ts.Result()
+	if !result.TimedOut {
+		t.Error("TimedOut is unset")
+	}
+	if result.Sessions != 0 || result.ExitCode != nil || result.FirstConnectionSeconds != nil {
+		t.Errorf("result = %+v, want no sessions or connections", result)
+	}
+}
+
+// TestResultClosedDuringSession checks that closing the server while a
+// session is running, as -max-lifetime does, waits for the session to record
+// how it ended before Serve returns.
+func TestResultClosedDuringSession(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"sh", "-c", "echo started; exec sleep 60"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	ss.waitForOutput(t, "started")
+
+	go ts.Close()
+	ts.wait(t)
+
+	result := ts.Result()
+	if result.Sessions != 1 {
+		t.Errorf("Sessions = %v, want 1", result.Sessions)
+	}
+	// The shell is killed with SIGKILL.
+	if result.ExitCode == nil || *result.ExitCode != 128+9 {
+		t.Errorf("ExitCode = %v, want %v", result.ExitCode, 128+9)
+	}
+	if err := ts.SessionError(); exitCodeFor(err) != 128+9 {
+		t.Errorf("SessionError() = %v, want the shell killed by SIGKILL", err)
+	}
+}
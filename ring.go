@@ -0,0 +1,58 @@
+package main
+
+import "sync"
+
+// ringBuffer keeps the most recent bytes written to it, up to its size, so
+// that viewers which connect part way through a session can be shown what
+// came just before. It is safe for concurrent use.
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	next int
+	full bool
+}
+
+// newRingBuffer returns a ringBuffer which keeps the last size bytes written
+// to it.
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+// Write keeps b, discarding the oldest bytes to make room. It never fails.
+func (r *ringBuffer) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(b)
+	if n == 0 || len(r.buf) == 0 {
+		return n, nil
+	}
+
+	if len(b) >= len(r.buf) {
+		copy(r.buf, b[len(b)-len(r.buf):])
+		r.next, r.full = 0, true
+		return n, nil
+	}
+
+	copied := copy(r.buf[r.next:], b)
+	if copied < len(b) {
+		copy(r.buf, b[copied:])
+		r.full = true
+	}
+	r.next = (r.next + len(b)) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the bytes kept, oldest first.
+func (r *ringBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.next]...)
+	}
+	return append(append([]byte(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
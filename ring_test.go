@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 4, nil, ""},
+		{"partly filled", 4, []string{"ab"}, "ab"},
+		{"exactly filled", 4, []string{"ab", "cd"}, "abcd"},
+		{"wraps", 4, []string{"abc", "de"}, "bcde"},
+		{"wraps to the start", 4, []string{"ab", "cd", "ef", "gh"}, "efgh"},
+		{"wraps more than once", 4, []string{"abc", "def", "ghi"}, "fghi"},
+		{"write the size", 4, []string{"a", "bcde"}, "bcde"},
+		{"write larger than the size", 4, []string{"a", "bcdefg"}, "defg"},
+		{"empty write", 4, []string{"abc", "", "d"}, "abcd"},
+		{"single byte", 1, []string{"a", "bc"}, "c"},
+		{"no size", 0, []string{"abc"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRingBuffer(tt.size)
+			for _, s := range tt.writes {
+				if n, err := r.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %v, %v", s, n, err)
+				}
+			}
+			if got := string(r.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferRandomWrites(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 7, 64} {
+		r := newRingBuffer(size)
+		var all bytes.Buffer
+		for i := 0; i < 1000; i++ {
+			b := []byte(strings.Repeat(string(rune('a'+i%26)), rng.Intn(2*size+1)))
+			r.Write(b)
+			all.Write(b)
+
+			want := all.Bytes()
+			if len(want) > size {
+				want = want[len(want)-size:]
+			}
+			if got := r.Bytes(); !bytes.Equal(got, want) {
+				t.Fatalf("size %v, after %v writes: Bytes() = %q, want %q", size, i+1, got, want)
+			}
+		}
+	}
+}
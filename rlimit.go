@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rlimitResources maps the names accepted by -rlimit to resources.
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// rlimit is a resource limit to apply to the shell. The limit is used as both
+// the soft and hard limit, so the session can't raise it.
+type rlimit struct {
+	name     string
+	resource int
+	value    uint64
+}
+
+// parseRlimits parses a comma-separated list of name=value resource limits,
+// such as "cpu=60,nofile=256".
+func parseRlimits(s string) ([]rlimit, error) {
+	var limits []rlimit
+	for _, elem := range splitList(s) {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid resource limit %q: expected name=value", elem)
+		}
+
+		resource, ok := rlimitResources[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown resource %q", parts[0])
+		}
+
+		value, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for resource %v: %w", parts[0], err)
+		}
+
+		limits = append(limits, rlimit{name: parts[0], resource: resource, value: value})
+	}
+	return limits, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// applyRlimits sets the given resource limits on the process with the given
+// pid, using prlimit(2). As the limits are applied after the process has
+// started, it may run briefly without them.
+func applyRlimits(pid int, limits []rlimit) error {
+	for _, limit := range limits {
+		rlim := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(limit.resource),
+			uintptr(unsafe.Pointer(&rlim)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("failed to set %v limit: %w", limit.name, errno)
+		}
+	}
+	return nil
+}
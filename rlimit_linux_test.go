@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestRlimitSession(t *testing.T) {
+	limits, err := parseRlimits("nofile=64,fsize=1024")
+	if err != nil {
+		t.Fatalf("failed to parse limits: %v", err)
+	}
+
+	// The limits are applied just after the shell starts, so give them time
+	// to be.
+	output, err := runTestSession(t, options{rlimits: limits}, "sh", "-c", "sleep 0.2; ulimit -n; ulimit -H -n; ulimit -f")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	// ulimit -f counts 512-byte blocks.
+	if want := "64\r\n64\r\n2\r\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
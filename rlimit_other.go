@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// applyRlimits is only supported on Linux.
+func applyRlimits(pid int, limits []rlimit) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	return errors.New("resource limits are only supported on Linux")
+}
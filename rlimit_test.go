@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseRlimits(t *testing.T) {
+	for _, tt := range []struct {
+		s       string
+		want    []rlimit
+		wantErr string
+	}{
+		{s: "", want: nil},
+		{s: "cpu=60", want: []rlimit{{name: "cpu", resource: syscall.RLIMIT_CPU, value: 60}}},
+		{s: "cpu=60, nofile=256", want: []rlimit{
+			{name: "cpu", resource: syscall.RLIMIT_CPU, value: 60},
+			{name: "nofile", resource: syscall.RLIMIT_NOFILE, value: 256},
+		}},
+		{s: "core=0", want: []rlimit{{name: "core", resource: syscall.RLIMIT_CORE, value: 0}}},
+		{s: "cpu", wantErr: `invalid resource limit "cpu": expected name=value`},
+		{s: "CPU=60", wantErr: `unknown resource "CPU"`},
+		{s: "nproc=10", wantErr: `unknown resource "nproc"`},
+		{s: "cpu=-1", wantErr: "invalid value for resource cpu"},
+		{s: "cpu=1m", wantErr: "invalid value for resource cpu"},
+	} {
+		got, err := parseRlimits(tt.s)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRlimits(%q) = %v, want an error containing %q", tt.s, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRlimits(%q) = %+v, %v, want %+v", tt.s, got, err, tt.want)
+		}
+	}
+}
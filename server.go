@@ -1,13 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -19,132 +25,1227 @@ import (
 )
 
 type oneTimeServer struct {
-	once       sync.Once
 	lasOnce    sync.Once
 	server     *ssh.Server
+	listeners  []net.Listener
 	sessionErr error
-	timeout    time.Duration
+
+	timeout      time.Duration
+	timeoutReset chan struct{}
+
+	// closed is closed once Close has finished shutting the server down.
+	closed     chan struct{}
+	closedOnce sync.Once
+
+	authorizedKeys *keySet
+	logWriter      io.Writer
+	opts           options
+
+	mu       sync.Mutex
+	attempts int
+
+	// result records what happened, for Result.
+	result struct {
+		sessions      int
+		remoteAddress string
+		start, end    time.Time
+		timedOut      bool
+
+		// listening is when the server started listening, and
+		// firstConnection and firstAuth are when the first connection
+		// attempt was made and the first client authenticated.
+		listening, firstConnection, firstAuth time.Time
+
+		// bytesIn and bytesOut are updated atomically.
+		bytesIn, bytesOut int64
+	}
+
+	// started is set once a session has been accepted, so that others can
+	// be turned away while it runs. It is cleared again if the session
+	// frees its slot with -retry-shell.
+	started bool
+
+	// sessions is the number of sessions which have opened their own log,
+	// with opts.openSessionLog.
+	sessions int
+
+	// shells holds the attachment for each session's shell, by the
+	// fingerprint of the key the session authenticated with.
+	shells map[string]*attachment
+
+	// usedKeys and active track sessions in once-per-key mode: usedKeys
+	// holds the fingerprints of keys which have had their session, and
+	// active is the number of sessions in progress.
+	usedKeys map[string]bool
+	active   int
+
+	// closing is set once no more sessions should be started.
+	closing bool
+
+	// running tracks the sessions in progress, which Serve waits for, so
+	// that they have recorded how they ended before it returns.
+	running sync.WaitGroup
+
+	// ready, if set, holds sessions until the -ready-command succeeds.
+	ready *readinessCheck
+
+	// web, if set, serves the -web-addr web terminal.
+	web *webTerminal
+}
+
+// contextKey is used to store values in an ssh.Context.
+type contextKey struct {
+	name string
 }
 
-func newOneTimeServer(addr string, authorizedKeys []gossh.PublicKey, signer ssh.Signer,
-	logWriter io.Writer, copyEnv bool, timeout time.Duration) *oneTimeServer {
+// keyCommentContextKey holds the comment of the authorized key that a
+// connection authenticated with.
+var keyCommentContextKey = &contextKey{"key-comment"}
+
+// authenticatedContextKey holds an *int32 which is set to 1 once a connection
+// has authenticated.
+var authenticatedContextKey = &contextKey{"authenticated"}
+
+// newOneTimeServer creates a server which authenticates clients against
+// authorizedKeys, using signer as its host key and logging sessions to
+// logWriter. Failing to write to logWriter doesn't interrupt a session.
+func newOneTimeServer(authorizedKeys *keySet, signer ssh.Signer, logWriter io.Writer, opts options) (*oneTimeServer, error) {
+	if signer == nil {
+		return nil, errors.New("no host key given")
+	}
+	if authorizedKeys == nil || len(authorizedKeys.get()) == 0 && !opts.allowAnyKey && opts.authHook == nil {
+		return nil, errors.New("no authorized keys given")
+	}
+	if logWriter == nil && opts.openSessionLog == nil {
+		return nil, errors.New("no log writer given")
+	}
+	if len(opts.addrs) == 0 {
+		return nil, errors.New("no listen address given")
+	}
+	if logWriter != nil {
+		logWriter = &bestEffortWriter{w: logWriter}
+	}
+
+	ots := &oneTimeServer{
+		timeout:        opts.timeout,
+		timeoutReset:   make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+		authorizedKeys: authorizedKeys,
+		logWriter:      logWriter,
+		opts:           opts,
+		shells:         make(map[string]*attachment),
+		usedKeys:       make(map[string]bool),
+	}
+
+	if opts.readyCommand != "" {
+		ots.ready = newReadinessCheck(opts.readyCommand, opts.readyInterval)
+	}
+
 	server := &ssh.Server{
-		Addr: addr,
-		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			for _, authorizedKey := range authorizedKeys {
-				if ssh.KeysEqual(key, authorizedKey) {
-					return true
-				}
+		Addr:                     opts.addrs[0],
+		PublicKeyHandler:         ots.handlePublicKey,
+		ConnCallback:             ots.handleConn,
+		Version:                  strings.TrimPrefix(opts.serverVersion, serverVersionPrefix),
+		ServerConfigCallback:     ots.serverConfig,
+		ConnectionFailedCallback: ots.handleConnFailed,
+	}
+	ots.server = server
+
+	server.Handle(ots.handleSession)
+
+	if opts.subsystem != "" {
+		// Requests for any other subsystem fall through to "default".
+		server.SubsystemHandlers = map[string]ssh.SubsystemHandler{
+			opts.subsystem: ots.handleSession,
+			"default":      rejectSubsystem,
+		}
+	}
+	server.PtyCallback = rejectNoPtyKey
+	if opts.sftpRoot != "" {
+		server.PtyCallback = rejectPty
+	}
+
+	server.AddHostKey(signer)
+	return ots, nil
+}
+
+// serverConfig returns the configuration for a new connection, which restricts
+// the algorithms it may negotiate to those allowed by opts.
+func (ots *oneTimeServer) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	config := &gossh.ServerConfig{}
+	config.KeyExchanges = ots.opts.kexAlgorithms
+	config.Ciphers = ots.opts.ciphers
+	config.MACs = ots.opts.macs
+	config.MaxAuthTries = ots.opts.maxAuthTries
+	return config
+}
+
+// handleConnFailed is called when a connection fails before a session starts,
+// such as when it fails to authenticate.
+func (ots *oneTimeServer) handleConnFailed(conn net.Conn, err error) {
+	if strings.Contains(err.Error(), "too many authentication failures") {
+		logWarn(fmt.Sprintf("dropped connection from %v: too many authentication failures (-max-auth-tries is %v)", conn.RemoteAddr(), ots.opts.maxAuthTries))
+		return
+	}
+	if strings.Contains(err.Error(), "no common algorithm") {
+		// The client only supports algorithms which -kex, -ciphers or
+		// -macs don't allow.
+		logWarn(fmt.Sprintf("rejected client from %v: %v", conn.RemoteAddr(), err))
+		return
+	}
+	logDebug(fmt.Sprintf("connection from %v failed: %v", conn.RemoteAddr(), err))
+}
+
+// Listen starts listening for connections on each of the configured
+// addresses, and serving the -web-addr web terminal if it is set. Listen must
+// be called before Serve.
+func (ots *oneTimeServer) Listen() error {
+	for _, addr := range ots.opts.addrs {
+		var listener net.Listener
+		var err error
+		if ots.opts.autoPort {
+			// Rather than waiting for the port to be free, use the next
+			// one which is.
+			listener, err = listen(addr)
+			if errors.Is(err, syscall.EADDRINUSE) {
+				listener, err = listenAutoPort(addr)
 			}
-			return false
-		},
+		} else {
+			listener, err = listenWithRetry(addr, ots.opts.listenRetries)
+		}
+		if err != nil {
+			for _, l := range ots.listeners {
+				l.Close()
+			}
+			ots.listeners = nil
+			return &listenError{addr: addr, err: err}
+		}
+		ots.listeners = append(ots.listeners, listener)
 	}
 
-	ots := oneTimeServer{
-		server:  server,
-		timeout: timeout,
+	if ots.opts.webAddr != "" {
+		web, err := newWebTerminal(ots.opts.webAddr, ots.handleSession)
+		if err != nil {
+			for _, l := range ots.listeners {
+				l.Close()
+			}
+			ots.listeners = nil
+			return fmt.Errorf("failed to set up -web-addr: %w", err)
+		}
+		ots.web = web
 	}
 
-	server.Handle(func(s ssh.Session) {
-		ots.once.Do(func() {
-			logNotice(fmt.Sprintf("session connected from %v", s.RemoteAddr()))
-			ots.sessionErr = handleSSHSession(logWriter, copyEnv, s)
-			logNotice("session disconnected")
-			server.Close()
-		})
-	})
+	ots.mu.Lock()
+	ots.result.listening = time.Now()
+	ots.mu.Unlock()
+	return nil
+}
 
-	server.AddHostKey(signer)
-	return &ots
+// autoPortAttempts is the number of ports after the requested one which
+// listenAutoPort tries.
+const autoPortAttempts = 100
+
+// listenAutoPort listens on the first free port after the one in addr.
+func listenAutoPort(addr string) (net.Listener, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	for next := port + 1; next <= port+autoPortAttempts && next <= 65535; next++ {
+		listener, err := listen(net.JoinHostPort(host, strconv.Itoa(next)))
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logNotice(fmt.Sprintf("port %v is in use, listening on port %v instead", port, next))
+		return listener, nil
+	}
+
+	return nil, fmt.Errorf("port %v and the %v ports after it are in use", port, autoPortAttempts)
+}
+
+// Addr returns the first address the server is listening on, which is the
+// one clients are told to connect to.
+func (ots *oneTimeServer) Addr() net.Addr {
+	return ots.listeners[0].Addr()
+}
+
+// WebURL returns the address to open the -web-addr web terminal at, or "" if
+// it isn't being served. host is interpreted as by formatConnectionHint.
+func (ots *oneTimeServer) WebURL(host string) (string, error) {
+	if ots.web == nil {
+		return "", nil
+	}
+	return ots.web.URL(host)
+}
+
+// Addrs returns every address the server is listening on.
+func (ots *oneTimeServer) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(ots.listeners))
+	for i, l := range ots.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
 }
 
-func (ots *oneTimeServer) ListenAndServe(ctx context.Context) error {
+// Serve accepts connections until the session ends or the timeout expires.
+func (ots *oneTimeServer) Serve(ctx context.Context) error {
 	var g errgroup.Group
 
 	cctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if ots.ready != nil {
+		go ots.ready.run(cctx)
+	}
+
 	g.Go(func() error {
-		select {
-		case <-time.After(ots.timeout):
-			ots.once.Do(func() {
-				logWarn(fmt.Sprintf("no connection within supplied timeout (%v), exiting\n", ots.timeout))
-				ots.Close()
-			})
-		case <-cctx.Done():
+		timer := time.NewTimer(ots.timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+				ots.mu.Lock()
+				ots.result.timedOut = true
+				ots.mu.Unlock()
+
+				// Keep waiting for resets, as a session which frees its
+				// slot for another restarts the timeout.
+				ots.shutdownIfIdle(fmt.Sprintf("no connection within supplied timeout (%v)", ots.timeout))
+			case <-ots.timeoutReset:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(ots.timeout)
+				logNotice(fmt.Sprintf("timeout reset, waiting another %v for a connection", ots.timeout))
+			case <-cctx.Done():
+				return nil
+			}
 		}
-		return nil
 	})
 
-	err := ots.server.ListenAndServe()
+	// Every listener feeds the same server, so the first session on any of
+	// them is the one session.
+	errs := make(chan error, len(ots.listeners))
+	for _, l := range ots.listeners {
+		go func(l net.Listener) {
+			errs <- ots.server.Serve(l)
+		}(l)
+	}
+
+	err := <-errs
+	if !errors.Is(err, ssh.ErrServerClosed) {
+		// Stop the other listeners too.
+		ots.server.Close()
+	}
+	for i := 1; i < len(ots.listeners); i++ {
+		<-errs
+	}
+
+	if errors.Is(err, ssh.ErrServerClosed) {
+		// Close may still be waiting for connections to finish.
+		<-ots.closed
+	}
+	ots.waitForSessions()
 	return err
 }
 
+// sessionEndTimeout is how long Serve waits for sessions in progress to end
+// once the server has closed. Closing the server closes their connections,
+// which kills their shells, so they normally end straight away.
+const sessionEndTimeout = 5 * time.Second
+
+// waitForSessions waits for the sessions in progress to end, so that Result
+// and SessionError describe them.
+func (ots *oneTimeServer) waitForSessions() {
+	done := make(chan struct{})
+	go func() {
+		ots.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(sessionEndTimeout):
+		logWarn(fmt.Sprintf("sessions still running %v after the server closed, exiting without waiting for them", sessionEndTimeout))
+	}
+}
+
+func (ots *oneTimeServer) handleSession(s ssh.Session) {
+	s = clampPty(s)
+
+	if ots.opts.subsystem != "" && s.Subsystem() == "" {
+		logWarn(fmt.Sprintf("rejected shell request %v: only the %v subsystem is allowed", describeSession(s), ots.opts.subsystem))
+		io.WriteString(s.Stderr(), "This server only allows the "+ots.opts.subsystem+" subsystem.\n")
+		s.Exit(1)
+		return
+	}
+
+	fingerprint := gossh.FingerprintSHA256(s.PublicKey())
+
+	ots.mu.Lock()
+	shell := ots.shells[fingerprint]
+	ots.mu.Unlock()
+
+	if shell != nil && shell.reattach(ots.countSession(s)) {
+		return
+	}
+
+	if ots.ready != nil && !ots.ready.wait(s) {
+		return
+	}
+
+	if ots.opts.approveSession != nil {
+		if !ots.opts.approveSession(s) {
+			logWarn("session " + describeSession(s) + " was not approved by the operator")
+			io.WriteString(s.Stderr(), "This session was not approved.\n")
+			s.Exit(1)
+			return
+		}
+		logNotice("session " + describeSession(s) + " was approved by the operator")
+	}
+
+	if ots.opts.oncePerKey {
+		ots.handleOncePerKeySession(s, fingerprint)
+		return
+	}
+
+	ots.mu.Lock()
+	closing := ots.closing
+	inUse := ots.started
+	ots.started = true
+	ots.mu.Unlock()
+
+	if closing {
+		return
+	}
+
+	if inUse {
+		logWarn("rejected session " + describeSession(s) + ": the server is already in use by another session")
+		io.WriteString(s.Stderr(), "This one-time server is already in use by another session.\n")
+		s.Exit(1)
+		return
+	}
+
+	if ots.runSession(s, fingerprint) {
+		ots.mu.Lock()
+		ots.started = false
+		ots.mu.Unlock()
+
+		ots.ResetTimeout()
+		return
+	}
+
+	// Close in the background, as a graceful shutdown waits for this
+	// session's connection to end.
+	go ots.Close()
+}
+
+// handleOncePerKeySession runs s, unless the key it authenticated with has
+// already been used for a session. The server is closed once every authorized
+// key has been used and their sessions have ended.
+func (ots *oneTimeServer) handleOncePerKeySession(s ssh.Session, fingerprint string) {
+	ots.mu.Lock()
+	if ots.closing || ots.usedKeys[fingerprint] {
+		ots.mu.Unlock()
+		logWarn("rejected session " + describeSession(s) + ": its key has already been used")
+		io.WriteString(s.Stderr(), "This key has already been used for a session.\n")
+		s.Exit(1)
+		return
+	}
+	ots.usedKeys[fingerprint] = true
+	ots.active++
+	ots.mu.Unlock()
+
+	retry := ots.runSession(s, fingerprint)
+
+	ots.mu.Lock()
+	if retry {
+		delete(ots.usedKeys, fingerprint)
+	}
+	ots.active--
+	done := ots.active == 0 && (ots.closing || ots.allKeysUsedLocked())
+	ots.mu.Unlock()
+
+	if done {
+		logNotice("all sessions have ended, exiting")
+		go ots.Close()
+	}
+}
+
+// allKeysUsedLocked reports whether every authorized key has been used for a
+// session. ots.mu must be held.
+func (ots *oneTimeServer) allKeysUsedLocked() bool {
+	if ots.opts.allowAnyKey {
+		return false
+	}
+
+	for _, key := range ots.authorizedKeys.get() {
+		if !ots.usedKeys[gossh.FingerprintSHA256(key.key)] {
+			return false
+		}
+	}
+	return true
+}
+
+// runSession runs s to completion. It reports whether the session's shell
+// failed early enough that, with -retry-shell, the session shouldn't use up
+// its slot.
+func (ots *oneTimeServer) runSession(s ssh.Session, fingerprint string) bool {
+	ots.running.Add(1)
+	defer ots.running.Done()
+
+	s = ots.countSession(s)
+	start := time.Now()
+
+	logNotice("session connected " + describeSession(s))
+	if conn, ok := s.Context().Value(ssh.ContextKeyConn).(*gossh.ServerConn); ok {
+		logAlgorithms(conn.Conn)
+	}
+
+	s, endEvents := watchSessionEvents(ots.opts, s)
+	defer endEvents()
+
+	if ots.opts.resolveHosts {
+		go logRemoteHostnames(s.RemoteAddr())
+	}
+
+	shell := newAttachment(ots.opts.reconnectGrace, ots.opts.requirePty, ots.opts.readOnly)
+	ots.mu.Lock()
+	ots.shells[fingerprint] = shell
+	ots.mu.Unlock()
+
+	keyOpts := sessionKeyOptions(s)
+	_, _, isPty := s.Pty()
+
+	var err error
+	switch {
+	case ots.opts.proxy != nil:
+		err = ots.withSessionLog(s, func(logs sessionLogs) error {
+			return handleProxySession(logs, ots.opts, s)
+		})
+	case ots.opts.sftpRoot != "":
+		// A command forced by the authorized key isn't run either, as
+		// -sftp-only sessions never run anything.
+		err = handleSFTPSession(ots.opts, s)
+	case keyOpts.command != "" && (!isPty || keyOpts.noPty):
+		err = ots.withSessionLog(s, func(logs sessionLogs) error {
+			return handleForcedCommandSession(logs.output, logs.input, ots.opts, s, keyOpts.command)
+		})
+	case keyOpts.command == "" && s.Subsystem() != "":
+		err = handleSubsystemSession(ots.opts, s)
+	default:
+		err = ots.withSessionLog(s, func(logs sessionLogs) error {
+			return handleSSHSession(logs, ots.opts, s, shell)
+		})
+	}
+
+	var early *earlyExitError
+	if ots.opts.retryShell && errors.As(err, &early) {
+		logWarn(fmt.Sprintf("shell failed %v after starting, waiting for another session", early.elapsed.Round(time.Millisecond)))
+		logNotice("session disconnected")
+		return true
+	}
+
+	ots.mu.Lock()
+	if ots.result.sessions == 0 || start.Before(ots.result.start) {
+		ots.result.start = start
+		ots.result.remoteAddress = s.RemoteAddr().String()
+	}
+	ots.result.sessions++
+	if _, isExit := shellExitCode(err); err != nil && !isExit {
+		err = &sessionError{err: err}
+	}
+	if ots.sessionErr == nil {
+		ots.sessionErr = err
+	}
+	ots.result.end = time.Now()
+	ots.mu.Unlock()
+
+	logNotice("session disconnected")
+	return false
+}
+
+// sessionLogs are the logs a session is recorded to.
+type sessionLogs struct {
+	// output is the session log.
+	output io.Writer
+
+	// input is the -log-input log, or nil if -log-input isn't set.
+	input io.Writer
+
+	// resizes is the -log-resizes log, or nil if -log-resizes isn't set or
+	// the session has no PTY.
+	resizes *resizeLog
+}
+
+// withSessionLog calls handle with the logs for s: the session log shared by
+// every session, or its own log if opts.openSessionLog is set, and its
+// -log-input and -log-resizes logs.
+func (ots *oneTimeServer) withSessionLog(s ssh.Session, handle func(logs sessionLogs) error) error {
+	logs := sessionLogs{output: ots.logWriter}
+	name := ""
+	if ots.opts.openSessionLog == nil {
+		if ots.opts.flushSessionLog != nil {
+			defer ots.opts.flushSessionLog()
+		}
+	} else {
+		ots.mu.Lock()
+		ots.sessions++
+		n := ots.sessions
+		ots.mu.Unlock()
+
+		logWriter, closeLog, err := ots.opts.openSessionLog(n)
+		if err != nil {
+			io.WriteString(s.Stderr(), "Failed to open the session log.\n")
+			s.Exit(1)
+			return fmt.Errorf("failed to open log for session %v: %w", n, err)
+		}
+		defer closeLog()
+
+		logs.output = &bestEffortWriter{w: logWriter}
+		name = fmt.Sprintf("session-%v", n)
+	}
+
+	input, closeInput, err := ots.openInputLog(s, name)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	logs.input = input
+
+	if _, _, isPty := s.Pty(); isPty && ots.opts.resizeLogPath != "" {
+		resizes, err := openResizeLogFile(ots.opts, s, name)
+		if err != nil {
+			io.WriteString(s.Stderr(), "Failed to open the session log.\n")
+			s.Exit(1)
+			return fmt.Errorf("failed to open resize log: %w", err)
+		}
+		defer resizes.Close()
+		logs.resizes = resizes
+	}
+
+	return handle(logs)
+}
+
+// openInputLog opens the -log-input file for s, if it is set, returning it
+// and a function which closes it. A nil writer is returned if -log-input
+// isn't set.
+func (ots *oneTimeServer) openInputLog(s ssh.Session, name string) (io.Writer, func(), error) {
+	if ots.opts.inputLogPath == "" {
+		return nil, func() {}, nil
+	}
+
+	inputLog, closeInput, err := openInputLogFile(ots.opts, s, name)
+	if err != nil {
+		io.WriteString(s.Stderr(), "Failed to open the session log.\n")
+		s.Exit(1)
+		return nil, nil, fmt.Errorf("failed to open input log: %w", err)
+	}
+	return inputLog, closeInput, nil
+}
+
+// shutdownIfIdle closes the server for the given reason, unless a session has
+// started. In once-per-key mode, no further sessions are started, and the
+// server closes once the sessions in progress have ended.
+func (ots *oneTimeServer) shutdownIfIdle(reason string) {
+	if !ots.opts.oncePerKey {
+		ots.mu.Lock()
+		idle := !ots.started && !ots.closing
+		if idle {
+			ots.closing = true
+		}
+		ots.mu.Unlock()
+
+		if idle {
+			logWarn(reason + ", exiting")
+			ots.Close()
+		}
+		return
+	}
+
+	ots.mu.Lock()
+	ots.closing = true
+	active := ots.active
+	ots.mu.Unlock()
+
+	if active > 0 {
+		logWarn(fmt.Sprintf("%v, exiting once %v active sessions have ended", reason, active))
+		return
+	}
+
+	logWarn(reason + ", exiting")
+	ots.Close()
+}
+
+// handleConn is called for each new connection, before the SSH handshake. It
+// returns nil to refuse the connection.
+func (ots *oneTimeServer) handleConn(ctx ssh.Context, conn net.Conn) net.Conn {
+	if elapsed, first := ots.recordFirst(&ots.result.firstConnection); first {
+		logNotice(fmt.Sprintf("first connection attempt from %v, %v after the server started", conn.RemoteAddr(), elapsed))
+	}
+
+	if addrInNets(conn.RemoteAddr(), ots.opts.denyFrom) {
+		logWarn(fmt.Sprintf("refused connection from %v: address matches -deny-from", conn.RemoteAddr()))
+		return nil
+	}
+
+	if ots.opts.maxAttempts > 0 {
+		ots.mu.Lock()
+		ots.attempts++
+		attempts := ots.attempts
+		ots.mu.Unlock()
+
+		if attempts > ots.opts.maxAttempts {
+			ots.shutdownIfIdle(fmt.Sprintf("connection attempt limit (%v) reached", ots.opts.maxAttempts))
+			return nil
+		}
+	}
+
+	if ots.opts.authTimeout > 0 {
+		authenticated := new(int32)
+		ctx.SetValue(authenticatedContextKey, authenticated)
+
+		time.AfterFunc(ots.opts.authTimeout, func() {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			if atomic.LoadInt32(authenticated) == 0 {
+				logWarn(fmt.Sprintf("dropping connection from %v: not authenticated within %v", conn.RemoteAddr(), ots.opts.authTimeout))
+				conn.Close()
+			}
+		})
+	}
+
+	return conn
+}
+
+// authFunc decides whether a connection may authenticate with key, returning
+// the reason for its decision.
+type authFunc func(ctx ssh.Context, key ssh.PublicKey) (ok bool, reason string)
+
+// approveFunc decides whether a session which has authenticated may start.
+type approveFunc func(s ssh.Session) bool
+
+// authHook customises authentication. It is passed the default authFunc,
+// which checks the key against the authorized keys, and may call it, adjust
+// its decision or ignore it entirely.
+type authHook func(ctx ssh.Context, key ssh.PublicKey, next authFunc) (ok bool, reason string)
+
+// handlePublicKey reports whether a connection may authenticate with key,
+// logging the reason.
+func (ots *oneTimeServer) handlePublicKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	var ok bool
+	var reason string
+	if ots.opts.authHook != nil {
+		ok, reason = ots.opts.authHook(ctx, key, ots.authenticate)
+	} else {
+		ok, reason = ots.authenticate(ctx, key)
+	}
+
+	fingerprint := gossh.FingerprintSHA256(key)
+	if !ok {
+		logWarn(fmt.Sprintf("rejected key %v for user %v from %v: %v", fingerprint, ctx.User(), ctx.RemoteAddr(), reason))
+		if ots.opts.sealOnFailure {
+			logError(fmt.Sprintf("SEALING THE SERVER: %v presented key %v, which was rejected, and -seal-on-failure is set", ctx.RemoteAddr(), fingerprint))
+
+			// Shut down in the background, as a graceful shutdown waits
+			// for this connection to end.
+			go ots.shutdownIfIdle("sealed after a rejected key")
+		}
+		return false
+	}
+
+	logNotice(fmt.Sprintf("accepted key %v for user %v from %v: %v", fingerprint, ctx.User(), ctx.RemoteAddr(), reason))
+	if elapsed, first := ots.recordFirst(&ots.result.firstAuth); first {
+		logNotice(fmt.Sprintf("first successful authentication, %v after the server started", elapsed))
+	}
+	if authenticated, ok := ctx.Value(authenticatedContextKey).(*int32); ok {
+		atomic.StoreInt32(authenticated, 1)
+	}
+	return true
+}
+
+// authenticate is the default authFunc, which accepts the authorized keys.
+func (ots *oneTimeServer) authenticate(ctx ssh.Context, key ssh.PublicKey) (bool, string) {
+	if reason := ots.opts.clientPolicy.check(ctx.ClientVersion()); reason != "" {
+		return false, reason
+	}
+
+	if ots.opts.allowHours != nil {
+		if t := now(); !ots.opts.allowHours.contains(t) {
+			return false, fmt.Sprintf("it is %v, outside of the allowed hours (%v)", t.In(ots.opts.allowHours.loc).Format("15:04"), ots.opts.allowHours)
+		}
+	}
+
+	if len(ots.opts.allowUsers) > 0 && !contains(ots.opts.allowUsers, ctx.User()) {
+		return false, "user is not allowed"
+	}
+
+	if ots.opts.allowAnyKey {
+		return true, "-allow-any-key is set"
+	}
+
+	for _, authorizedKey := range ots.authorizedKeys.get() {
+		if ssh.KeysEqual(key, authorizedKey.key) {
+			ctx.SetValue(keyCommentContextKey, authorizedKey.comment)
+			ctx.SetValue(keyOptionsContextKey, authorizedKey.options)
+			return true, "key is authorized"
+		}
+	}
+	return false, "key is not authorized"
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetTimeout restarts the wait for a connection, as if the server had just
+// started.
+func (ots *oneTimeServer) ResetTimeout() {
+	select {
+	case ots.timeoutReset <- struct{}{}:
+	default:
+	}
+}
+
+// Close shuts the server down. If a shutdown grace period is configured,
+// connections in progress are given that long to end before they are closed.
 func (ots *oneTimeServer) Close() error {
-	return ots.server.Close()
+	defer ots.closedOnce.Do(func() { close(ots.closed) })
+	if ots.web != nil {
+		defer ots.web.Close()
+	}
+
+	if ots.opts.shutdownGrace <= 0 {
+		return ots.server.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ots.opts.shutdownGrace)
+	defer cancel()
+
+	if err := ots.server.Shutdown(ctx); err != nil {
+		logWarn(fmt.Sprintf("connections still open after %v, closing them", ots.opts.shutdownGrace))
+		return ots.server.Close()
+	}
+	return nil
 }
 
+// SessionError returns the error the session ended with, if any. If no
+// session started before the timeout and -timeout-exit-code is set, it is a
+// *timeoutError.
 func (ots *oneTimeServer) SessionError() error {
+	ots.mu.Lock()
+	defer ots.mu.Unlock()
+
+	if ots.result.timedOut && ots.result.sessions == 0 && ots.opts.timeoutExitCode != 0 {
+		return &timeoutError{timeout: ots.timeout, code: ots.opts.timeoutExitCode}
+	}
 	return ots.sessionErr
 }
 
-func handleSSHSession(logWriter io.Writer, copyEnv bool, s ssh.Session) error {
+// logRemoteHostnames logs the result of a reverse DNS lookup of addr. Lookups
+// can be slow, so this is intended to be run in its own goroutine.
+func logRemoteHostnames(addr net.Addr) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		logWarn(fmt.Sprintf("failed to parse remote address %v: %v", addr, err))
+		return
+	}
+
+	names, err := net.LookupAddr(host)
+	if err != nil {
+		logWarn(fmt.Sprintf("reverse DNS lookup of %v failed: %v", host, err))
+		return
+	}
+
+	logNotice(fmt.Sprintf("session remote address %v resolves to %v", host, strings.Join(names, ", ")))
+}
+
+// describeSession describes who s is connected from, for logging.
+func describeSession(s ssh.Session) string {
+	description := fmt.Sprintf("from %v as user %v", s.RemoteAddr(), s.User())
+	if comment := keyComment(s); comment != "" {
+		description += fmt.Sprintf(", authenticated as %v", comment)
+	}
+	return description
+}
+
+// keyComment returns the comment of the authorized key that s authenticated
+// with.
+func keyComment(s ssh.Session) string {
+	comment, _ := s.Context().Value(keyCommentContextKey).(string)
+	return comment
+}
+
+func userShell() string {
 	shell := os.Getenv("SHELL")
 	if shell == "" {
 		shell = "bash"
 	}
+	return shell
+}
+
+// shellCommand returns the command to run in a session's PTY: the -program
+// if one was given, the -multiplex multiplexer, and otherwise the user's
+// shell.
+func shellCommand(opts options) *exec.Cmd {
+	if opts.multiplex != "" {
+		return multiplexCommand(opts.multiplex)
+	}
 
-	cmd := exec.Command(shell)
+	if len(opts.program) > 0 {
+		return exec.Command(opts.program[0], opts.program[1:]...)
+	}
+
+	shell := userShell()
+
+	cmd := exec.Command(shell, opts.shellArgs...)
+	if opts.loginShell {
+		// By convention, a leading dash in argv[0] tells the shell that it is
+		// a login shell.
+		cmd.Args[0] = "-" + filepath.Base(shell)
+	}
+	return cmd
+}
+
+func handleSSHSession(logs sessionLogs, opts options, s ssh.Session, shell *attachment) error {
+	logWriter, inputLog := logs.output, logs.input
+	if opts.message != "" {
+		message := opts.message
+		if !strings.HasSuffix(message, "\n") {
+			message += "\n"
+		}
+		_, err := io.WriteString(s, message)
+		return err
+	}
+
+	cmd := shellCommand(opts)
+	if command := sessionKeyOptions(s).command; command != "" {
+		cmd = exec.Command(userShell(), "-c", command)
+		if original := s.RawCommand(); original != "" {
+			cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+original)
+		}
+		logNotice(fmt.Sprintf("running command forced by the authorized key: %v", command))
+	}
 
 	ptyReq, winCh, isPty := s.Pty()
-	if !isPty {
-		io.WriteString(s, "No PTY requested.\n")
+	if !isPty || sessionKeyOptions(s).noPty {
+		rejectNoPty(s, opts.requirePty)
 		return nil
 	}
+	winCh = watchResizes(opts, s, winCh)
 
-	if copyEnv {
-		cmd.Env = append(cmd.Env, os.Environ()...)
+	if opts.copyEnv {
+		environ := os.Environ()
+		if opts.warnSensitiveEnv {
+			if names := sensitiveEnv(environ, opts.sensitiveEnvPatterns); len(names) > 0 {
+				logWarn(fmt.Sprintf("copying potentially sensitive environment variables to the session: %v", strings.Join(names, ", ")))
+			}
+		}
+		cmd.Env = append(cmd.Env, environ...)
 	}
 
+	cmd.Env = append(cmd.Env, clientLocaleEnv(s.Environ())...)
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-	f, err := pty.Start(cmd)
+	if comment := keyComment(s); comment != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("OTSSH_KEY_COMMENT=%s", comment))
+	}
+	cmd.Env = append(cmd.Env, keyEnvironment(s)...)
+	if opts.multiplex != "" {
+		cmd.Env = append(cmd.Env, multiplexEnv...)
+	}
+
+	if dir := keyWorkdir(s); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			io.WriteString(s.Stderr(), "Failed to start the session: the working directory "+dir+" does not exist on the server.\n")
+			s.Exit(1)
+			return fmt.Errorf("working directory %v for key %v is not a directory", dir, gossh.FingerprintSHA256(s.PublicKey()))
+		}
+		cmd.Dir = dir
+	}
+
+	if err := writeSessionHeader(logWriter, s, ptyReq); err != nil {
+		return fmt.Errorf("failed to write to log: %w", err)
+	}
+
+	if logs.resizes != nil {
+		logWriter = logs.resizes.countOutput(logWriter)
+		winCh = logResizes(logs.resizes, winCh)
+	}
+
+	start := time.Now()
+	var f *os.File
+	// The PTY starts at the requested size, rather than waiting for the
+	// window changes to set it, so that the shell never sees a size of 0.
+	size := &pty.Winsize{Rows: uint16(ptyReq.Window.Height), Cols: uint16(ptyReq.Window.Width)}
+	err := withUmask(opts.umask, func() (err error) {
+		f, err = pty.StartWithSize(cmd, size)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to start pty: %w", err)
+		// pty.StartWithSize cleans up after itself if the command fails to
+		// start, but make sure nothing is left running if it failed
+		// afterwards.
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+
+		io.WriteString(s.Stderr(), startFailureMessage(cmd, err))
+		err = checkEarlyExit(opts, s.Stderr(), start, fmt.Errorf("failed to start pty: %w", err))
+		s.Exit(1)
+		return err
 	}
 
-	go func() {
-		for win := range winCh {
-			setWinsize(f, win.Width, win.Height)
+	if err := applyRlimits(cmd.Process.Pid, opts.rlimits); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		f.Close()
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+
+	shell.start(f, cmd.Process, s, winCh, inputLog)
+	defer shell.close()
+
+	output := withEventOutput(opts, s, logWriter)
+	if opts.motd != nil && sessionKeyOptions(s).command == "" {
+		if err := writeMOTD(shell, output, opts.motd, s); err != nil {
+			logWarn(fmt.Sprintf("failed to write -motd: %v", err))
 		}
-	}()
+	}
 
+	// Wait for the shell in the background, as processes it leaves running
+	// may hold the PTY open, so that reading from it doesn't end when the
+	// shell exits. Killing them lets the output loop below finish.
+	waitErr := make(chan error, 1)
 	go func() {
-		io.Copy(f, s)
+		err := cmd.Wait()
+		if opts.killRemaining != 0 {
+			// pty.Start starts the shell with Setsid, which also makes it
+			// the leader of a process group of its own, as Setpgid would:
+			// the two can't be combined, as a session leader can't move
+			// to another group.
+			killRemaining(cmd.Process.Pid, opts.killRemaining)
+		}
+		waitErr <- err
 	}()
 
-	r := bufio.NewReaderSize(f, 1024)
-	for {
-		b := make([]byte, 1024)
-		_, err := r.Read(b)
+	if err := copyOutput(shell, output, f); err != nil {
+		return err
+	}
 
-		if _, ok := err.(*os.PathError); ok {
-			break
+	err = <-waitErr
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		logWarn(fmt.Sprintf("shell was killed by signal %v", status.Signal()))
+	}
+	logNotice(fmt.Sprintf("shell exited (%v), using %v", cmd.ProcessState, formatUsage(cmd.ProcessState)))
+
+	err = checkEarlyExit(opts, s.Stderr(), start, err)
+	shell.exit(cmd.ProcessState)
+	return err
+}
+
+// writeSessionHeader writes a block describing s to the log, ahead of the
+// session's output, so that the log makes sense on its own.
+func writeSessionHeader(w io.Writer, s ssh.Session, ptyReq ssh.Pty) error {
+	header := fmt.Sprintf("=== otsshd session ===\n"+
+		"start:       %v\n"+
+		"remote:      %v\n"+
+		"user:        %v\n"+
+		"fingerprint: %v\n"+
+		"term:        %v\n"+
+		"window:      %vx%v\n"+
+		"======================\n",
+		formatNow(), s.RemoteAddr(), s.User(), gossh.FingerprintSHA256(s.PublicKey()),
+		ptyReq.Term, ptyReq.Window.Width, ptyReq.Window.Height)
+
+	_, err := io.WriteString(w, header)
+	return err
+}
+
+// exitCode returns the exit code of a process, using the shell convention of
+// 128+n for a process killed by signal n.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// serverVersionPrefix is the prefix of every SSH 2.0 version string.
+const serverVersionPrefix = "SSH-2.0-"
+
+// validateServerVersion checks that v is a valid SSH protocol version string,
+// as defined by RFC 4253: "SSH-2.0-", then a software version of printable
+// characters other than '-', optionally followed by a space and comments.
+func validateServerVersion(v string) error {
+	if !strings.HasPrefix(v, serverVersionPrefix) {
+		return fmt.Errorf("must start with %q", serverVersionPrefix)
+	}
+
+	// The version line, including the trailing CR LF, may be at most 255
+	// characters long.
+	if len(v) > 253 {
+		return fmt.Errorf("must be at most 253 characters long")
+	}
+
+	for _, c := range v {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("must only contain printable ASCII characters")
 		}
+	}
 
-		if err != nil {
-			return fmt.Errorf("failed to read from command: %w", err)
+	software := strings.SplitN(strings.TrimPrefix(v, serverVersionPrefix), " ", 2)[0]
+	if software == "" {
+		return fmt.Errorf("must include a software version after %q", serverVersionPrefix)
+	}
+	if strings.Contains(software, "-") {
+		return fmt.Errorf("software version %q must not contain '-'", software)
+	}
+
+	return nil
+}
+
+// exitSignalNames are the names of the signals which may be sent in an
+// exit-signal request, as defined by RFC 4254.
+var exitSignalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// parseSignal parses the name of one of the signals in exitSignalNames, with or
+// without its SIG prefix.
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	for sig, sigName := range exitSignalNames {
+		if sigName == name {
+			return sig, nil
 		}
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
 
-		if _, err := logWriter.Write(b); err != nil {
-			return fmt.Errorf("failed to write to log: %w", err)
+// killRemaining sends sig to the processes which the shell, the leader of the
+// process group with ID pgid, left running in its group when it exited.
+func killRemaining(pgid int, sig syscall.Signal) {
+	if err := syscall.Kill(-pgid, sig); err != nil {
+		if err != syscall.ESRCH {
+			logWarn(fmt.Sprintf("failed to signal processes left running by the session: %v", err))
 		}
+		return
+	}
+	logNotice(fmt.Sprintf("sent SIG%v to the processes left running by the session", exitSignalNames[sig]))
+}
+
+// sendExit tells the client how the shell exited, then closes the session. A
+// shell killed by a signal is reported with an exit-signal request, so that the
+// client can report the signal, falling back to an exit status of 128+n for
+// signals which can't be named in one.
+func sendExit(s ssh.Session, state *os.ProcessState) error {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return s.Exit(state.ExitCode())
+	}
+
+	name, ok := exitSignalNames[status.Signal()]
+	if !ok {
+		return s.Exit(exitCode(state))
+	}
+
+	msg := struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Language   string
+	}{Signal: name, CoreDumped: status.CoreDump()}
+
+	_, err := s.SendRequest("exit-signal", false, gossh.Marshal(&msg))
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
 
-		if _, err := s.Write(b); err != nil {
-			return fmt.Errorf("failed to write to session: %w", err)
+// sensitiveEnv returns the names of the variables in environ which match any of
+// the given glob patterns.
+func sensitiveEnv(environ []string, patterns []string) []string {
+	var names []string
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				names = append(names, name)
+				break
+			}
 		}
 	}
+	return names
+}
+
+// rejectNoPty tells the client that a PTY is needed. If requirePty is set, the
+// message is written to stderr and the session exits with a non-zero status.
+func rejectNoPty(s ssh.Session, requirePty bool) {
+	const msg = "No PTY requested. This server only supports interactive sessions: " +
+		"connect with `ssh -t` to request a PTY.\n"
 
-	return cmd.Wait()
+	if !requirePty {
+		io.WriteString(s, msg)
+		return
+	}
+
+	io.WriteString(s.Stderr(), msg)
+	s.Exit(1)
+}
+
+// startFailureMessage returns the message to send to the client when cmd,
+// the session's shell, fails to start with err.
+func startFailureMessage(cmd *exec.Cmd, err error) string {
+	const prefix = "Failed to start the session: "
+
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return prefix + cmd.Path + " does not exist on the server.\n"
+	case errors.Is(err, os.ErrPermission):
+		return prefix + cmd.Path + " is not executable.\n"
+	case errors.Is(err, syscall.ENOEXEC):
+		return prefix + cmd.Path + " is not a program the server can run.\n"
+	default:
+		return prefix + "the server could not start a shell.\n"
+	}
 }
 
 func setWinsize(f *os.File, w, h int) {
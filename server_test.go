@@ -0,0 +1,590 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAuthAccepted(t *testing.T) {
+	key := newTestKey(t)
+	t.Setenv("SHELL", "echo")
+	ts := startTestServer(t, options{shellArgs: []string{"hello"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	if got := ss.stdout.String(); !strings.Contains(got, "hello") {
+		t.Errorf("output = %q, want it to contain %q", got, "hello")
+	}
+	if got := ts.log.String(); !strings.Contains(got, "hello") {
+		t.Errorf("log = %q, want it to contain %q", got, "hello")
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	authorized, other := newTestKey(t), newTestKey(t)
+	t.Setenv("SHELL", "echo")
+	ts := startTestServer(t, options{shellArgs: []string{"hello"}}, authorized.PublicKey())
+
+	client, err := ts.dial(other)
+	if err == nil {
+		client.Close()
+		t.Fatal("connecting with an unauthorized key succeeded")
+	}
+	if !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("error = %v, want an authentication failure", err)
+	}
+
+	// The rejected key doesn't use up the session.
+	ss := ts.startSession(t, authorized, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session with the authorized key failed: %v", err)
+	}
+}
+
+func TestOnlyPublicKeyAuth(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"echo", "hello"}}, key.PublicKey())
+
+	var tried []string
+	password := gossh.PasswordCallback(func() (string, error) {
+		tried = append(tried, "password")
+		return "secret", nil
+	})
+	keyboardInteractive := gossh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		tried = append(tried, "keyboard-interactive")
+		return make([]string, len(questions)), nil
+	})
+	dial := func(auth ...gossh.AuthMethod) (*gossh.Client, error) {
+		return gossh.Dial("tcp", ts.Addr().String(), &gossh.ClientConfig{
+			User:            "test",
+			Auth:            auth,
+			HostKeyCallback: gossh.FixedHostKey(ts.hostKey),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	// Without a key, there is nothing else to try.
+	if client, err := dial(password, keyboardInteractive); err == nil {
+		client.Close()
+		t.Fatal("connecting without a key succeeded")
+	} else if !strings.Contains(err.Error(), "no supported methods remain") {
+		t.Errorf("error = %v, want no methods to remain", err)
+	}
+
+	// The key alone is enough, without a second factor.
+	client, err := dial(password, keyboardInteractive, gossh.PublicKeys(key))
+	if err != nil {
+		t.Fatalf("connecting with the key failed: %v", err)
+	}
+	client.Close()
+
+	if len(tried) > 0 {
+		t.Errorf("server offered %v, want only publickey", tried)
+	}
+}
+
+func TestNoKeyboardInteractivePrompt(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"echo", "hello"}}, key.PublicKey())
+
+	var prompts []string
+	client, err := gossh.Dial("tcp", ts.Addr().String(), &gossh.ClientConfig{
+		User: "test",
+		Auth: []gossh.AuthMethod{gossh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			prompts = append(prompts, instruction+strings.Join(questions, ""))
+			return make([]string, len(questions)), nil
+		})},
+		HostKeyCallback: gossh.FixedHostKey(ts.hostKey),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		client.Close()
+		t.Fatal("connecting with keyboard-interactive authentication succeeded")
+	}
+	if len(prompts) > 0 {
+		t.Errorf("client was prompted with %q, want no challenge", prompts)
+	}
+
+	// The client which was turned away doesn't use up the session.
+	ss := ts.startSession(t, key, false)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session with the authorized key failed: %v", err)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program []string
+		want    int
+	}{
+		{"success", []string{"true"}, 0},
+		{"failure", []string{"false"}, 1},
+		{"code", []string{"sh", "-c", "exit 42"}, 42},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runTestSession(t, options{}, tt.program...)
+			if got := exitStatus(t, err); got != tt.want {
+				t.Errorf("exit status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCodeFromShell(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program []string
+		want    int
+	}{
+		{"success", []string{"true"}, 0},
+		{"failure", []string{"false"}, 1},
+		{"code", []string{"sh", "-c", "exit 42"}, 42},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			ts := startTestServer(t, options{program: tt.program}, key.PublicKey())
+			ts.startSession(t, key, true).wait(t)
+			ts.wait(t)
+
+			// As in main, otsshd only fails if the session did.
+			got := 0
+			if err := ts.SessionError(); err != nil {
+				got = exitCodeFor(err)
+			}
+			if got != tt.want {
+				t.Errorf("otsshd exit code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKillRemaining(t *testing.T) {
+	output, err := runTestSession(t, options{killRemaining: syscall.SIGTERM}, "sh", "-c", "sleep 300 & echo pid=$!")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	m := regexp.MustCompile(`pid=(\d+)`).FindStringSubmatch(output)
+	if m == nil {
+		t.Fatalf("output = %q, want the background job's PID", output)
+	}
+	pid, _ := strconv.Atoi(m[1])
+
+	deadline := time.Now().Add(10 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background job %v is still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// processRunning reports whether the process with the given PID is running.
+// A process which has exited but not yet been reaped by its new parent, which
+// may not reap it promptly in a container, isn't counted as running.
+func processRunning(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return false
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	i := strings.LastIndexByte(string(stat), ')')
+	return i < 0 || !strings.HasPrefix(string(stat[i+1:]), " Z")
+}
+
+func TestValidateServerVersion(t *testing.T) {
+	for _, tt := range []struct {
+		v       string
+		wantErr string
+	}{
+		{v: "SSH-2.0-otsshd"},
+		{v: "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13"},
+		{v: "SSH-2.0-x " + strings.Repeat("c", 243)},
+		{v: "otsshd", wantErr: `must start with "SSH-2.0-"`},
+		{v: "SSH-1.99-otsshd", wantErr: `must start with "SSH-2.0-"`},
+		{v: "SSH-2.0-x " + strings.Repeat("c", 244), wantErr: "at most 253 characters"},
+		{v: "SSH-2.0-otsshd\r\n", wantErr: "printable ASCII"},
+		{v: "SSH-2.0-café", wantErr: "printable ASCII"},
+		{v: "SSH-2.0-", wantErr: "must include a software version"},
+		{v: "SSH-2.0- comment", wantErr: "must include a software version"},
+		{v: "SSH-2.0-ots-shd", wantErr: `software version "ots-shd" must not contain '-'`},
+	} {
+		err := validateServerVersion(tt.v)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validateServerVersion(%q) = %v, want error %q", tt.v, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"true"}, serverVersion: "SSH-2.0-Custom_1.0 test build"}, key.PublicKey())
+
+	client, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if got, want := string(client.ServerVersion()), "SSH-2.0-Custom_1.0 test build"; got != want {
+		t.Errorf("server version = %q, want %q", got, want)
+	}
+}
+
+func TestAllowUser(t *testing.T) {
+	key := newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"true"}, allowUsers: []string{"alice", "bob"}}, key.PublicKey())
+
+	for _, user := range []string{"test", "root", "Alice", "alice,bob"} {
+		if client, err := ts.dialAddr(ts.Addr().String(), user, key); err == nil {
+			client.Close()
+			t.Errorf("user %q was allowed to connect", user)
+		}
+	}
+
+	// Rejected users don't use up the session.
+	client, err := ts.dialAddr(ts.Addr().String(), "bob", key)
+	if err != nil {
+		t.Fatalf("user bob wasn't allowed to connect: %v", err)
+	}
+	client.Close()
+}
+
+func TestShellCommand(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+
+	for _, tt := range []struct {
+		name     string
+		opts     options
+		wantPath string
+		wantArgs []string
+	}{
+		{"shell", options{}, "/bin/sh", []string{"/bin/sh"}},
+		{"login shell", options{loginShell: true}, "/bin/sh", []string{"-sh"}},
+		{"login shell with arguments", options{loginShell: true, shellArgs: []string{"-x"}}, "/bin/sh", []string{"-sh", "-x"}},
+		{"program", options{program: []string{"/bin/echo", "hi"}}, "/bin/echo", []string{"/bin/echo", "hi"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := shellCommand(tt.opts)
+			if cmd.Path != tt.wantPath || strings.Join(cmd.Args, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("shellCommand = %v %q, want %v %q", cmd.Path, cmd.Args, tt.wantPath, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestLoginShell(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	t.Setenv("HOME", t.TempDir())
+
+	key := newTestKey(t)
+	ts := startTestServer(t, options{loginShell: true, shellArgs: []string{"-c", `echo "argv0=$0"`}}, key.PublicKey())
+	ss := ts.startSession(t, key, true)
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	// The shell sees it was started as a login shell from its argv[0].
+	if got := ss.stdout.String(); !strings.Contains(got, "argv0=-sh") {
+		t.Errorf("output = %q, want argv0=-sh", got)
+	}
+}
+
+func TestRequirePty(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		requirePty bool
+		wantStatus int
+		wantStderr bool
+	}{
+		{"not required", false, 0, false},
+		// The message goes to stderr when the session fails because of it.
+		{"required", true, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			ts := startTestServer(t, options{program: []string{"echo", "program"}, requirePty: tt.requirePty}, key.PublicKey())
+
+			ss := ts.startSession(t, key, false)
+			if got := exitStatus(t, ss.wait(t)); got != tt.wantStatus {
+				t.Errorf("exit status = %v, want %v", got, tt.wantStatus)
+			}
+
+			output := ss.stdout
+			if tt.wantStderr {
+				output = ss.stderr
+			}
+			if !strings.Contains(output.String(), "No PTY requested") {
+				t.Errorf("stdout = %q, stderr = %q, want the message on stderr %v", ss.stdout.String(), ss.stderr.String(), tt.wantStderr)
+			}
+			if strings.Contains(ss.stdout.String(), "program") {
+				t.Errorf("program ran without a PTY")
+			}
+		})
+	}
+}
+
+func TestAlreadyInUse(t *testing.T) {
+	first, second := newTestKey(t), newTestKey(t)
+	ts := startTestServer(t, options{program: []string{"cat"}}, first.PublicKey(), second.PublicKey())
+
+	ss := ts.startSession(t, first, true)
+	ss.stdin.Write([]byte("first\r"))
+	ss.waitForOutput(t, "first")
+
+	other := ts.startSession(t, second, true)
+	if got := exitStatus(t, other.wait(t)); got != 1 {
+		t.Errorf("exit status of the second session = %v, want 1", got)
+	}
+	if got, want := other.stderr.String(), "This one-time server is already in use by another session.\n"; got != want {
+		t.Errorf("second session's stderr = %q, want %q", got, want)
+	}
+
+	// The first session carries on, and is the one the server reports.
+	ss.stdin.Write([]byte("still here\r\x04"))
+	ss.waitForOutput(t, "still here")
+	if err := ss.wait(t); err != nil {
+		t.Fatalf("first session failed: %v", err)
+	}
+	ts.wait(t)
+	if err := ts.SessionError(); err != nil {
+		t.Errorf("session error = %v, want the first session's, nil", err)
+	}
+}
+
+func TestSignalExitCode(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program string
+		want    int
+	}{
+		{"exit status", "exit 3", 3},
+		{"SIGTERM", "kill -TERM $$", 128 + int(syscall.SIGTERM)},
+		{"SIGKILL", "kill -KILL $$", 128 + int(syscall.SIGKILL)},
+		{"SIGVTALRM", "kill -VTALRM $$", 128 + int(syscall.SIGVTALRM)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			ts := startTestServer(t, options{program: []string{"sh", "-c", tt.program}}, key.PublicKey())
+			ts.startSession(t, key, true).wait(t)
+			ts.wait(t)
+
+			// otsshd exits with the shell's exit status, or 128+n if it was
+			// killed by signal n, as shells report it.
+			if got := exitCodeFor(ts.SessionError()); got != tt.want {
+				t.Errorf("exit code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitSignal(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		program    string
+		wantSignal string
+		wantStatus int
+	}{
+		{"SIGTERM", "kill -TERM $$", "TERM", 0},
+		{"SIGKILL", "kill -KILL $$", "KILL", 0},
+		{"SIGUSR1", "kill -USR1 $$", "USR1", 0},
+		// Signals RFC 4254 doesn't name are reported as 128+n.
+		{"SIGVTALRM", "kill -VTALRM $$", "", 128 + int(syscall.SIGVTALRM)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runTestSession(t, options{}, "sh", "-c", tt.program)
+
+			var exitErr *gossh.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("session error = %v, want an exit error", err)
+			}
+			if exitErr.Signal() != tt.wantSignal || tt.wantSignal == "" && exitErr.ExitStatus() != tt.wantStatus {
+				t.Errorf("exit signal = %q, status %v, want %q, status %v", exitErr.Signal(), exitErr.ExitStatus(), tt.wantSignal, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestStartFailureMessage(t *testing.T) {
+	dir := t.TempDir()
+	notExecutable := filepath.Join(dir, "not-executable")
+	if err := ioutil.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	notAProgram := filepath.Join(dir, "not-a-program")
+	if err := ioutil.WriteFile(notAProgram, []byte("\x00\x01\x02\x03"), 0755); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		program string
+		want    string
+	}{
+		{"missing", filepath.Join(dir, "missing"), " does not exist on the server."},
+		{"not in PATH", "otsshd-no-such-program", " does not exist on the server."},
+		{"not executable", notExecutable, " is not executable."},
+		{"not a program", notAProgram, " is not a program the server can run."},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newTestKey(t)
+			ts := startTestServer(t, options{program: []string{tt.program}}, key.PublicKey())
+			ss := ts.startSession(t, key, true)
+			if got := exitStatus(t, ss.wait(t)); got != 1 {
+				t.Errorf("exit status = %v, want 1", got)
+			}
+
+			want := "Failed to start the session: " + tt.program + tt.want
+			if got := ss.stderr.String(); !strings.Contains(got, want) {
+				t.Errorf("stderr = %q, want it to contain %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProgram(t *testing.T) {
+	// The program's arguments are passed as they are, not interpreted by a
+	// shell, and it runs in the session's PTY.
+	output, err := runTestSession(t, options{}, "sh", "-c", `printf '%s|' "$@"; test -t 0 && echo tty`, "sh", "a b", "$HOME", "*")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if want := "a b|$HOME|*|tty\r\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	program := []string{"sh", "-c", "echo started; read line; echo finished"}
+
+	t.Run("finishes", func(t *testing.T) {
+		key := newTestKey(t)
+		ts := startTestServer(t, options{program: program, shutdownGrace: 10 * time.Second}, key.PublicKey())
+		ss := ts.startSession(t, key, true)
+		ss.waitForOutput(t, "started")
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- ts.Close()
+		}()
+		select {
+		case err := <-closed:
+			t.Fatalf("Close returned %v while the session was running", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// The session is left to finish, then the server closes once the
+		// client disconnects.
+		ss.stdin.Write([]byte("\r"))
+		if err := ss.wait(t); err != nil {
+			t.Fatalf("session failed: %v", err)
+		}
+		ss.waitForOutput(t, "finished")
+		ss.client.Close()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close didn't return after the client disconnected")
+		}
+		ts.wait(t)
+	})
+
+	t.Run("runs out", func(t *testing.T) {
+		key := newTestKey(t)
+		ts := startTestServer(t, options{program: program, shutdownGrace: 100 * time.Millisecond}, key.PublicKey())
+		ss := ts.startSession(t, key, true)
+		ss.waitForOutput(t, "started")
+
+		// The session is closed once the grace period runs out.
+		ts.Close()
+		ss.wait(t)
+		ts.wait(t)
+		if got, want := exitCodeFor(ts.SessionError()), 128+int(syscall.SIGKILL); got != want {
+			t.Errorf("exit code = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNewOneTimeServerInvalid(t *testing.T) {
+	signer, _, err := newHostKey()
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	keys := newKeySet([]authorizedKey{{key: newTestKey(t).PublicKey()}})
+	addrs := []string{"127.0.0.1:0"}
+
+	for _, tt := range []struct {
+		name    string
+		keys    *keySet
+		signer  ssh.Signer
+		log     io.Writer
+		opts    options
+		wantErr string
+	}{
+		{"no host key", keys, nil, ioutil.Discard, options{addrs: addrs}, "no host key given"},
+		{"no key set", nil, signer, ioutil.Discard, options{addrs: addrs}, "no authorized keys given"},
+		{"no keys", newKeySet(nil), signer, ioutil.Discard, options{addrs: addrs}, "no authorized keys given"},
+		{"no log", keys, signer, nil, options{addrs: addrs}, "no log writer given"},
+		{"no address", keys, signer, ioutil.Discard, options{}, "no listen address given"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newOneTimeServer(tt.keys, tt.signer, tt.log, tt.opts)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("newOneTimeServer = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Keys aren't needed when any key is allowed, or a hook decides, and a
+	// log writer isn't needed when each session opens its own.
+	for _, opts := range []options{
+		{addrs: addrs, allowAnyKey: true},
+		{addrs: addrs, authHook: func(ctx ssh.Context, key ssh.PublicKey, next authFunc) (bool, string) { return true, "" }},
+	} {
+		if _, err := newOneTimeServer(newKeySet(nil), signer, ioutil.Discard, opts); err != nil {
+			t.Errorf("newOneTimeServer with no keys failed: %v", err)
+		}
+	}
+	openLog := func(n int) (io.Writer, func(), error) { return ioutil.Discard, func() {}, nil }
+	if _, err := newOneTimeServer(keys, signer, nil, options{addrs: addrs, openSessionLog: openLog}); err != nil {
+		t.Errorf("newOneTimeServer with no log writer failed: %v", err)
+	}
+}
+
+func TestShutdownIfIdleTwice(t *testing.T) {
+	ts := startTestServer(t, options{timeout: 100 * time.Millisecond}, newTestKey(t).PublicKey())
+	ts.wait(t)
+
+	// A second call, such as -max-attempts being reached while the timeout
+	// is shutting the server down, mustn't clear the closing flag set by the
+	// first.
+	ts.shutdownIfIdle("second")
+
+	ts.mu.Lock()
+	closing := ts.closing
+	ts.mu.Unlock()
+	if !closing {
+		t.Error("server isn't closing after the second shutdownIfIdle")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// handleSFTPSession serves SFTP for -sftp-only, confined to opts.sftpRoot,
+// which the client sees as /.
+func handleSFTPSession(opts options, s ssh.Session) error {
+	h := &sftpHandler{root: opts.sftpRoot}
+	server := sftp.NewRequestServer(s, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	defer server.Close()
+
+	logNotice(fmt.Sprintf("starting SFTP session in %v", opts.sftpRoot))
+	if err := server.Serve(); err != nil && err != io.EOF {
+		s.Exit(1)
+		return fmt.Errorf("SFTP: %w", err)
+	}
+	s.Exit(0)
+	return nil
+}
+
+// sftpRootDir returns the directory to confine -sftp-only sessions to: dir, or
+// the current directory if it is empty, as an absolute path without symbolic
+// links, so that paths can be checked against it.
+func sftpRootDir(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%v is not a directory", dir)
+	}
+	return root, nil
+}
+
+// rejectPty rejects PTY requests for -sftp-only, as no shell will be run.
+func rejectPty(ctx ssh.Context, pty ssh.Pty) bool {
+	logWarn(fmt.Sprintf("rejected PTY request from %v: only SFTP is allowed", ctx.RemoteAddr()))
+	return false
+}
+
+// sftpHandler serves SFTP requests from the files under root. Paths from the
+// client are relative to root, and may not leave it, including by following
+// symbolic links, which clients can't create.
+type sftpHandler struct {
+	root string
+}
+
+// lpath returns the path on disk of name, a path from the client. The last
+// element of name isn't followed if it is a symbolic link, as for operations
+// on the link itself, such as removing it.
+func (h *sftpHandler) lpath(name string) (string, error) {
+	p := filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+name)))
+	if p == h.root {
+		return p, nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", clientPathError(err, name)
+	}
+	if !h.contains(dir) {
+		return "", &os.PathError{Op: "access", Path: name, Err: syscall.EACCES}
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
+
+// path is like lpath, but follows the last element of name if it is a
+// symbolic link.
+func (h *sftpHandler) path(name string) (string, error) {
+	p, err := h.lpath(name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// A file which doesn't exist yet, such as one being uploaded,
+		// is created in the directory lpath checked, unless p is a link
+		// to it, which could point anywhere.
+		if _, err := os.Lstat(p); err == nil {
+			return "", &os.PathError{Op: "access", Path: name, Err: syscall.EACCES}
+		}
+		return p, nil
+	case err != nil:
+		return "", clientPathError(err, name)
+	case !h.contains(resolved):
+		return "", &os.PathError{Op: "access", Path: name, Err: syscall.EACCES}
+	}
+	return resolved, nil
+}
+
+// contains reports whether p, a path with no symbolic links, is under root.
+func (h *sftpHandler) contains(p string) bool {
+	rel, err := filepath.Rel(h.root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// clientPathError returns err with the path on disk replaced by name, the
+// path the client used, so that clients don't learn where root is.
+func clientPathError(err error, name string) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return &os.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return &os.PathError{Op: linkErr.Op, Path: name, Err: linkErr.Err}
+	}
+	return err
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return h.open(r, os.O_RDONLY)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.open(r, os.O_WRONLY)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.open(r, os.O_RDWR)
+}
+
+// open opens the file r refers to with flag and the flags r was opened with.
+// Appending is done by the client writing at the end of the file, as
+// os.File.WriteAt can't be used with O_APPEND.
+func (h *sftpHandler) open(r *sftp.Request, flag int) (*sftpFile, error) {
+	p, err := h.path(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(p, flag, 0666)
+	if err != nil {
+		return nil, clientPathError(err, r.Filepath)
+	}
+	return &sftpFile{File: f, name: r.Filepath, write: flag&(os.O_WRONLY|os.O_RDWR) != 0}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		return h.rename(r, false)
+	case "Mkdir":
+		p, err := h.lpath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(p, 0777); err != nil {
+			return clientPathError(err, r.Filepath)
+		}
+		logNotice(fmt.Sprintf("SFTP: created directory %v", r.Filepath))
+	case "Rmdir":
+		p, err := h.lpath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Rmdir(p); err != nil {
+			return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: err}
+		}
+		logNotice(fmt.Sprintf("SFTP: removed directory %v", r.Filepath))
+	case "Remove":
+		p, err := h.lpath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Unlink(p); err != nil {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: err}
+		}
+		logNotice(fmt.Sprintf("SFTP: removed %v", r.Filepath))
+	case "Link":
+		oldPath, err := h.lpath(r.Filepath)
+		if err != nil {
+			return err
+		}
+		newPath, err := h.lpath(r.Target)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(oldPath, newPath); err != nil {
+			return clientPathError(err, r.Target)
+		}
+		logNotice(fmt.Sprintf("SFTP: linked %v to %v", r.Target, r.Filepath))
+	default:
+		// Symbolic links aren't allowed, as they could point outside
+		// root.
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return nil
+}
+
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	return h.rename(r, true)
+}
+
+// rename renames the file r refers to to r.Target, replacing r.Target if
+// replace is set, or failing if it exists otherwise, as SFTP's rename does.
+func (h *sftpHandler) rename(r *sftp.Request, replace bool) error {
+	oldPath, err := h.lpath(r.Filepath)
+	if err != nil {
+		return err
+	}
+	newPath, err := h.lpath(r.Target)
+	if err != nil {
+		return err
+	}
+
+	if !replace {
+		if _, err := os.Lstat(newPath); err == nil {
+			return &os.PathError{Op: "rename", Path: r.Target, Err: syscall.EEXIST}
+		}
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return clientPathError(err, r.Filepath)
+	}
+	logNotice(fmt.Sprintf("SFTP: renamed %v to %v", r.Filepath, r.Target))
+	return nil
+}
+
+// setstat changes the size, permissions and times of the file r refers to.
+// Ownership isn't changed, as files belong to the user otsshd runs as.
+func (h *sftpHandler) setstat(r *sftp.Request) error {
+	p, err := h.path(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+			return clientPathError(err, r.Filepath)
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return clientPathError(err, r.Filepath)
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(p, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return clientPathError(err, r.Filepath)
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		p, err := h.path(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, clientPathError(err, r.Filepath)
+		}
+		defer f.Close()
+
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, clientPathError(err, r.Filepath)
+		}
+		return sftpListing(infos), nil
+	case "Stat":
+		p, err := h.path(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, clientPathError(err, r.Filepath)
+		}
+		return sftpListing{info}, nil
+	default:
+		// Reading links isn't supported, as their targets are paths on
+		// disk rather than paths the client can use.
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := h.lpath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, clientPathError(err, r.Filepath)
+	}
+	return sftpListing{info}, nil
+}
+
+// sftpListing is the result of listing a directory or statting a file.
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpFile is a file opened by an SFTP client, which logs how much was
+// transferred once it is closed.
+type sftpFile struct {
+	*os.File
+	name  string
+	write bool
+
+	read, written atomic.Int64
+}
+
+func (f *sftpFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) Close() error {
+	if f.write {
+		logNotice(fmt.Sprintf("SFTP: uploaded %v (%v)", f.name, formatBytes(f.written.Load())))
+	} else {
+		logNotice(fmt.Sprintf("SFTP: downloaded %v (%v)", f.name, formatBytes(f.read.Load())))
+	}
+	return f.File.Close()
+}
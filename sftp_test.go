@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer starts a -sftp-only server confined to a new directory,
+// returning a client connected to it and the directory.
+func startSFTPServer(t *testing.T) (*sftp.Client, string) {
+	t.Helper()
+
+	root, err := sftpRootDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to resolve root: %v", err)
+	}
+	key := newTestKey(t)
+	ts := startTestServer(t, options{subsystem: "sftp", sftpRoot: root}, key.PublicKey())
+
+	conn, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("failed to start SFTP: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, root
+}
+
+func TestSFTPOnly(t *testing.T) {
+	client, root := startSFTPServer(t)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "existing"), []byte("download me"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	f, err := client.Open("/existing")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "download me" {
+		t.Errorf("downloaded %q, %v, want %q", b, err, "download me")
+	}
+
+	if err := client.Mkdir("/dir"); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	f, err = client.Create("/dir/uploaded")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := f.Write([]byte("uploaded")); err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+	f.Close()
+	if b, err := ioutil.ReadFile(filepath.Join(root, "dir", "uploaded")); err != nil || string(b) != "uploaded" {
+		t.Errorf("uploaded file holds %q, %v, want %q", b, err, "uploaded")
+	}
+
+	if err := client.Rename("/dir/uploaded", "/existing"); err == nil {
+		t.Errorf("rename replaced an existing file")
+	}
+	if err := client.PosixRename("/dir/uploaded", "/renamed"); err != nil {
+		t.Errorf("failed to rename: %v", err)
+	}
+	if err := client.Remove("/existing"); err != nil {
+		t.Errorf("failed to remove file: %v", err)
+	}
+	if err := client.RemoveDirectory("/dir"); err != nil {
+		t.Errorf("failed to remove directory: %v", err)
+	}
+
+	infos, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "renamed" {
+		t.Errorf("root holds %v, want renamed", got)
+	}
+}
+
+func TestSFTPConfined(t *testing.T) {
+	client, root := startSFTPServer(t)
+
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	for name, target := range map[string]string{
+		"file-link":     filepath.Join(outside, "secret"),
+		"dir-link":      outside,
+		"dangling-link": filepath.Join(outside, "created"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("failed to create link: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "secret"), []byte("inside"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// Leaving the root with .. ends up at the root instead.
+	for _, name := range []string{"../secret", "/../../secret", "dir/../../secret"} {
+		f, err := client.Open(name)
+		if err != nil {
+			t.Errorf("failed to open %v: %v", name, err)
+			continue
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if string(b) != "inside" {
+			t.Errorf("%v holds %q, want the file in the root", name, b)
+		}
+	}
+
+	for _, name := range []string{"/file-link", "/dir-link/secret"} {
+		if _, err := client.Open(name); err == nil {
+			t.Errorf("opened %v, outside the root", name)
+		}
+		if _, err := client.Stat(name); err == nil {
+			t.Errorf("statted %v, outside the root", name)
+		}
+	}
+	if _, err := client.ReadDir("/dir-link"); err == nil {
+		t.Errorf("listed a directory outside the root")
+	}
+	if _, err := client.Create("/dangling-link"); err == nil {
+		t.Errorf("created a file through a link to outside the root")
+	}
+	if _, err := client.Create("/dir-link/created"); err == nil {
+		t.Errorf("created a file in a directory outside the root")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "created")); err == nil {
+		t.Errorf("a file was created outside the root")
+	}
+
+	if err := client.Symlink("/", "/new-link"); err == nil {
+		t.Errorf("created a symbolic link")
+	}
+
+	// Links themselves can be seen and removed, without touching their
+	// targets.
+	if info, err := client.Lstat("/file-link"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat of link = %v, %v, want a link", info, err)
+	}
+	if err := client.Remove("/file-link"); err != nil {
+		t.Errorf("failed to remove link: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("removing the link removed its target: %v", err)
+	}
+}
+
+func TestSFTPOnlyRejectsShell(t *testing.T) {
+	root, err := sftpRootDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to resolve root: %v", err)
+	}
+	key := newTestKey(t)
+	ts := startTestServer(t, options{subsystem: "sftp", sftpRoot: root}, key.PublicKey())
+
+	conn, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for _, tt := range []struct {
+		name  string
+		start func(*gossh.Session) error
+	}{
+		{"shell", func(s *gossh.Session) error { return s.Shell() }},
+		{"command", func(s *gossh.Session) error { return s.Start("id") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := conn.NewSession()
+			if err != nil {
+				t.Fatalf("failed to open session: %v", err)
+			}
+			defer session.Close()
+
+			var stderr syncBuffer
+			session.Stderr = &stderr
+			if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err == nil {
+				t.Errorf("PTY request was accepted")
+			}
+			if err := tt.start(session); err != nil {
+				t.Fatalf("failed to start session: %v", err)
+			}
+			if got := exitStatus(t, session.Wait()); got != 1 {
+				t.Errorf("exit status = %v, want 1", got)
+			}
+			if got := stderr.String(); !strings.Contains(got, "only allows the sftp subsystem") {
+				t.Errorf("stderr = %q, want it to say why the session was rejected", got)
+			}
+		})
+	}
+}
+
+func TestSFTPRootDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+	want, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("failed to resolve %v: %v", dir, err)
+	}
+
+	for _, tt := range []struct {
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{dir: dir, want: want},
+		{dir: link, want: want},
+		{dir: file, wantErr: true},
+		{dir: filepath.Join(dir, "missing"), wantErr: true},
+	} {
+		got, err := sftpRootDir(tt.dir)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sftpRootDir(%q) = %q, %v, want %q, error %v", tt.dir, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
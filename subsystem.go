@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// handleSubsystemSession runs opts.subsystemCommand for a session which
+// requested the -subsystem subsystem, connecting its standard input and output
+// to the session. No PTY is allocated.
+func handleSubsystemSession(opts options, s ssh.Session) error {
+	cmd := pipedCommand(opts, s, opts.subsystemCommand)
+
+	logNotice(fmt.Sprintf("starting %v subsystem: %v", s.Subsystem(), opts.subsystemCommand))
+	if err := runPiped(cmd, s, opts.umask, nil, nil); err != nil {
+		return fmt.Errorf("%v subsystem: %w", s.Subsystem(), err)
+	}
+	return nil
+}
+
+// handleForcedCommandSession runs the command forced by the authorized key s
+// authenticated with, for a session without a PTY, writing its output to
+// logWriter, and its input to inputLog, if it isn't nil.
+func handleForcedCommandSession(logWriter, inputLog io.Writer, opts options, s ssh.Session, command string) error {
+	cmd := pipedCommand(opts, s, command)
+
+	logNotice(fmt.Sprintf("running command forced by the authorized key: %v", command))
+	return runPiped(cmd, s, opts.umask, withEventOutput(opts, s, logWriter), inputLog)
+}
+
+// pipedCommand returns a command which runs command using the shell, for a
+// session without a PTY.
+func pipedCommand(opts options, s ssh.Session, command string) *exec.Cmd {
+	cmd := exec.Command(userShell(), "-c", command)
+	if opts.copyEnv {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, keyEnvironment(s)...)
+	if original := s.RawCommand(); original != "" && sessionKeyOptions(s).command != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+original)
+	}
+	cmd.Dir = keyWorkdir(s)
+	return cmd
+}
+
+// runPiped runs cmd with its standard input and output connected to s, and
+// the given umask, if it isn't nil, and sends the client its exit status. If
+// log isn't nil, the output is written to it too, and if input isn't nil, so
+// is the input.
+func runPiped(cmd *exec.Cmd, s ssh.Session, umask *int, log, input io.Writer) error {
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	if log != nil {
+		cmd.Stdout = io.MultiWriter(s, log)
+		cmd.Stderr = io.MultiWriter(s.Stderr(), log)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+
+	if err := withUmask(umask, cmd.Start); err != nil {
+		io.WriteString(s.Stderr(), startFailureMessage(cmd, err))
+		s.Exit(1)
+		return fmt.Errorf("failed to start: %w", err)
+	}
+
+	// The input isn't waited for, as the client may keep the session open
+	// after the command has exited.
+	go func() {
+		io.Copy(stdin, teeInput(s, input))
+		stdin.Close()
+	}()
+
+	err = cmd.Wait()
+	sendExit(s, cmd.ProcessState)
+	return err
+}
+
+// rejectSubsystem rejects a request for a subsystem other than the -subsystem
+// subsystem.
+func rejectSubsystem(s ssh.Session) {
+	logWarn(fmt.Sprintf("rejected request for the %v subsystem %v", s.Subsystem(), describeSession(s)))
+	io.WriteString(s.Stderr(), "This subsystem is not available.\n")
+	s.Exit(1)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSubsystemOnly(t *testing.T) {
+	log := captureLog(t)
+	key := newTestKey(t)
+	ts := startTestServer(t, options{subsystem: "greeter", subsystemCommand: "echo hello from greeter"}, key.PublicKey())
+
+	conn, err := ts.dial(key)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for _, tt := range []struct {
+		name       string
+		start      func(*gossh.Session) error
+		wantStderr string
+		wantStdout string
+		wantLog    string
+	}{
+		{
+			name:       "shell",
+			start:      func(s *gossh.Session) error { return s.Shell() },
+			wantStderr: "This server only allows the greeter subsystem.\n",
+			wantLog:    "rejected shell request",
+		},
+		{
+			name:       "command",
+			start:      func(s *gossh.Session) error { return s.Start("id") },
+			wantStderr: "This server only allows the greeter subsystem.\n",
+			wantLog:    "rejected shell request",
+		},
+		{
+			name:       "other subsystem",
+			start:      func(s *gossh.Session) error { return s.RequestSubsystem("sftp") },
+			wantStderr: "This subsystem is not available.\n",
+			wantLog:    "rejected request for the sftp subsystem",
+		},
+		// The allowed subsystem is last, as its session uses up the server.
+		{
+			name:       "allowed subsystem",
+			start:      func(s *gossh.Session) error { return s.RequestSubsystem("greeter") },
+			wantStdout: "hello from greeter\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := conn.NewSession()
+			if err != nil {
+				t.Fatalf("failed to open session: %v", err)
+			}
+			defer session.Close()
+
+			// Wait can't be used for subsystems, which gossh doesn't
+			// count as started, so the output is read until the session
+			// closes instead.
+			stdout, err := session.StdoutPipe()
+			if err != nil {
+				t.Fatalf("failed to open stdout: %v", err)
+			}
+			stderr, err := session.StderrPipe()
+			if err != nil {
+				t.Fatalf("failed to open stderr: %v", err)
+			}
+			before := len(log.String())
+			if err := tt.start(session); err != nil {
+				t.Fatalf("failed to start session: %v", err)
+			}
+			if got, _ := ioutil.ReadAll(stderr); string(got) != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", got, tt.wantStderr)
+			}
+			if got, _ := ioutil.ReadAll(stdout); string(got) != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", got, tt.wantStdout)
+			}
+			if logged := log.String()[before:]; tt.wantLog != "" && !strings.Contains(logged, tt.wantLog) {
+				t.Errorf("logged %q, want it to contain %q", logged, tt.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// tailQueueSize is the number of writes buffered for each viewer. A
+	// viewer which falls this far behind is disconnected.
+	tailQueueSize = 1024
+
+	// tailCloseTimeout is how long Close waits for viewers to be sent the
+	// rest of the log.
+	tailCloseTimeout = 5 * time.Second
+)
+
+// tailServer streams the session log over HTTP, like `tail -f`, for
+// -tail-addr. It is sent the session output as it is logged, and each viewer
+// is sent the end of the log so far, kept in a ringBuffer, followed by
+// everything written to it until the server closes. Viewers must present the
+// token, in the same way as for the monitor.
+type tailServer struct {
+	token    string
+	listener net.Listener
+	server   *http.Server
+
+	mu      sync.Mutex
+	backlog *ringBuffer
+	viewers map[chan []byte]bool
+	closed  bool
+}
+
+// newTailServer starts serving the log on addr to viewers which present token,
+// sending them the last backlogSize bytes of it when they connect.
+func newTailServer(addr, token string, backlogSize int) (*tailServer, error) {
+	if token == "" {
+		return nil, errors.New("a token is required")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	t := &tailServer{
+		token:    token,
+		listener: listener,
+		backlog:  newRingBuffer(backlogSize),
+		viewers:  make(map[chan []byte]bool),
+	}
+	t.server = &http.Server{Handler: t}
+	go t.server.Serve(listener)
+	return t, nil
+}
+
+// Addr returns the address the tail server is listening on.
+func (t *tailServer) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Write sends b to every viewer, and keeps it for viewers which connect later.
+// It never fails, so that viewers can't interrupt logging.
+func (t *tailServer) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.backlog.Write(b)
+
+	if len(t.viewers) == 0 {
+		return len(b), nil
+	}
+
+	chunk := append([]byte(nil), b...)
+	for viewer := range t.viewers {
+		select {
+		case viewer <- chunk:
+		default:
+			// Dropping output would leave the viewer with a misleading
+			// log, so disconnect it instead.
+			delete(t.viewers, viewer)
+			close(viewer)
+		}
+	}
+	return len(b), nil
+}
+
+func (t *tailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasToken(r, t.token) {
+		logWarn(fmt.Sprintf("rejected tail viewer from %v: invalid token", r.RemoteAddr))
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	viewer := make(chan []byte, tailQueueSize)
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	backlog := t.backlog.Bytes()
+	t.viewers[viewer] = true
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		if t.viewers[viewer] {
+			delete(t.viewers, viewer)
+			close(viewer)
+		}
+		t.mu.Unlock()
+	}()
+
+	logNotice(fmt.Sprintf("tail viewer connected from %v", r.RemoteAddr))
+	defer logNotice(fmt.Sprintf("tail viewer disconnected from %v", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(backlog)
+	flusher.Flush()
+
+	for {
+		select {
+		case chunk, ok := <-viewer:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Close stops accepting viewers, and ends the streams of those which are
+// connected, waiting a short time for them to be sent what is queued.
+func (t *tailServer) Close() {
+	t.mu.Lock()
+	t.closed = true
+	for viewer := range t.viewers {
+		delete(t.viewers, viewer)
+		close(viewer)
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tailCloseTimeout)
+	defer cancel()
+
+	if err := t.server.Shutdown(ctx); err != nil {
+		t.server.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// States of transcriptWriter's escape sequence parser.
+const (
+	transcriptText = iota
+	transcriptEscape
+	transcriptEscapeIntermediate
+	transcriptCSI
+	transcriptOSC
+	transcriptOSCEscape
+)
+
+// transcriptWriter writes a human-readable transcript of the output of a
+// terminal session. Escape sequences and control characters are stripped, and
+// each line is prefixed with the time at which it was completed, unless
+// timestamps is false.
+type transcriptWriter struct {
+	w          io.Writer
+	timestamps bool
+	state      int
+	line       []byte
+}
+
+func newTranscriptWriter(w io.Writer) *transcriptWriter {
+	return &transcriptWriter{w: w, timestamps: true}
+}
+
+func (t *transcriptWriter) Write(b []byte) (int, error) {
+	for _, c := range b {
+		switch t.state {
+		case transcriptText:
+			switch {
+			case c == 0x1b:
+				t.state = transcriptEscape
+			case c == '\n':
+				if err := t.writeLine(); err != nil {
+					return 0, err
+				}
+			case c == '\t' || c >= 0x20 && c != 0x7f:
+				t.line = append(t.line, c)
+			}
+		case transcriptEscape:
+			switch {
+			case c == '[':
+				t.state = transcriptCSI
+			case c == ']':
+				t.state = transcriptOSC
+			case c >= 0x20 && c <= 0x2f:
+				t.state = transcriptEscapeIntermediate
+			default:
+				t.state = transcriptText
+			}
+		case transcriptEscapeIntermediate:
+			if c >= 0x30 && c <= 0x7e {
+				t.state = transcriptText
+			}
+		case transcriptCSI:
+			if c >= 0x40 && c <= 0x7e {
+				t.state = transcriptText
+			}
+		case transcriptOSC:
+			switch c {
+			case 0x07:
+				t.state = transcriptText
+			case 0x1b:
+				t.state = transcriptOSCEscape
+			}
+		case transcriptOSCEscape:
+			if c == '\\' {
+				t.state = transcriptText
+			} else {
+				t.state = transcriptOSC
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any incomplete final line.
+func (t *transcriptWriter) Flush() error {
+	if len(t.line) == 0 {
+		return nil
+	}
+	return t.writeLine()
+}
+
+func (t *transcriptWriter) writeLine() error {
+	var line []byte
+	if t.timestamps {
+		line = append(line, time.Now().Format(time.RFC3339)+" "...)
+	}
+	line = append(line, t.line...)
+	line = append(line, '\n')
+	t.line = t.line[:0]
+
+	_, err := writeFull(t.w, line)
+	return err
+}
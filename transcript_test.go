@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptWriter(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"plain lines", []string{"one\r\ntwo\r\n"}, "one\ntwo\n"},
+		{"incomplete line", []string{"prompt$ "}, "prompt$ \n"},
+		{"tabs kept", []string{"a\tb\n"}, "a\tb\n"},
+		{"control characters", []string{"bell\a back\b del\x7f nul\x00\n"}, "bell back del nul\n"},
+		{"colours", []string{"\x1b[1;31merror\x1b[0m: failed\n"}, "error: failed\n"},
+		{"cursor movement", []string{"\x1b[2J\x1b[H\x1b[?25lscreen\x1b[?25h\n"}, "screen\n"},
+		{"title with bell", []string{"\x1b]0;user@host: ~\atext\n"}, "text\n"},
+		{"title with string terminator", []string{"\x1b]2;title\x1b\\text\n"}, "text\n"},
+		{"escape inside title", []string{"\x1b]0;a\x1bb\atext\n"}, "text\n"},
+		{"character set", []string{"\x1b(Bascii\n"}, "ascii\n"},
+		{"two character escape", []string{"\x1b=keypad\x1b>\n"}, "keypad\n"},
+		{"split sequence", []string{"before\x1b", "[3", "1mafter\n"}, "beforeafter\n"},
+		{"split title", []string{"\x1b]0;ti", "tle\x1b", "\\text\n"}, "text\n"},
+		{"utf-8", []string{"caf\xc3\xa9 \xe2\x9c\x93\n"}, "café ✓\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newTranscriptWriter(&buf)
+			w.timestamps = false
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %v, %v", s, n, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("transcript = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranscriptTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	w := newTranscriptWriter(&buf)
+	w.Write([]byte("first\r\nsecond\r\n"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("transcript = %q, want 2 lines", buf.String())
+	}
+	for i, want := range []string{"first", "second"} {
+		stamp, text, _ := strings.Cut(lines[i], " ")
+		if _, err := time.Parse(time.RFC3339, stamp); err != nil {
+			t.Errorf("line %q doesn't start with a timestamp: %v", lines[i], err)
+		}
+		if text != want {
+			t.Errorf("line %v = %q, want %q", i, text, want)
+		}
+	}
+
+	// Nothing is written for an empty final line.
+	buf.Reset()
+	if err := w.Flush(); err != nil || buf.Len() != 0 {
+		t.Errorf("Flush with no incomplete line wrote %q, %v", buf.String(), err)
+	}
+}
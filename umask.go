@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// parseUmask parses an octal umask, such as 022 or 0077.
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0o777 {
+		return 0, fmt.Errorf("%q is not an octal umask between 000 and 777", s)
+	}
+	return int(mask), nil
+}
+
+// umaskMu serializes the changes withUmask makes to the process's umask.
+var umaskMu sync.Mutex
+
+// withUmask calls start, which starts a command, with the process's umask set
+// to umask if it isn't nil. The umask is process-wide, so it can't be set for
+// the command alone, but the command keeps the umask it was forked with, so
+// it's restored as soon as start returns. Files otsshd creates from other
+// goroutines in the meantime get the command's umask too.
+func withUmask(umask *int, start func() error) error {
+	if umask == nil {
+		return start()
+	}
+
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	old := syscall.Umask(*umask)
+	defer syscall.Umask(old)
+	return start()
+}
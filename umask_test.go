@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseUmask(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "022", want: 0o22},
+		{in: "0077", want: 0o77},
+		{in: "777", want: 0o777},
+		{in: "0", want: 0},
+		{in: "1000", wantErr: true},
+		{in: "088", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := parseUmask(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUmask(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseUmask(%q) = %04o, want %04o", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUmaskSession(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0o022))
+
+	umask := 0o077
+	output, err := runTestSession(t, options{umask: &umask}, "sh", "-c", "umask")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if !strings.Contains(output, "0077") {
+		t.Errorf("output = %q, want the umask 0077", output)
+	}
+
+	// otsshd's own umask is restored once the shell has started.
+	if got := syscall.Umask(0o022); got != 0o022 {
+		t.Errorf("otsshd's umask = %04o, want it restored to 0022", got)
+	}
+}
+
+func TestUmaskMissingShell(t *testing.T) {
+	umask := 0o077
+	key := newTestKey(t)
+	ts := startTestServer(t, options{umask: &umask, program: []string{"/nonexistent/shell"}}, key.PublicKey())
+
+	ss := ts.startSession(t, key, true)
+	if got := exitStatus(t, ss.wait(t)); got != 1 {
+		t.Errorf("exit status = %v, want 1", got)
+	}
+
+	const want = "/nonexistent/shell does not exist on the server"
+	if got := ss.stderr.String(); !strings.Contains(got, want) {
+		t.Errorf("stderr = %q, want it to contain %q", got, want)
+	}
+}
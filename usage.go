@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// formatUsage describes the resources used by a process which has exited, for
+// the notice logged at the end of a session. The maximum resident set size is
+// left out on platforms which don't report it.
+func formatUsage(state *os.ProcessState) string {
+	usage := fmt.Sprintf("%v user and %v system CPU time",
+		state.UserTime().Round(time.Millisecond), state.SystemTime().Round(time.Millisecond))
+
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return usage
+	}
+
+	// macOS reports the maximum resident set size in bytes, and everything
+	// else in kilobytes.
+	maxRSS := int64(rusage.Maxrss)
+	if runtime.GOOS != "darwin" {
+		maxRSS *= 1024
+	}
+
+	return fmt.Sprintf("%v, %v maximum resident memory", usage, formatBytes(maxRSS))
+}
+
+// formatBytes formats n bytes in the largest binary unit it fills, such as
+// 1.5MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
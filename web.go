@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	webWriteTimeout = 10 * time.Second
+
+	// webUser is the username web sessions are logged with.
+	webUser = "web"
+
+	// webKeyComment is logged in place of the comment of an authorized key
+	// for web sessions.
+	webKeyComment = "web terminal"
+)
+
+// webTerminal serves a terminal in the browser, for -web-addr, so that the
+// session can be used without an SSH client. The page runs xterm.js, which
+// connects back over a websocket, and the websocket is handled as a session
+// with a PTY, in the same way as an SSH session. Browsers must present the
+// token, which is generated at startup and can only be used once.
+type webTerminal struct {
+	token    string
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	handle   func(ssh.Session)
+
+	// key identifies web sessions wherever an SSH session is identified by
+	// the key it authenticated with, such as in the log.
+	key gossh.PublicKey
+
+	mu       sync.Mutex
+	used     bool
+	closed   bool
+	sessions map[*webSession]bool
+}
+
+// newWebTerminal starts serving the web terminal on addr, passing each
+// session to handle.
+func newWebTerminal(addr string, handle func(ssh.Session)) (*webTerminal, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	t := &webTerminal{
+		token:    hex.EncodeToString(b),
+		listener: listener,
+		handle:   handle,
+		key:      key,
+		sessions: make(map[*webSession]bool),
+		upgrader: websocket.Upgrader{
+			// Browsers are authenticated by the token rather than by
+			// where the page came from.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", t.servePage)
+	mux.HandleFunc("/ws", t.serveSession)
+	t.server = &http.Server{Handler: mux}
+	go t.server.Serve(listener)
+	return t, nil
+}
+
+// Addr returns the address the web terminal is listening on.
+func (t *webTerminal) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// URL returns the address to open the web terminal at, including its token.
+// host is interpreted as by formatConnectionHint.
+func (t *webTerminal) URL(host string) (string, error) {
+	host, port, err := connectionHost(host, t.Addr())
+	if err != nil {
+		return "", err
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/?token=" + t.token, nil
+}
+
+// usable reports whether r presents the token, and it hasn't been used yet.
+func (t *webTerminal) usable(w http.ResponseWriter, r *http.Request) bool {
+	if !hasToken(r, t.token) {
+		logWarn(fmt.Sprintf("rejected web terminal connection from %v: invalid token", r.RemoteAddr))
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+
+	t.mu.Lock()
+	used := t.used
+	t.mu.Unlock()
+	if used {
+		logWarn(fmt.Sprintf("rejected web terminal connection from %v: the token has already been used", r.RemoteAddr))
+		http.Error(w, "this link has already been used", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+func (t *webTerminal) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !t.usable(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, webTerminalPage)
+}
+
+func (t *webTerminal) serveSession(w http.ResponseWriter, r *http.Request) {
+	if !t.usable(w, r) {
+		return
+	}
+
+	conn, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+
+	t.mu.Lock()
+	if t.closed || t.used {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.used = true
+	s := newWebSession(conn, r, t.key)
+	t.sessions[s] = true
+	t.mu.Unlock()
+
+	logNotice(fmt.Sprintf("web terminal connected from %v", r.RemoteAddr))
+	go s.readInput()
+	t.handle(s)
+	s.Close()
+
+	t.mu.Lock()
+	delete(t.sessions, s)
+	t.mu.Unlock()
+}
+
+// Close stops serving the web terminal and disconnects its sessions.
+func (t *webTerminal) Close() {
+	t.mu.Lock()
+	t.closed = true
+	sessions := t.sessions
+	t.sessions = make(map[*webSession]bool)
+	t.mu.Unlock()
+
+	t.server.Close()
+	for s := range sessions {
+		s.Close()
+	}
+}
+
+// webMessage is a control message sent as a text message over the websocket:
+// a resize from the browser, or the exit status of the session from the
+// server. Input and output are sent as binary messages.
+type webMessage struct {
+	Type   string `json:"type"`
+	Cols   int    `json:"cols,omitempty"`
+	Rows   int    `json:"rows,omitempty"`
+	Status *int   `json:"status,omitempty"`
+}
+
+// webSession is a session in the web terminal, which implements ssh.Session
+// so that it can be handled like an SSH session with a PTY. It has no command
+// or environment, and signals can't be sent to it.
+type webSession struct {
+	conn *websocket.Conn
+	ctx  *webContext
+	pty  ssh.Pty
+
+	winCh chan ssh.Window
+
+	input      *io.PipeReader
+	inputWrite *io.PipeWriter
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWebSession(conn *websocket.Conn, r *http.Request, key gossh.PublicKey) *webSession {
+	window := ssh.Window{Width: defaultWidth, Height: defaultHeight}
+	if cols, err := strconv.Atoi(r.URL.Query().Get("cols")); err == nil {
+		window.Width = cols
+	}
+	if rows, err := strconv.Atoi(r.URL.Query().Get("rows")); err == nil {
+		window.Height = rows
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	s := &webSession{
+		conn: conn,
+		ctx: &webContext{
+			Context: ctx,
+			cancel:  cancel,
+			remote:  remote,
+			local:   local,
+			values: map[interface{}]interface{}{
+				keyCommentContextKey: webKeyComment,
+			},
+			key: key,
+		},
+		pty:   ssh.Pty{Term: "xterm-256color", Window: window},
+		winCh: make(chan ssh.Window, 1),
+	}
+	s.input, s.inputWrite = io.Pipe()
+
+	// As with an SSH session, the window channel starts with the size
+	// of the PTY, which the shell's PTY is set to.
+	s.winCh <- window
+	return s
+}
+
+// readInput reads messages from the browser until the websocket is closed,
+// passing input to Read and resizes to the window channel, which is closed
+// once it returns.
+func (s *webSession) readInput() {
+	defer close(s.winCh)
+	defer s.Close()
+
+	for {
+		kind, b, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if kind == websocket.BinaryMessage {
+			if _, err := s.inputWrite.Write(b); err != nil {
+				return
+			}
+			continue
+		}
+
+		var msg webMessage
+		if err := json.Unmarshal(b, &msg); err != nil || msg.Type != "resize" {
+			logDebug(fmt.Sprintf("ignoring unknown message from web terminal: %q", b))
+			continue
+		}
+		select {
+		case s.winCh <- ssh.Window{Width: msg.Cols, Height: msg.Rows}:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *webSession) Read(b []byte) (int, error) {
+	return s.input.Read(b)
+}
+
+func (s *webSession) Write(b []byte) (int, error) {
+	if err := s.send(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// send writes a message to the browser.
+func (s *webSession) send(kind int, b []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+	return s.conn.WriteMessage(kind, b)
+}
+
+// Close closes the websocket, ending the session.
+func (s *webSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeMu.Lock()
+		s.conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		s.writeMu.Unlock()
+
+		s.conn.Close()
+		s.inputWrite.CloseWithError(io.EOF)
+		s.ctx.cancel()
+	})
+	return nil
+}
+
+func (s *webSession) CloseWrite() error {
+	return nil
+}
+
+func (s *webSession) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+// Stderr returns the session itself, as a PTY merges its output streams.
+func (s *webSession) Stderr() io.ReadWriter {
+	return s
+}
+
+// Exit sends the browser the exit status of the session, then closes it.
+func (s *webSession) Exit(code int) error {
+	b, err := json.Marshal(webMessage{Type: "exit", Status: &code})
+	if err == nil {
+		err = s.send(websocket.TextMessage, b)
+	}
+	s.Close()
+	return err
+}
+
+func (s *webSession) User() string {
+	return webUser
+}
+
+func (s *webSession) RemoteAddr() net.Addr {
+	return s.ctx.RemoteAddr()
+}
+
+func (s *webSession) LocalAddr() net.Addr {
+	return s.ctx.LocalAddr()
+}
+
+func (s *webSession) Environ() []string {
+	return nil
+}
+
+func (s *webSession) Command() []string {
+	return nil
+}
+
+func (s *webSession) RawCommand() string {
+	return ""
+}
+
+func (s *webSession) Subsystem() string {
+	return ""
+}
+
+func (s *webSession) PublicKey() ssh.PublicKey {
+	return s.ctx.key
+}
+
+func (s *webSession) Context() ssh.Context {
+	return s.ctx
+}
+
+func (s *webSession) Permissions() ssh.Permissions {
+	return ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
+
+func (s *webSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return s.pty, s.winCh, true
+}
+
+func (s *webSession) Signals(c chan<- ssh.Signal) {}
+
+func (s *webSession) Break(c chan<- bool) {}
+
+// webContext is the ssh.Context of a webSession, which is done once the
+// session has closed.
+type webContext struct {
+	context.Context
+	sync.Mutex
+
+	cancel        context.CancelFunc
+	remote, local net.Addr
+	key           gossh.PublicKey
+
+	valuesMu sync.Mutex
+	values   map[interface{}]interface{}
+}
+
+func (c *webContext) Value(key interface{}) interface{} {
+	c.valuesMu.Lock()
+	v, ok := c.values[key]
+	c.valuesMu.Unlock()
+	if ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *webContext) SetValue(key, value interface{}) {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+	c.values[key] = value
+}
+
+func (c *webContext) User() string {
+	return webUser
+}
+
+func (c *webContext) SessionID() string {
+	return ""
+}
+
+func (c *webContext) ClientVersion() string {
+	return ""
+}
+
+func (c *webContext) ServerVersion() string {
+	return ""
+}
+
+func (c *webContext) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *webContext) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *webContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
+
+// webTerminalPage is the page which runs the terminal in the browser. It loads
+// xterm.js from a CDN, and connects to the websocket with the token it was
+// loaded with.
+const webTerminalPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>otsshd</title>
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.min.css">
+<script src="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.min.js"></script>
+<script src="https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0/lib/addon-fit.min.js"></script>
+<style>
+html, body, #terminal { height: 100%; margin: 0; background: #000; }
+</style>
+</head>
+<body>
+<div id="terminal"></div>
+<script>
+const term = new Terminal({cursorBlink: true});
+const fit = new FitAddon.FitAddon();
+term.loadAddon(fit);
+term.open(document.getElementById("terminal"));
+fit.fit();
+term.focus();
+
+const token = new URLSearchParams(location.search).get("token") || "";
+const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+const ws = new WebSocket(scheme + "//" + location.host + "/ws?token=" + encodeURIComponent(token) +
+	"&cols=" + term.cols + "&rows=" + term.rows);
+ws.binaryType = "arraybuffer";
+
+const encoder = new TextEncoder();
+ws.onmessage = (e) => {
+	if (typeof e.data !== "string") {
+		term.write(new Uint8Array(e.data));
+		return;
+	}
+	const msg = JSON.parse(e.data);
+	if (msg.type === "exit") {
+		term.write("\r\n[session exited with status " + msg.status + "]\r\n");
+	}
+};
+ws.onclose = () => term.write("\r\n[disconnected]\r\n");
+
+term.onData((data) => {
+	if (ws.readyState === WebSocket.OPEN) {
+		ws.send(encoder.encode(data));
+	}
+});
+term.onResize(({cols, rows}) => {
+	if (ws.readyState === WebSocket.OPEN) {
+		ws.send(JSON.stringify({type: "resize", cols: cols, rows: rows}));
+	}
+});
+window.addEventListener("resize", () => fit.fit());
+</script>
+</body>
+</html>
+`
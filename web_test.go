@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webTestSession is a connection to a test server's web terminal.
+type webTestSession struct {
+	conn   *websocket.Conn
+	output strings.Builder
+	status *int
+}
+
+// webTestURL returns the URL of the test server's web terminal, with path
+// and the query parameters in query, which include the token.
+func webTestURL(t *testing.T, ts *testServer, scheme, path string, query url.Values) string {
+	t.Helper()
+
+	link, err := ts.WebURL("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to build link: %v", err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("invalid link %q: %v", link, err)
+	}
+
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.Scheme, u.Path, u.RawQuery = scheme, path, q.Encode()
+	return u.String()
+}
+
+// dialWeb connects to the test server's web terminal with a window of cols by
+// rows.
+func dialWeb(t *testing.T, ts *testServer, cols, rows string) (*webTestSession, *http.Response, error) {
+	t.Helper()
+
+	conn, resp, err := websocket.DefaultDialer.Dial(webTestURL(t, ts, "ws", "/ws", url.Values{"cols": {cols}, "rows": {rows}}), nil)
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &webTestSession{conn: conn}, resp, nil
+}
+
+// readUntil reads from the web terminal until its output contains s, or it
+// exits if s is empty.
+func (ws *webTestSession) readUntil(t *testing.T, s string) {
+	t.Helper()
+
+	ws.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for s == "" || !strings.Contains(ws.output.String(), s) {
+		kind, b, err := ws.conn.ReadMessage()
+		if err != nil {
+			if s == "" && ws.status != nil {
+				return
+			}
+			t.Fatalf("web terminal ended waiting for %q, with output %q: %v", s, ws.output.String(), err)
+		}
+
+		if kind == websocket.BinaryMessage {
+			ws.output.Write(b)
+			continue
+		}
+		var msg webMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			t.Fatalf("invalid message %q: %v", b, err)
+		}
+		if msg.Type == "exit" {
+			ws.status = msg.Status
+		}
+	}
+}
+
+func (ws *webTestSession) send(t *testing.T, input string) {
+	t.Helper()
+
+	if err := ws.conn.WriteMessage(websocket.BinaryMessage, []byte(input)); err != nil {
+		t.Fatalf("failed to send input: %v", err)
+	}
+}
+
+func TestWebTerminal(t *testing.T) {
+	t.Setenv("SHELL", "sh")
+	ts := startTestServer(t, options{
+		webAddr:   "127.0.0.1:0",
+		shellArgs: []string{"-c", `stty size; read line; echo "got $line"; exit 3`},
+	}, newTestKey(t).PublicKey())
+
+	ws, _, err := dialWeb(t, ts, "100", "30")
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	ws.readUntil(t, "30 100")
+	ws.send(t, "hello\r")
+	ws.readUntil(t, "got hello")
+	ws.readUntil(t, "")
+
+	if ws.status == nil || *ws.status != 3 {
+		t.Errorf("exit status = %v, want 3", ws.status)
+	}
+	ts.wait(t)
+	var exitErr *exec.ExitError
+	if err := ts.SessionError(); !errors.As(err, &exitErr) || exitCode(exitErr.ProcessState) != 3 {
+		t.Errorf("session error = %v, want exit status 3", err)
+	}
+
+	log := ts.log.String()
+	for _, want := range []string{"user:        web\n", "got hello"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log = %q, want it to contain %q", log, want)
+		}
+	}
+}
+
+func TestWebTerminalResize(t *testing.T) {
+	t.Setenv("SHELL", "sh")
+	ts := startTestServer(t, options{
+		webAddr:   "127.0.0.1:0",
+		shellArgs: []string{"-c", "while read line; do stty size; done"},
+	}, newTestKey(t).PublicKey())
+
+	ws, _, err := dialWeb(t, ts, "80", "24")
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	if err := ws.conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`)); err != nil {
+		t.Fatalf("failed to resize: %v", err)
+	}
+
+	// The resize reaches the PTY in the background, so keep asking for the
+	// size until it has.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-time.After(50 * time.Millisecond):
+				ws.conn.WriteMessage(websocket.BinaryMessage, []byte("\r"))
+			case <-done:
+				return
+			}
+		}
+	}()
+	ws.readUntil(t, "40 120")
+}
+
+func TestWebTerminalToken(t *testing.T) {
+	t.Setenv("SHELL", "sh")
+	ts := startTestServer(t, options{
+		webAddr:   "127.0.0.1:0",
+		shellArgs: []string{"-c", "read line"},
+	}, newTestKey(t).PublicKey())
+
+	get := func(query url.Values) int {
+		t.Helper()
+
+		resp, err := http.Get(webTestURL(t, ts, "http", "/", query))
+		if err != nil {
+			t.Fatalf("failed to load page: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get(url.Values{"token": {"wrong"}}); got != http.StatusUnauthorized {
+		t.Errorf("page with the wrong token: status %v, want %v", got, http.StatusUnauthorized)
+	}
+	if got := get(nil); got != http.StatusOK {
+		t.Errorf("page: status %v, want %v", got, http.StatusOK)
+	}
+
+	if _, _, err := dialWeb(t, ts, "80", "24"); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	// The token has been used up by the first session.
+	if got := get(nil); got != http.StatusGone {
+		t.Errorf("page after the token was used: status %v, want %v", got, http.StatusGone)
+	}
+	if _, resp, err := dialWeb(t, ts, "80", "24"); err == nil || resp == nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("connecting after the token was used: %v, want status %v", err, http.StatusGone)
+	}
+}